@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+)
+
+const auditCommand = "audit"
+
+var errAuditUsage = errors.New("usage: audit [-file FILE] [-since DURATION|TIME] [-dir PATH] [-command SUBCOMMAND] [-failed] [-json]")
+
+// runAuditCommand queries the audit log of the engine
+func runAuditCommand(args []string, out io.Writer) error {
+	defaultFile, err := engine.DefaultAuditLogFile()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet(auditCommand, flag.ContinueOnError)
+	flags.SetOutput(out)
+
+	file := flags.String("file", defaultFile, "audit log file")
+	since := flags.String("since", "", "only runs started in this duration before now, e.g. 24h, or after this RFC 3339 time")
+	dir := flags.String("dir", "", "only runs in this working directory")
+	command := flags.String("command", "", "only runs of this tofu subcommand, e.g. apply")
+	failed := flags.Bool("failed", false, "only runs which failed")
+	asJSON := flags.Bool("json", false, "print the records as JSON lines")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return errAuditUsage
+	}
+
+	filter := engine.AuditFilter{WorkingDir: *dir, Command: *command, FailedOnly: *failed}
+
+	if *since != "" {
+		if filter.Since, err = parseSince(*since); err != nil {
+			return err
+		}
+	}
+
+	records, err := engine.ReadAuditLog(*file, filter)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 0, tabwriterPadding, ' ', 0)
+
+	fmt.Fprintln(writer, "TIME\tRUN ID\tUSER\tWORKING DIR\tARGS\tEXIT\tDURATION")
+
+	for _, record := range records {
+		duration := time.Duration(record.Duration * float64(time.Second)).Round(time.Millisecond)
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", record.Time.Format(time.RFC3339), record.RunID, record.User,
+			record.WorkingDir, strings.Join(record.Args, " "), record.ExitCode, duration)
+	}
+
+	return writer.Flush()
+}
+
+// parseSince parses a duration before now or an RFC 3339 time
+func parseSince(value string) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -since %q: expected a duration or an RFC 3339 time", value)
+	}
+
+	return since, nil
+}
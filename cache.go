@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+)
+
+const (
+	cacheCommand     = "cache"
+	defaultPruneAge  = 30 * 24 * time.Hour
+	tabwriterPadding = 2
+)
+
+var errUsage = errors.New("usage: cache list [-dir DIR] | cache prune [-dir DIR] [-older-than DURATION] [-dry-run]")
+
+// runCacheCommand lists or prunes the provider cache managed by the engine
+func runCacheCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	defaultDir, err := engine.DefaultProviderCacheDir()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet(cacheCommand+" "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+
+	dir := flags.String("dir", defaultDir, "provider cache directory")
+
+	switch args[0] {
+	case "list":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		providers, err := engine.ListCachedProviders(*dir)
+		if err != nil {
+			return err
+		}
+
+		return printProviders(out, providers)
+	case "prune":
+		olderThan := flags.Duration("older-than", defaultPruneAge, "remove provider versions last used longer ago than this")
+		dryRun := flags.Bool("dry-run", false, "only print the provider versions which would be removed")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		pruned, err := engine.PruneCachedProviders(*dir, *olderThan, *dryRun)
+		if err != nil {
+			return err
+		}
+
+		verb := "Removed"
+		if *dryRun {
+			verb = "Would remove"
+		}
+
+		for _, provider := range pruned {
+			fmt.Fprintf(out, "%s %s %s\n", verb, provider.Address, provider.Version)
+		}
+
+		return nil
+	default:
+		return errUsage
+	}
+}
+
+// printProviders writes the cached providers as a table
+func printProviders(out io.Writer, providers []engine.CachedProvider) error {
+	writer := tabwriter.NewWriter(out, 0, 0, tabwriterPadding, ' ', 0)
+
+	fmt.Fprintln(writer, "PROVIDER\tVERSION\tPLATFORMS\tSIZE\tMODIFIED\tLAST USED")
+
+	for _, provider := range providers {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\t%s\n", provider.Address, provider.Version,
+			strings.Join(provider.Platforms, ","), provider.Size, provider.ModTime.Format(time.RFC3339),
+			provider.LastUsed.Format(time.RFC3339))
+	}
+
+	return writer.Flush()
+}
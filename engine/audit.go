@@ -0,0 +1,295 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaAuditLog     = "audit_log"
+	metaAuditLogFile = "audit_log_file"
+
+	auditLogFileName = "audit.jsonl"
+	auditLogFileMode = 0600
+	auditLogDirMode  = 0700
+	redactedValue    = "REDACTED"
+	runIDLength      = 16
+)
+
+var (
+	ErrInvalidAuditLog = errors.New("invalid audit log configuration")
+
+	// redactedFlags are the flags whose values are always redacted, they commonly carry secrets
+	redactedFlags = []string{"-var", "-backend-config"}
+
+	// sensitiveAssignment matches key=value arguments whose key looks like it names a secret
+	sensitiveAssignment = regexp.MustCompile(`(?i)^([^=]*(password|passwd|secret|token|credential|private_key|access_key)[^=]*)=.*$`)
+)
+
+// AuditRecord describes a single Run in the audit log
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	RunID         string    `json:"run_id"`
+	User          string    `json:"user,omitempty"`
+	Host          string    `json:"host,omitempty"`
+	WorkingDir    string    `json:"working_dir"`
+	BinaryVersion string    `json:"binary_version,omitempty"`
+	BinaryDigest  string    `json:"binary_digest,omitempty"`
+	OutputHash    string    `json:"output_hash"`
+	Args          []string  `json:"args"`
+	EnvKeys       []string  `json:"env_keys"`
+	Duration      float64   `json:"duration_seconds"`
+	ExitCode      int       `json:"exit_code"`
+}
+
+// AuditFilter selects records of the audit log, zero fields match every record
+type AuditFilter struct {
+	Since      time.Time
+	WorkingDir string
+	Command    string
+	FailedOnly bool
+}
+
+// auditLog appends a record of every Run to a JSON lines file
+type auditLog struct {
+	path string
+}
+
+// DefaultAuditLogFile returns the audit log used when audit_log is set without audit_log_file
+func DefaultAuditLogFile() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user cache directory: %w", err)
+	}
+
+	return filepath.Join(cacheDir, "terragrunt", "tofudl", auditLogFileName), nil
+}
+
+// parseAuditLog reads the audit log settings from Init meta, nil when it is disabled
+func parseAuditLog(meta map[string]*anypb.Any) (*auditLog, error) {
+	path := metaString(meta, metaAuditLogFile)
+
+	enabled, err := metaBool(meta, metaAuditLog)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled && path == "" {
+		return nil, nil
+	}
+
+	if path == "" {
+		if path, err = DefaultAuditLogFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAuditLog, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), auditLogDirMode); err != nil {
+		return nil, fmt.Errorf("%w: failed to create directory of %s: %w", ErrInvalidAuditLog, path, err)
+	}
+
+	return &auditLog{path: path}, nil
+}
+
+// audit runs a Run through run and appends its record to the audit log
+func (a *auditLog) audit(req *tgengine.RunRequest, stream tgengine.Engine_RunServer, runID, binary string, run func(tgengine.Engine_RunServer) error) error {
+	output := sha256.New()
+	audited := newResultStream(stream, func(response *tgengine.RunResponse) {
+		_, _ = io.WriteString(output, response.GetStdout())
+		_, _ = io.WriteString(output, response.GetStderr())
+	})
+	start := time.Now()
+
+	err := run(audited)
+
+	record := &AuditRecord{
+		Time:       start.UTC(),
+		RunID:      runID,
+		WorkingDir: req.GetWorkingDir(),
+		Args:       redactArgs(req.GetArgs()),
+		EnvKeys:    envKeys(req),
+		Duration:   time.Since(start).Seconds(),
+		ExitCode:   audited.exitCode(err),
+		OutputHash: hex.EncodeToString(output.Sum(nil)),
+	}
+
+	if record.User = IdentityFromContext(stream.Context()); record.User == "" {
+		if current, err := user.Current(); err == nil {
+			record.User = current.Username
+		}
+	}
+
+	record.Host, _ = os.Hostname()
+	info := tofuBinaries.get(binary)
+	record.BinaryVersion, record.BinaryDigest = info.version, info.digest
+
+	if err := a.append(record); err != nil {
+		log.Errorf("Failed to write audit record of run %s: %v", record.RunID, err)
+	}
+
+	return err
+}
+
+// append writes a record as a single line, under a lock shared with other engine processes
+func (a *auditLog) append(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := acquireFileLock(lockKindAuditLog, a.path+".lock", false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, auditLogFileMode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
+
+// ReadAuditLog returns the records of an audit log which match the filter, oldest first
+func ReadAuditLog(path string, filter AuditFilter) ([]AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		if filter.matches(&record) {
+			records = append(records, record)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// matches reports whether a record is selected by the filter
+func (f AuditFilter) matches(record *AuditRecord) bool {
+	switch {
+	case !f.Since.IsZero() && record.Time.Before(f.Since):
+		return false
+	case f.WorkingDir != "" && filepath.Clean(record.WorkingDir) != filepath.Clean(f.WorkingDir):
+		return false
+	case f.Command != "" && subcommand(record.Args) != f.Command:
+		return false
+	case f.FailedOnly && record.ExitCode == 0:
+		return false
+	default:
+		return true
+	}
+}
+
+// redactArgs replaces the values of variables, backend settings and secret looking assignments
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+
+	for i, arg := range args {
+		switch {
+		case i > 0 && !strings.Contains(args[i-1], "=") && slices.Contains(redactedFlags, normalizeFlag(args[i-1])):
+			redacted[i] = redactAssignment(arg)
+		case strings.HasPrefix(arg, "-") && strings.Contains(arg, "="):
+			flag, value, _ := strings.Cut(arg, "=")
+			if slices.Contains(redactedFlags, normalizeFlag(flag)) {
+				redacted[i] = flag + "=" + redactAssignment(value)
+			} else {
+				redacted[i] = flag + "=" + sensitiveAssignment.ReplaceAllString(value, "${1}="+redactedValue)
+			}
+		default:
+			redacted[i] = sensitiveAssignment.ReplaceAllString(arg, "${1}="+redactedValue)
+		}
+	}
+
+	return redacted
+}
+
+// redactAssignment keeps the name of a name=value assignment and redacts the value. A value without a name, such
+// as a backend config file, is kept.
+func redactAssignment(value string) string {
+	if name, _, found := strings.Cut(value, "="); found {
+		return name + "=" + redactedValue
+	}
+
+	return value
+}
+
+// envKeys returns the sorted names of the environment variables of a request, never their values
+func envKeys(req *tgengine.RunRequest) []string {
+	keys := make([]string, 0, len(req.GetEnvVars()))
+	for key := range req.GetEnvVars() {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+// newRunID returns a random identifier of a run
+func newRunID() string {
+	id := make([]byte, runIDLength)
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,72 @@
+package engine_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTofuEngine_RunWritesAuditLog(t *testing.T) {
+	t.Parallel()
+
+	auditFile := filepath.Join(t.TempDir(), "audit", "runs.jsonl")
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("audit_log_file", auditFile)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `case "$1" in
+version) echo '{"terraform_version":"1.9.0"}' ;;
+apply) echo "apply failed" >&2; exit 1 ;;
+*) echo "ran $1" ;;
+esac
+`))
+
+	workingDir := t.TempDir()
+
+	run := func(args ...string) {
+		t.Helper()
+
+		require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+			WorkingDir: workingDir,
+			Args:       args,
+			EnvVars:    map[string]string{"AWS_SECRET_ACCESS_KEY": "hunter2", "TF_IN_AUTOMATION": "1"},
+		}, &MockRunServer{}))
+	}
+
+	run("plan", "-var=db_password=hunter2", "-var", "region=us-east-1", "-backend-config=backend.hcl", "-lock-timeout=5m")
+	run("apply", "-auto-approve", "-var", "token=hunter2")
+
+	records, err := engine.ReadAuditLog(auditFile, engine.AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	plan := records[0]
+	assert.Len(t, plan.RunID, 32)
+	assert.NotEqual(t, plan.RunID, records[1].RunID)
+	assert.Equal(t, workingDir, plan.WorkingDir)
+	assert.Equal(t, []string{"plan", "-var=db_password=REDACTED", "-var", "region=REDACTED", "-backend-config=backend.hcl", "-lock-timeout=5m"}, plan.Args)
+	assert.Equal(t, []string{"AWS_SECRET_ACCESS_KEY", "TF_IN_AUTOMATION"}, plan.EnvKeys)
+	assert.Equal(t, "1.9.0", plan.BinaryVersion)
+	assert.Len(t, plan.BinaryDigest, 64)
+	assert.Len(t, plan.OutputHash, 64)
+	assert.Equal(t, 0, plan.ExitCode)
+	assert.NotContains(t, plan.Args, "hunter2")
+
+	failed, err := engine.ReadAuditLog(auditFile, engine.AuditFilter{FailedOnly: true})
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, 1, failed[0].ExitCode)
+	assert.Equal(t, []string{"apply", "-auto-approve", "-var", "token=REDACTED"}, failed[0].Args)
+
+	applies, err := engine.ReadAuditLog(auditFile, engine.AuditFilter{Command: "apply", WorkingDir: workingDir})
+	require.NoError(t, err)
+	assert.Len(t, applies, 1)
+
+	recent, err := engine.ReadAuditLog(auditFile, engine.AuditFilter{Since: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, recent)
+}
@@ -0,0 +1,405 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/hashicorp/hcl/v2/hclsimple"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authorizationHeader = "authorization"
+	bearerPrefix        = "bearer "
+)
+
+var (
+	ErrInvalidAuthConfig = errors.New("invalid auth configuration")
+
+	// sessionInitMeta are the Init meta keys which identities without admin may set: options which only affect the
+	// runs of their own session, and Run meta which Terragrunt sends with Init as well. Options which select the
+	// executor, paths on the server or network listeners need admin.
+	sessionInitMeta = []string{
+		"tofu_version",
+		metaCommandMode, metaAllowedCommands, metaDeniedFlags, metaAllowedRoots,
+		metaRetryMaxAttempts, metaRetrySleepInterval, metaRetryMaxSleepInterval, metaRetryableErrors, metaRetryCommands,
+		metaProviderCache, metaPlanStore, metaAuditLog,
+		metaStateBackup, metaStateBackupCompress, metaStateBackupRetention, metaStateBackupMaxAge,
+		metaMaxChanges, metaMaxDeletes, metaProtectAddresses,
+		metaRunLog, metaRunLogMaxSize, metaRunLogMaxBackups, metaRunLogRetention, metaRunLogMaxAge,
+		metaForceInit, metaRunReport, metaJSONEvents, metaSandbox, metaSandboxIsolateNetwork, metaDriftDetection,
+		metaPlanID, metaGuardrailOverride, metaLogLevel,
+	}
+)
+
+// identityContextKey is the context key of the authenticated identity of a request
+type identityContextKey struct{}
+
+// authFile is the HCL schema of the auth configuration file
+type authFile struct {
+	JWT        *jwtBlock       `hcl:"jwt,block"`
+	Identities []identityBlock `hcl:"identity,block"`
+}
+
+// jwtBlock configures the verification of JWTs, whose subject names the identity
+type jwtBlock struct {
+	KeyFile  string `hcl:"key_file"`
+	Issuer   string `hcl:"issuer,optional"`
+	Audience string `hcl:"audience,optional"`
+}
+
+// identityBlock is an identity and the policy of its requests
+type identityBlock struct {
+	Name            string   `hcl:"name,label"`
+	TokenSHA256     string   `hcl:"token_sha256,optional"`
+	AllowedRoots    []string `hcl:"allowed_roots,optional"`
+	AllowedCommands []string `hcl:"allowed_commands,optional"`
+	MaxConcurrency  int      `hcl:"max_concurrency,optional"`
+	Admin           bool     `hcl:"admin,optional"`
+}
+
+// identity is a caller of the engine with its policy
+type identity struct {
+	name         string
+	tokenHash    []byte
+	allowedRoots []string
+	commands     commandPolicy
+
+	// admin may set every Init meta option, other identities only those in sessionInitMeta
+	admin bool
+
+	// running counts the runs of the identity, limited by maxConcurrency when it is positive
+	running        int
+	maxConcurrency int
+}
+
+// Authenticator authenticates the callers of the engine server with bearer tokens or JWTs and authorizes their
+// runs with the policy of their identity
+type Authenticator struct {
+	identities map[string]*identity
+	jwtKey     any
+	jwtParser  *jwt.Parser
+	mu         sync.Mutex
+}
+
+// LoadAuthConfig reads the identities and the JWT verification key from an HCL file, e.g.
+//
+//	jwt {
+//	  key_file = "/etc/tofu-engine/jwt.pem"
+//	  issuer   = "https://ci.example.com"
+//	}
+//
+//	identity "ci" {
+//	  allowed_roots    = ["/srv/units"]
+//	  allowed_commands = ["init", "plan"]
+//	  max_concurrency  = 4
+//	}
+//
+// An identity is authenticated by a JWT whose subject is its name, or by a static bearer token whose SHA-256 is
+// set as token_sha256. Only identities with admin = true may set the Init meta options outside of sessionInitMeta.
+func LoadAuthConfig(path string) (*Authenticator, error) {
+	var file authFile
+	if err := hclsimple.DecodeFile(path, nil, &file); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAuthConfig, err)
+	}
+
+	auth := &Authenticator{identities: map[string]*identity{}}
+
+	for _, block := range file.Identities {
+		if _, exists := auth.identities[block.Name]; exists {
+			return nil, fmt.Errorf("%w: duplicate identity %q", ErrInvalidAuthConfig, block.Name)
+		}
+
+		roots, err := resolveRoots(block.AllowedRoots)
+		if err != nil {
+			return nil, fmt.Errorf("%w: identity %q: %w", ErrInvalidAuthConfig, block.Name, err)
+		}
+
+		identity := &identity{
+			name:           block.Name,
+			allowedRoots:   roots,
+			maxConcurrency: block.MaxConcurrency,
+			commands:       commandPolicy{mode: "identity " + block.Name},
+			admin:          block.Admin,
+		}
+
+		for _, command := range block.AllowedCommands {
+			identity.commands.allowedCommands = append(identity.commands.allowedCommands, strings.Fields(command))
+		}
+
+		if block.TokenSHA256 != "" {
+			if identity.tokenHash, err = hex.DecodeString(block.TokenSHA256); err != nil || len(identity.tokenHash) != sha256.Size {
+				return nil, fmt.Errorf("%w: identity %q: token_sha256 must be a hex encoded SHA-256", ErrInvalidAuthConfig, block.Name)
+			}
+		}
+
+		auth.identities[block.Name] = identity
+	}
+
+	if file.JWT != nil {
+		if err := auth.loadJWTKey(file.JWT); err != nil {
+			return nil, err
+		}
+	}
+
+	return auth, nil
+}
+
+// loadJWTKey reads the key JWTs are verified with: a PEM public key for RS, PS, ES and EdDSA tokens, or otherwise
+// the shared secret of HS tokens
+func (a *Authenticator) loadJWTKey(block *jwtBlock) error {
+	content, err := os.ReadFile(block.KeyFile)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidAuthConfig, err)
+	}
+
+	var methods []string
+
+	switch pemBlock, _ := pem.Decode(content); {
+	case pemBlock == nil:
+		a.jwtKey = content
+		methods = []string{"HS256", "HS384", "HS512"}
+	case pemBlock.Type != "PUBLIC KEY":
+		return fmt.Errorf("%w: %s must hold a PEM public key or a shared secret, got a %s", ErrInvalidAuthConfig, block.KeyFile, pemBlock.Type)
+	default:
+		if a.jwtKey, err = parsePublicKey(content); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidAuthConfig, block.KeyFile, err)
+		}
+
+		methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+
+	if block.Issuer != "" {
+		options = append(options, jwt.WithIssuer(block.Issuer))
+	}
+
+	if block.Audience != "" {
+		options = append(options, jwt.WithAudience(block.Audience))
+	}
+
+	a.jwtParser = jwt.NewParser(options...)
+
+	return nil
+}
+
+// parsePublicKey parses a PEM public key of any type supported for JWTs
+func parsePublicKey(content []byte) (any, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(content); err == nil {
+		return key, nil
+	}
+
+	if key, err := jwt.ParseECPublicKeyFromPEM(content); err == nil {
+		return key, nil
+	}
+
+	return jwt.ParseEdPublicKeyFromPEM(content)
+}
+
+// ServerOptions returns the interceptors which authenticate and authorize the requests of a server
+func (a *Authenticator) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(a.UnaryInterceptor),
+		grpc.ChainStreamInterceptor(a.StreamInterceptor),
+	}
+}
+
+// UnaryInterceptor rejects unary calls without valid credentials, except health checks
+func (a *Authenticator) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if isHealthMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+
+	identity, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(context.WithValue(ctx, identityContextKey{}, identity.name), req)
+}
+
+// StreamInterceptor rejects streams without valid credentials, except health checks, and Run requests which the
+// policy of the identity denies, before they reach the engine
+func (a *Authenticator) StreamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if isHealthMethod(info.FullMethod) {
+		return handler(srv, stream)
+	}
+
+	identity, err := a.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	authorized := &authorizedStream{
+		ServerStream: stream,
+		ctx:          context.WithValue(stream.Context(), identityContextKey{}, identity.name),
+		auth:         a,
+		identity:     identity,
+	}
+	defer authorized.release()
+
+	return handler(srv, authorized)
+}
+
+// authenticate returns the identity of the credentials in the request metadata
+func (a *Authenticator) authenticate(ctx context.Context) (*identity, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(authorizationHeader)
+	if len(values) == 0 || !strings.HasPrefix(strings.ToLower(values[0]), bearerPrefix) {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	token := strings.TrimSpace(values[0][len(bearerPrefix):])
+
+	if a.jwtParser != nil && strings.Count(token, ".") == 2 {
+		claims := jwt.RegisteredClaims{}
+		if _, err := a.jwtParser.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) { return a.jwtKey, nil }); err != nil {
+			log.Warnf("Rejected JWT: %v", err)
+
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+
+		if identity, exists := a.identities[claims.Subject]; exists {
+			return identity, nil
+		}
+
+		return nil, status.Errorf(codes.PermissionDenied, "unknown identity %q", claims.Subject)
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	for _, identity := range a.identities {
+		if identity.tokenHash != nil && subtle.ConstantTimeCompare(identity.tokenHash, hash[:]) == 1 {
+			return identity, nil
+		}
+	}
+
+	return nil, status.Error(codes.Unauthenticated, "invalid token")
+}
+
+// authorizeInit checks that the Init meta only sets options the identity may set
+func (a *Authenticator) authorizeInit(identity *identity, req *tgengine.InitRequest) error {
+	if identity.admin {
+		return nil
+	}
+
+	keys := make([]string, 0, len(req.GetMeta()))
+	for key := range req.GetMeta() {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !slices.Contains(sessionInitMeta, key) {
+			return status.Errorf(codes.PermissionDenied, "identity %q may not set the Init meta option %s, it needs admin", identity.name, key)
+		}
+	}
+
+	return nil
+}
+
+// authorize checks a Run request against the policy of the identity and reserves a concurrency slot for it
+func (a *Authenticator) authorize(identity *identity, req *tgengine.RunRequest) error {
+	if err := identity.commands.check(req.GetArgs(), req.GetEnvVars()); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if len(identity.allowedRoots) > 0 {
+		if _, err := resolveWorkingDir(req.GetWorkingDir(), identity.allowedRoots, req.GetArgs()); err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if identity.maxConcurrency > 0 && identity.running >= identity.maxConcurrency {
+		return status.Errorf(codes.ResourceExhausted, "identity %q already runs %d requests", identity.name, identity.running)
+	}
+
+	identity.running++
+
+	return nil
+}
+
+// authorizedStream authorizes the request message of a stream when the handler receives it. Shutdown requests need
+// no authorization, they only stop the session of the connection.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	auth     *Authenticator
+	identity *identity
+	reserved bool
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authorizedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if req, ok := m.(*tgengine.InitRequest); ok {
+		if err := s.auth.authorizeInit(s.identity, req); err != nil {
+			log.Warnf("Denied Init of identity %q: %v", s.identity.name, err)
+
+			return err
+		}
+
+		return nil
+	}
+
+	req, ok := m.(*tgengine.RunRequest)
+	if !ok {
+		return nil
+	}
+
+	if err := s.auth.authorize(s.identity, req); err != nil {
+		log.Warnf("Denied run %v of identity %q: %v", req.GetArgs(), s.identity.name, err)
+
+		return err
+	}
+
+	s.reserved = true
+
+	return nil
+}
+
+// release frees the concurrency slot of an authorized run
+func (s *authorizedStream) release() {
+	if !s.reserved {
+		return
+	}
+
+	s.auth.mu.Lock()
+	s.identity.running--
+	s.auth.mu.Unlock()
+}
+
+// IdentityFromContext returns the name of the identity authenticated for a request, or an empty string
+func IdentityFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(identityContextKey{}).(string)
+
+	return name
+}
@@ -0,0 +1,236 @@
+package engine_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_AuthorizesRuns(t *testing.T) {
+	// the server runs the tofu of PATH
+	t.Setenv("PATH", filepath.Dir(fakeTofu(t, `[ "$1" = apply ] && sleep 1; echo "ran $*"`))+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	units := filepath.Join(dir, "units")
+	unit := filepath.Join(units, "vpc")
+	require.NoError(t, os.MkdirAll(unit, 0755))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "jwt.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}), 0600))
+
+	staticToken := "s3cr3t-token"
+	tokenHash := sha256.Sum256([]byte(staticToken))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "auth.hcl"), []byte(`
+jwt {
+  key_file = "`+filepath.Join(dir, "jwt.pem")+`"
+  issuer   = "https://ci.example.com"
+}
+
+identity "ci" {
+  allowed_roots    = ["`+units+`"]
+  allowed_commands = ["plan", "apply"]
+  max_concurrency  = 1
+}
+
+identity "reader" {
+  token_sha256     = "`+hex.EncodeToString(tokenHash[:])+`"
+  allowed_commands = ["plan"]
+}
+`), 0600))
+
+	auth, err := engine.LoadAuthConfig(filepath.Join(dir, "auth.hcl"))
+	require.NoError(t, err)
+
+	listener, err := engine.Listen("tcp://127.0.0.1:0")
+	require.NoError(t, err)
+
+	server, _ := startServer(t, listener, auth.ServerOptions()...)
+	client := engineClient(t, server.Addr().String())
+
+	sign := func(claims jwt.RegisteredClaims) string {
+		t.Helper()
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+		require.NoError(t, err)
+
+		return token
+	}
+
+	ciToken := sign(jwt.RegisteredClaims{Subject: "ci", Issuer: "https://ci.example.com", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+
+	run := func(token string, workingDir string, args ...string) (string, codes.Code) {
+		t.Helper()
+
+		ctx := t.Context()
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+
+		output, _, err := runOutput(ctx, client, &tgengine.RunRequest{WorkingDir: workingDir, Args: args})
+
+		return output, status.Code(err)
+	}
+
+	output, code := run(ciToken, unit, "plan")
+	assert.Equal(t, codes.OK, code)
+	assert.Equal(t, "ran plan\n", output)
+
+	output, code = run(staticToken, unit, "plan")
+	assert.Equal(t, codes.OK, code)
+	assert.Equal(t, "ran plan\n", output)
+
+	_, code = run("", unit, "plan")
+	assert.Equal(t, codes.Unauthenticated, code)
+
+	_, code = run("wrong-token", unit, "plan")
+	assert.Equal(t, codes.Unauthenticated, code)
+
+	expired := sign(jwt.RegisteredClaims{Subject: "ci", Issuer: "https://ci.example.com", ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))})
+	_, code = run(expired, unit, "plan")
+	assert.Equal(t, codes.Unauthenticated, code)
+
+	otherIssuer := sign(jwt.RegisteredClaims{Subject: "ci", Issuer: "https://evil.example.com", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	_, code = run(otherIssuer, unit, "plan")
+	assert.Equal(t, codes.Unauthenticated, code)
+
+	unknown := sign(jwt.RegisteredClaims{Subject: "admin", Issuer: "https://ci.example.com", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	_, code = run(unknown, unit, "plan")
+	assert.Equal(t, codes.PermissionDenied, code)
+
+	// the policy of the identity
+	_, code = run(staticToken, unit, "apply")
+	assert.Equal(t, codes.PermissionDenied, code)
+
+	_, code = run(ciToken, dir, "plan")
+	assert.Equal(t, codes.PermissionDenied, code)
+
+	// the identity may only run one request at a time
+	started := make(chan codes.Code, 1)
+
+	go func() {
+		_, code := run(ciToken, unit, "apply", "-auto-approve")
+		started <- code
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+
+	_, code = run(ciToken, unit, "plan")
+	assert.Equal(t, codes.ResourceExhausted, code)
+
+	_, code = run(staticToken, unit, "plan")
+	assert.Equal(t, codes.OK, code)
+
+	assert.Equal(t, codes.OK, <-started)
+
+	_, code = run(ciToken, unit, "plan")
+	assert.Equal(t, codes.OK, code)
+}
+
+func TestServer_AuthorizesInit(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	userHash := sha256.Sum256([]byte("user-token"))
+	adminHash := sha256.Sum256([]byte("admin-token"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "auth.hcl"), []byte(`
+identity "user" {
+  token_sha256 = "`+hex.EncodeToString(userHash[:])+`"
+}
+
+identity "admin" {
+  token_sha256 = "`+hex.EncodeToString(adminHash[:])+`"
+  admin        = true
+}
+`), 0600))
+
+	auth, err := engine.LoadAuthConfig(filepath.Join(dir, "auth.hcl"))
+	require.NoError(t, err)
+
+	listener, err := engine.Listen("tcp://127.0.0.1:0")
+	require.NoError(t, err)
+
+	server, _ := startServer(t, listener, auth.ServerOptions()...)
+	client := engineClient(t, server.Addr().String())
+
+	init := func(token string, meta ...string) codes.Code {
+		t.Helper()
+
+		ctx := metadata.AppendToOutgoingContext(t.Context(), "authorization", "Bearer "+token)
+
+		stream, err := client.Init(ctx, &tgengine.InitRequest{Meta: stringMeta(meta...)})
+		require.NoError(t, err)
+
+		for {
+			if _, err := stream.Recv(); err != nil {
+				if err == io.EOF {
+					return codes.OK
+				}
+
+				return status.Code(err)
+			}
+		}
+	}
+
+	// options which only affect the runs of the session
+	assert.Equal(t, codes.OK, init("user-token", "command_mode", "read-only", "run_log", "true", "json_events", "true"))
+
+	// options which select the executor or paths on the server
+	assert.Equal(t, codes.PermissionDenied, init("user-token", "executor", "ssh", "ssh_host", "bastion"))
+	assert.Equal(t, codes.PermissionDenied, init("user-token", "run_log_dir", dir))
+	assert.Equal(t, codes.PermissionDenied, init("user-token", "audit_log_file", filepath.Join(dir, "audit.log")))
+
+	assert.Equal(t, codes.OK, init("admin-token", "run_log_dir", dir))
+
+	// shutting down only ends the session of the connection
+	ctx := metadata.AppendToOutgoingContext(t.Context(), "authorization", "Bearer user-token")
+	stream, err := client.Shutdown(ctx, &tgengine.ShutdownRequest{})
+	require.NoError(t, err)
+
+	for err == nil {
+		_, err = stream.Recv()
+	}
+
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestLoadAuthConfig_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for name, config := range map[string]string{
+		"duplicate identity": `identity "ci" {}
+identity "ci" {}`,
+		"invalid token hash": `identity "ci" { token_sha256 = "abc" }`,
+		"missing key file":   `jwt { key_file = "/nonexistent/jwt.pem" }`,
+		"unknown attribute":  `identity "ci" { tokens = [] }`,
+	} {
+		path := filepath.Join(t.TempDir(), "auth.hcl")
+		require.NoError(t, os.WriteFile(path, []byte(config), 0600))
+
+		_, err := engine.LoadAuthConfig(path)
+		require.ErrorIs(t, err, engine.ErrInvalidAuthConfig, name)
+	}
+}
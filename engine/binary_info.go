@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tofuBinaries is the binary info cache shared by the audit log and the run logs
+var tofuBinaries = &binaryInfos{infos: map[string]binaryInfo{}}
+
+// binaryInfo is the version and SHA-256 digest of a tofu binary, empty when they can't be determined
+type binaryInfo struct {
+	modTime time.Time
+	version string
+	digest  string
+	size    int64
+}
+
+// binaryInfos caches the info of tofu binaries by path, size and modification time, so that the version command
+// and the hash only run again when a binary is replaced
+type binaryInfos struct {
+	infos map[string]binaryInfo
+	mu    sync.Mutex
+}
+
+// get returns the info of a tofu binary, looked up in PATH unless it is a path
+func (b *binaryInfos) get(binary string) binaryInfo {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return binaryInfo{}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return binaryInfo{}
+	}
+
+	b.mu.Lock()
+	cached, exists := b.infos[path]
+	b.mu.Unlock()
+
+	if exists && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached
+	}
+
+	cached = binaryInfo{modTime: info.ModTime(), size: info.Size()}
+
+	if cached.digest, err = fileSHA256(path); err != nil {
+		log.Warnf("Failed to hash %s: %v", path, err)
+	}
+
+	if cached.version, err = tofuVersion(localExecutor{}, &ExecSpec{Binary: path}); err != nil {
+		log.Warnf("Failed to get the version of %s: %v", path, err)
+	}
+
+	b.mu.Lock()
+	b.infos[path] = cached
+	b.mu.Unlock()
+
+	return cached
+}
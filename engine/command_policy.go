@@ -0,0 +1,162 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaCommandMode     = "command_mode"
+	metaAllowedCommands = "allowed_commands"
+	metaDeniedFlags     = "denied_flags"
+
+	commandModeUnrestricted = "unrestricted"
+	commandModeReadOnly     = "read-only"
+
+	// cliArgsEnvPrefix prefixes the variables whose value tofu appends to its arguments, TF_CLI_ARGS and
+	// TF_CLI_ARGS_<subcommand>
+	cliArgsEnvPrefix = "TF_CLI_ARGS"
+)
+
+var (
+	ErrCommandNotAllowed  = errors.New("command is not allowed by the engine command policy")
+	ErrInvalidCommandMode = errors.New("invalid command mode")
+
+	// readOnlyCommands are the subcommands which can't mutate infrastructure or state
+	readOnlyCommands = []string{"init", "plan", "validate", "show", "output", "version"}
+
+	// readOnlyDeniedFlags are flags which make otherwise read-only subcommands mutate state
+	readOnlyDeniedFlags = []string{"-migrate-state", "-force-copy"}
+)
+
+// commandPolicy restricts the subcommands and flags which Run passes to tofu.
+// An empty allowlist means every subcommand is allowed.
+type commandPolicy struct {
+	mode            string
+	allowedCommands [][]string
+	deniedFlags     []string
+}
+
+// CommandPolicyError describes an invocation rejected by the command policy
+type CommandPolicyError struct {
+	Mode       string
+	Subcommand string
+	Flag       string
+	EnvVar     string
+	Reason     string
+}
+
+func (e *CommandPolicyError) Error() string {
+	if e.EnvVar != "" {
+		return fmt.Sprintf("%v: environment variable %s is denied, it passes arguments the policy can't check (mode: %s)", ErrCommandNotAllowed, e.EnvVar, e.Mode)
+	}
+
+	if e.Flag != "" {
+		return fmt.Sprintf("%v: flag %s is denied (mode: %s)", ErrCommandNotAllowed, e.Flag, e.Mode)
+	}
+
+	return fmt.Sprintf("%v: subcommand %q is not allowed (mode: %s, %s)", ErrCommandNotAllowed, e.Subcommand, e.Mode, e.Reason)
+}
+
+func (e *CommandPolicyError) Unwrap() error {
+	return ErrCommandNotAllowed
+}
+
+// parseCommandPolicy builds the command policy from Init meta
+func parseCommandPolicy(meta map[string]*anypb.Any) (commandPolicy, error) {
+	policy := commandPolicy{mode: strings.TrimSpace(metaString(meta, metaCommandMode))}
+
+	switch policy.mode {
+	case "", commandModeUnrestricted:
+		policy.mode = commandModeUnrestricted
+	case commandModeReadOnly:
+		for _, command := range readOnlyCommands {
+			policy.allowedCommands = append(policy.allowedCommands, []string{command})
+		}
+
+		policy.deniedFlags = append(policy.deniedFlags, readOnlyDeniedFlags...)
+	default:
+		return commandPolicy{}, fmt.Errorf("%w %q, expected %q or %q", ErrInvalidCommandMode, policy.mode, commandModeUnrestricted, commandModeReadOnly)
+	}
+
+	for _, command := range metaStrings(meta, metaAllowedCommands) {
+		policy.allowedCommands = append(policy.allowedCommands, strings.Fields(command))
+	}
+
+	for _, flag := range metaStrings(meta, metaDeniedFlags) {
+		policy.deniedFlags = append(policy.deniedFlags, normalizeFlag(flag))
+	}
+
+	return policy, nil
+}
+
+// check verifies that args and the environment variables of a request are allowed by the policy
+func (p commandPolicy) check(args []string, envVars map[string]string) error {
+	words, flags := splitCommandArgs(args)
+
+	if len(p.allowedCommands) > 0 || len(p.deniedFlags) > 0 {
+		for name := range envVars {
+			if strings.HasPrefix(strings.ToUpper(name), cliArgsEnvPrefix) {
+				return &CommandPolicyError{Mode: p.mode, Subcommand: strings.Join(words, " "), EnvVar: name}
+			}
+		}
+	}
+
+	for _, flag := range flags {
+		if slices.Contains(p.deniedFlags, flag) {
+			return &CommandPolicyError{Mode: p.mode, Subcommand: strings.Join(words, " "), Flag: flag}
+		}
+	}
+
+	if len(p.allowedCommands) == 0 || len(words) == 0 {
+		return nil
+	}
+
+	for _, allowed := range p.allowedCommands {
+		if len(allowed) > 0 && len(words) >= len(allowed) && slices.Equal(words[:len(allowed)], allowed) {
+			return nil
+		}
+	}
+
+	return &CommandPolicyError{Mode: p.mode, Subcommand: strings.Join(words, " "), Reason: "not in the allowlist"}
+}
+
+// splitCommandArgs separates the positional words (subcommand and its arguments) from the normalized flag names
+func splitCommandArgs(args []string) ([]string, []string) {
+	var words, flags []string
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			flags = append(flags, normalizeFlag(arg))
+			continue
+		}
+
+		words = append(words, arg)
+	}
+
+	return words, flags
+}
+
+// subcommand returns the tofu subcommand of args, or an empty string when there is none
+func subcommand(args []string) string {
+	words, _ := splitCommandArgs(args)
+	if len(words) == 0 {
+		return ""
+	}
+
+	return words[0]
+}
+
+// normalizeFlag strips the value and reduces the flag to a single leading dash
+func normalizeFlag(flag string) string {
+	flag = strings.TrimSpace(flag)
+	if name, _, found := strings.Cut(flag, "="); found {
+		flag = name
+	}
+
+	return "-" + strings.TrimLeft(flag, "-")
+}
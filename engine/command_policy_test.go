@@ -0,0 +1,115 @@
+package engine_test
+
+import (
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTofuEngine_RunReadOnlyMode(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("command_mode", "read-only")}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "ran $*"`))
+
+	testCases := []struct {
+		name    string
+		args    []string
+		allowed bool
+	}{
+		{name: "plan", args: []string{"plan", "-out=tfplan"}, allowed: true},
+		{name: "output", args: []string{"output", "-json"}, allowed: true},
+		{name: "help", args: []string{"-help"}, allowed: true},
+		{name: "apply", args: []string{"apply", "-auto-approve"}},
+		{name: "destroy", args: []string{"destroy"}},
+		{name: "state rm", args: []string{"state", "rm", "aws_instance.example"}},
+		{name: "chdir apply", args: []string{"-chdir=other", "apply"}},
+		{name: "migrate state", args: []string{"init", "--migrate-state"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockStream := &MockRunServer{}
+			err := tofuEngine.Run(&tgengine.RunRequest{Args: tc.args}, mockStream)
+
+			if tc.allowed {
+				require.NoError(t, err)
+				assert.Contains(t, stdout(mockStream.Responses), "ran")
+				assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+				return
+			}
+
+			require.ErrorIs(t, err, engine.ErrCommandNotAllowed)
+
+			var policyErr *engine.CommandPolicyError
+			require.ErrorAs(t, err, &policyErr)
+			assert.Equal(t, "read-only", policyErr.Mode)
+			assert.NotContains(t, stdout(mockStream.Responses), "ran")
+			assert.Contains(t, stderr(mockStream.Responses), "not allowed by the engine command policy")
+			assert.Equal(t, int32(1), resultCode(mockStream.Responses))
+		})
+	}
+}
+
+func TestTofuEngine_RunAllowedCommands(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	meta := stringMeta("command_mode", "read-only", "allowed_commands", "state list, state show", "denied_flags", "-lock")
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: meta}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo ran`))
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{Args: []string{"state", "list"}}, &MockRunServer{}))
+	require.ErrorIs(t, tofuEngine.Run(&tgengine.RunRequest{Args: []string{"state", "rm", "x"}}, &MockRunServer{}), engine.ErrCommandNotAllowed)
+	require.ErrorIs(t, tofuEngine.Run(&tgengine.RunRequest{Args: []string{"plan", "-lock=false"}}, &MockRunServer{}), engine.ErrCommandNotAllowed)
+}
+
+func TestTofuEngine_InitInvalidCommandMode(t *testing.T) {
+	t.Parallel()
+
+	mockStream := &MockInitServer{}
+	err := (&engine.TofuEngine{}).Init(&tgengine.InitRequest{Meta: stringMeta("command_mode", "yolo")}, mockStream)
+	require.ErrorIs(t, err, engine.ErrInvalidCommandMode)
+	assert.Equal(t, int32(1), mockStream.Responses[len(mockStream.Responses)-1].GetResultCode())
+}
+
+func TestTofuEngine_RunPolicyCLIArgsEnv(t *testing.T) {
+	t.Parallel()
+
+	readOnly := &engine.TofuEngine{}
+	require.NoError(t, readOnly.Init(&tgengine.InitRequest{Meta: stringMeta("command_mode", "read-only")}, &MockInitServer{}))
+	readOnly.SetBinaryPath(fakeTofu(t, `echo ran`))
+
+	for _, name := range []string{"TF_CLI_ARGS", "TF_CLI_ARGS_init", "TF_CLI_ARGS_apply", "tf_cli_args_plan"} {
+		mockStream := &MockRunServer{}
+		err := readOnly.Run(&tgengine.RunRequest{
+			Args:    []string{"plan"},
+			EnvVars: map[string]string{name: "-auto-approve"},
+		}, mockStream)
+		require.ErrorIs(t, err, engine.ErrCommandNotAllowed, name)
+
+		var policyErr *engine.CommandPolicyError
+		require.ErrorAs(t, err, &policyErr)
+		assert.Equal(t, name, policyErr.EnvVar)
+		assert.NotContains(t, stdout(mockStream.Responses), "ran")
+	}
+
+	// without a policy the variables are passed to tofu
+	unrestricted := &engine.TofuEngine{}
+	require.NoError(t, unrestricted.Init(&tgengine.InitRequest{}, &MockInitServer{}))
+	unrestricted.SetBinaryPath(fakeTofu(t, `echo "ran $TF_CLI_ARGS"`))
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, unrestricted.Run(&tgengine.RunRequest{
+		Args:    []string{"plan"},
+		EnvVars: map[string]string{"TF_CLI_ARGS": "-compact-warnings"},
+	}, mockStream))
+	assert.Contains(t, stdout(mockStream.Responses), "ran -compact-warnings")
+}
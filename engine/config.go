@@ -0,0 +1,177 @@
+package engine
+
+import (
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// engineConfig holds the settings passed through Init meta which apply to every Run
+type engineConfig struct {
+	commandPolicy commandPolicy
+	allowedRoots  []string
+	retry         retryConfig
+
+	// providerCacheDir is the provider cache managed by the engine, empty when it is disabled
+	providerCacheDir string
+
+	// providerMirrorDir is the directory of provider packages served to runs, empty when the mirror is disabled
+	providerMirrorDir string
+
+	// stateBackup configures the state backups before mutating runs, nil when they are disabled
+	stateBackup *stateBackupConfig
+
+	// planStoreDir is the directory of the plan store, empty when it is disabled
+	planStoreDir string
+
+	// policies are checked against the plans of plan runs
+	policies []policy
+
+	// guardrails limit the changes of apply and destroy runs, nil when none are configured
+	guardrails *guardrails
+
+	// driftReportDir is the directory drift reports are written to, empty when they are not written
+	driftReportDir string
+
+	// auditLog records every run, nil when it is disabled
+	auditLog *auditLog
+
+	// runLogs mirror the output of every run to a file, nil when they are disabled
+	runLogs *runLogs
+
+	// executor spawns the tofu processes of runs
+	executor Executor
+
+	// metricsAddress is the address the metrics are served on, empty when they are not served
+	metricsAddress string
+}
+
+// parseEngineConfig builds the engine configuration from Init meta
+func parseEngineConfig(meta map[string]*anypb.Any) (*engineConfig, error) {
+	policy, err := parseCommandPolicy(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedRoots, err := parseAllowedRoots(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	retry, err := parseRetryConfig(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	providerCacheDir, err := parseProviderCacheDir(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	providerMirrorDir, err := parseProviderMirrorDir(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	planStoreDir, err := parsePlanStoreDir(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	stateBackup, err := parseStateBackupConfig(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := parsePolicies(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	guardrails, err := parseGuardrails(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	driftReportDir, err := parseDriftReportDir(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog, err := parseAuditLog(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	runLogs, err := parseRunLogs(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	executor, err := parseExecutor(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsAddress, err := parseMetricsAddress(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &engineConfig{
+		commandPolicy:     policy,
+		allowedRoots:      allowedRoots,
+		retry:             retry,
+		providerCacheDir:  providerCacheDir,
+		providerMirrorDir: providerMirrorDir,
+		planStoreDir:      planStoreDir,
+		stateBackup:       stateBackup,
+		policies:          policies,
+		guardrails:        guardrails,
+		driftReportDir:    driftReportDir,
+		auditLog:          auditLog,
+		runLogs:           runLogs,
+		executor:          executor,
+		metricsAddress:    metricsAddress,
+	}, nil
+}
+
+// setConfig safely sets the engine configuration
+func (c *TofuEngine) setConfig(config *engineConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config
+}
+
+// setMirror safely replaces the provider mirror, the previous one is stopped
+func (c *TofuEngine) setMirror(mirror *providerMirror) {
+	c.mu.Lock()
+	previous := c.mirror
+	c.mirror = mirror
+	c.mu.Unlock()
+
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			log.Warnf("Failed to stop provider mirror: %v", err)
+		}
+	}
+}
+
+// getMirror safely gets the provider mirror, nil when it is disabled
+func (c *TofuEngine) getMirror() *providerMirror {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.mirror
+}
+
+// getConfig safely gets the engine configuration, an empty configuration is returned before Init
+func (c *TofuEngine) getConfig() *engineConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.config == nil {
+		return &engineConfig{}
+	}
+
+	return c.config
+}
@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	metaRunReport = "run_report"
+
+	// EventTypeRunReport is the type of the event record attached to the final response of a run with run_report enabled
+	EventTypeRunReport = "run_report"
+
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+var (
+	ansiEscapePattern         = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
+	diagnosticHeaderPattern   = regexp.MustCompile(`^(Error|Warning): (.+)$`)
+	diagnosticLocationPattern = regexp.MustCompile(`^on (.+) line (\d+)(?:, in (.+))?:$`)
+	diagnosticWithPattern     = regexp.MustCompile(`^with (.+),$`)
+	diagnosticResourcePattern = regexp.MustCompile(`^(?:resource|data) "([^"]+)" "([^"]+)"$`)
+	diagnosticSnippetPattern  = regexp.MustCompile(`^\d+:( |$)`)
+)
+
+// RunReport summarizes a run. It is sent as an event record in the stdout of the final RunResponse when the
+// run_report meta option is set.
+type RunReport struct {
+	Diagnostics []Diagnostic      `json:"diagnostics"`
+	Violations  []PolicyViolation `json:"policy_violations,omitempty"`
+	Drift       *DriftReport      `json:"drift,omitempty"`
+	ResultCode  int               `json:"result_code"`
+	Attempts    int               `json:"attempts"`
+	PlanID      string            `json:"plan_id,omitempty"`
+	StateBackup string            `json:"state_backup,omitempty"`
+	InitSkipped bool              `json:"init_skipped,omitempty"`
+}
+
+// summary returns a one line description of the report
+func (r *RunReport) summary() string {
+	errorCount, warningCount := 0, 0
+
+	for _, diagnostic := range r.Diagnostics {
+		switch diagnostic.Severity {
+		case severityError:
+			errorCount++
+		case severityWarning:
+			warningCount++
+		}
+	}
+
+	return fmt.Sprintf("Run finished with result code %d after %d attempt(s): %d error(s), %d warning(s)",
+		r.ResultCode, r.Attempts, errorCount, warningCount)
+}
+
+// record encodes the report as an event record
+func (r *RunReport) record() (string, error) {
+	return encodeEventRecord(&Event{Type: EventTypeRunReport, Message: r.summary(), Report: r})
+}
+
+// collectDiagnostics extracts the diagnostics of a run. The machine readable output is used when tofu ran
+// with -json, the human readable Error/Warning blocks are parsed otherwise.
+func collectDiagnostics(args []string, stdout, stderr string) []Diagnostic {
+	diagnostics := []Diagnostic{}
+
+	_, flags := splitCommandArgs(args)
+	if slices.Contains(flags, jsonFlag) {
+		diagnostics = append(diagnostics, parseJSONDiagnostics(stdout, subcommand(args) == validateCommand)...)
+	} else {
+		diagnostics = append(diagnostics, parseHumanDiagnostics(stdout)...)
+	}
+
+	return append(diagnostics, parseHumanDiagnostics(stderr)...)
+}
+
+// parseJSONDiagnostics extracts diagnostics from the machine readable UI
+func parseJSONDiagnostics(output string, validate bool) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	if validate {
+		if events, ok := parseValidateOutput([]byte(output)); ok {
+			for _, event := range events {
+				if event.Diagnostic != nil {
+					diagnostics = append(diagnostics, *event.Diagnostic)
+				}
+			}
+		}
+
+		return diagnostics
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		// with json_events enabled the captured output holds event records instead of UI lines
+		if event, ok := ParseEventRecord(line); ok {
+			if event.Diagnostic != nil {
+				diagnostics = append(diagnostics, *event.Diagnostic)
+			}
+
+			continue
+		}
+
+		if event, ok := parseUILine(line); ok && event.Diagnostic != nil {
+			diagnostics = append(diagnostics, *event.Diagnostic)
+		}
+	}
+
+	return diagnostics
+}
+
+// parseHumanDiagnostics extracts diagnostics from the human readable output, with or without colors and the
+// box drawing characters tofu uses to frame them. Unframed diagnostics (-no-color) end at the next diagnostic.
+func parseHumanDiagnostics(output string) []Diagnostic {
+	var (
+		diagnostics []Diagnostic
+		current     *Diagnostic
+		detail      []string
+	)
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+
+		current.Detail = strings.TrimSpace(strings.Join(detail, "\n"))
+		diagnostics = append(diagnostics, *current)
+		current, detail = nil, nil
+	}
+
+	for _, rawLine := range strings.Split(ansiEscapePattern.ReplaceAllString(output, ""), "\n") {
+		trimmed := strings.TrimSpace(stripDiagnosticFrame(rawLine))
+
+		if match := diagnosticHeaderPattern.FindStringSubmatch(trimmed); match != nil {
+			flush()
+
+			current = &Diagnostic{Severity: strings.ToLower(match[1]), Summary: match[2]}
+
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(rawLine), "╵") {
+			flush()
+			continue
+		}
+
+		switch {
+		case current.Range == nil && diagnosticLocationPattern.MatchString(trimmed):
+			match := diagnosticLocationPattern.FindStringSubmatch(trimmed)
+			lineNumber, _ := strconv.Atoi(match[2])
+			current.Range = &DiagnosticRange{
+				Filename: match[1],
+				Start:    DiagnosticPos{Line: lineNumber},
+				End:      DiagnosticPos{Line: lineNumber},
+			}
+
+			if resource := diagnosticResourcePattern.FindStringSubmatch(match[3]); resource != nil && current.Address == "" {
+				current.Address = resource[1] + "." + resource[2]
+			}
+		case diagnosticWithPattern.MatchString(trimmed):
+			current.Address = diagnosticWithPattern.FindStringSubmatch(trimmed)[1]
+		case diagnosticSnippetPattern.MatchString(trimmed), strings.HasPrefix(trimmed, "├"), strings.HasPrefix(trimmed, "│"):
+			// source snippet and expression values
+		default:
+			detail = append(detail, trimmed)
+		}
+	}
+
+	flush()
+
+	return diagnostics
+}
+
+// stripDiagnosticFrame removes the box drawing prefix tofu puts in front of diagnostic lines
+func stripDiagnosticFrame(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if rest, found := strings.CutPrefix(trimmed, "│"); found {
+		return rest
+	}
+
+	if strings.HasPrefix(trimmed, "╷") {
+		return ""
+	}
+
+	return line
+}
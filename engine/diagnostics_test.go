@@ -0,0 +1,139 @@
+package engine_test
+
+import (
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runReport runs the fake tofu script with run_report enabled and returns the report of the final response
+func runReport(t *testing.T, script string, args []string, meta ...string) (*engine.RunReport, []*tgengine.RunResponse) {
+	t.Helper()
+
+	tofuEngine := &engine.TofuEngine{}
+	tofuEngine.SetBinaryPath(fakeTofu(t, script))
+
+	return runReportWith(t, tofuEngine, args, meta...)
+}
+
+// runReportWith runs tofu through tofuEngine with run_report enabled and returns the report of the final response
+func runReportWith(t *testing.T, tofuEngine *engine.TofuEngine, args []string, meta ...string) (*engine.RunReport, []*tgengine.RunResponse) {
+	t.Helper()
+
+	// runs get their own directory, so that init never writes .terraform into the package directory
+	return runReportRequest(t, tofuEngine, &tgengine.RunRequest{WorkingDir: t.TempDir(), Args: args, Meta: stringMeta(meta...)})
+}
+
+// runReportRequest runs req through tofuEngine with run_report enabled and returns the report of the final response
+func runReportRequest(t *testing.T, tofuEngine *engine.TofuEngine, req *tgengine.RunRequest) (*engine.RunReport, []*tgengine.RunResponse) {
+	t.Helper()
+
+	if req.Meta == nil {
+		req.Meta = stringMeta()
+	}
+
+	req.Meta["run_report"] = stringMeta("run_report", "true")["run_report"]
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(req, mockStream))
+
+	final := mockStream.Responses[len(mockStream.Responses)-1]
+	event, ok := engine.ParseEventRecord(final.GetStdout())
+	require.True(t, ok, "final response should carry the run report")
+	require.Equal(t, engine.EventTypeRunReport, event.Type)
+	require.NotNil(t, event.Report)
+	assert.Equal(t, int(final.GetResultCode()), event.Report.ResultCode)
+
+	return event.Report, mockStream.Responses
+}
+
+func TestTofuEngine_RunReportHumanDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	script := `cat >&2 <<'EOF'
+╷
+│ Error: Unsupported argument
+│ 
+│   on main.tf line 3, in resource "null_resource" "example":
+│    3:   foo = "bar"
+│ 
+│ An argument named "foo" is not expected here.
+╵
+╷
+│ Error: Invalid value for variable
+│ 
+│   on variables.tf line 1:
+│    1: variable "count" {
+│     ├────────────────
+│     │ var.count is -1
+│ 
+│   with module.app.aws_instance.web,
+│ 
+│ Count must be positive.
+│ See the docs.
+╵
+EOF
+exit 1
+`
+	report, _ := runReport(t, script, []string{"plan"})
+	assert.Equal(t, 1, report.ResultCode)
+	require.Len(t, report.Diagnostics, 2)
+
+	first := report.Diagnostics[0]
+	assert.Equal(t, "error", first.Severity)
+	assert.Equal(t, "Unsupported argument", first.Summary)
+	assert.Equal(t, `An argument named "foo" is not expected here.`, first.Detail)
+	assert.Equal(t, "null_resource.example", first.Address)
+	require.NotNil(t, first.Range)
+	assert.Equal(t, "main.tf", first.Range.Filename)
+	assert.Equal(t, 3, first.Range.Start.Line)
+
+	second := report.Diagnostics[1]
+	assert.Equal(t, "Invalid value for variable", second.Summary)
+	assert.Equal(t, "module.app.aws_instance.web", second.Address)
+	assert.Equal(t, "variables.tf", second.Range.Filename)
+	assert.Equal(t, "Count must be positive.\nSee the docs.", second.Detail)
+}
+
+func TestTofuEngine_RunReportPlainDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	script := "printf '\\033[31mWarning: Deprecated attribute\\033[0m\\n\\n  on main.tf line 7:\\n   7:   old = 1\\n\\nUse new instead.\\n'\n"
+	report, _ := runReport(t, script, []string{"plan", "-no-color"})
+	assert.Equal(t, 0, report.ResultCode)
+	require.Len(t, report.Diagnostics, 1)
+	assert.Equal(t, "warning", report.Diagnostics[0].Severity)
+	assert.Equal(t, "Deprecated attribute", report.Diagnostics[0].Summary)
+	assert.Equal(t, "Use new instead.", report.Diagnostics[0].Detail)
+	assert.Equal(t, 7, report.Diagnostics[0].Range.Start.Line)
+}
+
+func TestTofuEngine_RunReportJSONDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	for _, meta := range [][]string{nil, {"json_events", "true"}} {
+		report, _ := runReport(t, "cat <<'EOF'\n"+planJSONOutput+"EOF\nexit 1\n", []string{"plan", "-json"}, meta...)
+		assert.Equal(t, 1, report.ResultCode)
+		require.Len(t, report.Diagnostics, 1)
+		assert.Equal(t, "Unsupported argument", report.Diagnostics[0].Summary)
+		assert.Equal(t, "null_resource.example", report.Diagnostics[0].Address)
+		assert.Equal(t, 40, report.Diagnostics[0].Range.Start.Byte)
+	}
+}
+
+func TestTofuEngine_RunWithoutReport(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	tofuEngine.SetBinaryPath(fakeTofu(t, "echo 'Error: boom' >&2\nexit 1\n"))
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{Args: []string{"plan"}}, mockStream))
+
+	final := mockStream.Responses[len(mockStream.Responses)-1]
+	assert.Empty(t, final.GetStdout())
+	assert.Equal(t, int32(1), final.GetResultCode())
+}
@@ -0,0 +1,209 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaDriftDetection = "drift_detection"
+	metaDriftReportDir = "drift_report_dir"
+
+	// DriftModePlan detects drift with a normal plan: changes of the infrastructure and of the configuration
+	DriftModePlan = "plan"
+	// DriftModeRefreshOnly detects drift with a refresh-only plan: changes made outside of OpenTofu
+	DriftModeRefreshOnly = "refresh-only"
+
+	// EventTypeDrift is the type of the event record with the drift report of a drift detection run
+	EventTypeDrift = "drift"
+
+	detailedExitCodeFlag = "-detailed-exitcode"
+	refreshOnlyFlag      = "-refresh-only"
+	driftPlanPrefix      = "terragrunt-engine-drift-*.tfplan"
+	driftReportDirMode   = 0755
+
+	// driftResultCode is the exit code of `plan -detailed-exitcode` when the plan has changes
+	driftResultCode = 2
+)
+
+var ErrInvalidDriftDetection = errors.New("invalid drift detection")
+
+// DriftReport is the outcome of a drift detection run
+type DriftReport struct {
+	Time      time.Time       `json:"time"`
+	Unit      string          `json:"unit"`
+	Mode      string          `json:"mode"`
+	Resources []DriftResource `json:"resources"`
+	Drifted   bool            `json:"drifted"`
+}
+
+// DriftResource is a resource which drifted, with the top-level attributes whose values differ
+type DriftResource struct {
+	Address    string   `json:"address"`
+	Type       string   `json:"type,omitempty"`
+	Actions    []string `json:"actions"`
+	Attributes []string `json:"attributes,omitempty"`
+}
+
+// driftRun is a plan run in drift detection mode
+type driftRun struct {
+	mode string
+
+	// planFile is the plan the drift report is read from, tempFile is set when the engine created it
+	planFile string
+	tempFile bool
+}
+
+// parseDriftDetection reads the drift detection mode of a plan run from Run meta
+func parseDriftDetection(req *tgengine.RunRequest) (string, error) {
+	mode := metaString(req.GetMeta(), metaDriftDetection)
+
+	switch mode {
+	case "":
+		return "", nil
+	case DriftModePlan, DriftModeRefreshOnly:
+	default:
+		return "", fmt.Errorf("%w: %s must be %s or %s, got %q", ErrInvalidDriftDetection, metaDriftDetection, DriftModePlan, DriftModeRefreshOnly, mode)
+	}
+
+	// the engine meta of Terragrunt is passed to every run, other runs than plan ignore the mode
+	if subcommand(req.GetArgs()) != planCommand {
+		return "", nil
+	}
+
+	return mode, nil
+}
+
+// parseDriftReportDir reads the directory drift reports are written to from Init meta, empty when they are not written
+func parseDriftReportDir(meta map[string]*anypb.Any) (string, error) {
+	dir := metaString(meta, metaDriftReportDir)
+	if dir == "" {
+		return "", nil
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidDriftDetection, err)
+	}
+
+	if err := os.MkdirAll(dir, driftReportDirMode); err != nil {
+		return "", fmt.Errorf("failed to create drift report directory %s: %w", dir, err)
+	}
+
+	return dir, nil
+}
+
+// newDriftRun adds the flags of drift detection to a plan run: -detailed-exitcode, -refresh-only for that mode
+// and a plan file to read the changes from when the run doesn't save one itself
+func newDriftRun(req *tgengine.RunRequest, opts *runOptions) (*driftRun, error) {
+	drift := &driftRun{mode: opts.driftMode, planFile: planOutFile(req.GetArgs())}
+
+	_, flags := splitCommandArgs(req.GetArgs())
+
+	if !slices.Contains(flags, detailedExitCodeFlag) {
+		opts.extraArgs = append(opts.extraArgs, detailedExitCodeFlag)
+	}
+
+	if drift.mode == DriftModeRefreshOnly && !slices.Contains(flags, refreshOnlyFlag) {
+		opts.extraArgs = append(opts.extraArgs, refreshOnlyFlag)
+	}
+
+	if drift.planFile == "" {
+		planFile, err := tempPlanFile(moduleDir(opts.workingDir, req.GetArgs()), driftPlanPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidDriftDetection, err)
+		}
+
+		drift.planFile = planFile
+		drift.tempFile = true
+		opts.extraArgs = append(opts.extraArgs, outFlag+"="+planFile)
+	}
+
+	return drift, nil
+}
+
+// report builds the drift report from the saved plan and writes it to reportDir when one is configured
+func (d *driftRun) report(c *TofuEngine, req *tgengine.RunRequest, opts *runOptions, reportDir string) (*DriftReport, error) {
+	plan, err := c.showPlan(req, opts, d.planFile)
+	if err != nil {
+		return nil, err
+	}
+
+	unit := moduleDir(opts.workingDir, req.GetArgs())
+	report := &DriftReport{Time: time.Now().UTC(), Unit: unit, Mode: d.mode, Resources: []DriftResource{}}
+
+	changes := plan.ResourceChanges
+	if d.mode == DriftModeRefreshOnly {
+		changes = plan.ResourceDrift
+	}
+
+	for _, change := range changes {
+		actions := change.Change.Actions
+		if len(actions) == 0 || slices.Equal(actions, []string{"no-op"}) || slices.Equal(actions, []string{"read"}) {
+			continue
+		}
+
+		report.Resources = append(report.Resources, DriftResource{
+			Address:    change.Address,
+			Type:       change.Type,
+			Actions:    actions,
+			Attributes: changedAttributes(change.Change.Before, change.Change.After),
+		})
+	}
+
+	report.Drifted = len(report.Resources) > 0
+
+	if reportDir != "" {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeFileAtomic(filepath.Join(reportDir, unitFileName(unit)+".json"), append(content, '\n')); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// cleanup removes the plan file created for the drift report
+func (d *driftRun) cleanup() {
+	if d.tempFile {
+		_ = os.Remove(d.planFile)
+	}
+}
+
+// changedAttributes returns the sorted top-level attributes whose values differ between before and after
+func changedAttributes(before, after any) []string {
+	beforeValues, _ := before.(map[string]any)
+	afterValues, _ := after.(map[string]any)
+
+	var attributes []string
+
+	for name, value := range afterValues {
+		if previous, exists := beforeValues[name]; !exists || !reflect.DeepEqual(previous, value) {
+			attributes = append(attributes, name)
+		}
+	}
+
+	for name := range beforeValues {
+		if _, exists := afterValues[name]; !exists {
+			attributes = append(attributes, name)
+		}
+	}
+
+	sort.Strings(attributes)
+
+	return attributes
+}
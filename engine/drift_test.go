@@ -0,0 +1,105 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// driftTofu fakes a refresh-only plan which finds a changed security group, and exits 2 like -detailed-exitcode
+const driftTofu = `case "$1" in
+plan)
+  echo "$*" > args
+  for arg in "$@"; do case "$arg" in -out=*) echo plan > "${arg#-out=}" ;; esac; done
+  exit 2 ;;
+show) cat <<'JSON'
+{"resource_drift": [
+  {"address": "aws_security_group.web", "type": "aws_security_group", "change": {"actions": ["update"],
+   "before": {"name": "web", "ingress": [{"port": 22}], "tags": {}}, "after": {"name": "web", "ingress": [{"port": 22}, {"port": 3389}], "description": "x"}}},
+  {"address": "aws_vpc.main", "type": "aws_vpc", "change": {"actions": ["no-op"]}}
+], "resource_changes": []}
+JSON
+;;
+esac
+`
+
+func TestTofuEngine_RunDetectsDrift(t *testing.T) {
+	t.Parallel()
+
+	reportDir := t.TempDir()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("drift_report_dir", reportDir)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, driftTofu))
+
+	workingDir := t.TempDir()
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: workingDir,
+		Args:       []string{"plan"},
+		Meta:       stringMeta("drift_detection", "refresh-only", "run_report", "true"),
+	}, mockStream))
+
+	// exit code 2 means the plan has changes, not that it failed
+	assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+	args, err := os.ReadFile(filepath.Join(workingDir, "args"))
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "plan -detailed-exitcode -refresh-only -out=")
+
+	var report *engine.DriftReport
+
+	for _, response := range mockStream.Responses {
+		if event, ok := engine.ParseEventRecord(response.GetStdout()); ok && event.Type == engine.EventTypeDrift {
+			report = event.Drift
+		}
+	}
+
+	require.NotNil(t, report)
+	assert.True(t, report.Drifted)
+	assert.Equal(t, "refresh-only", report.Mode)
+	assert.Equal(t, workingDir, report.Unit)
+	assert.Equal(t, []engine.DriftResource{{
+		Address:    "aws_security_group.web",
+		Type:       "aws_security_group",
+		Actions:    []string{"update"},
+		Attributes: []string{"description", "ingress", "tags"},
+	}}, report.Resources)
+
+	files, err := filepath.Glob(filepath.Join(reportDir, "*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+
+	var written engine.DriftReport
+	require.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, report.Resources, written.Resources)
+
+	// the plan file created for the report is removed
+	planFiles, err := filepath.Glob(filepath.Join(workingDir, "*.tfplan"))
+	require.NoError(t, err)
+	assert.Empty(t, planFiles)
+}
+
+func TestTofuEngine_RunDriftDetectionOnlyForPlan(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "ran $*"`))
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"apply"}, Meta: stringMeta("drift_detection", "plan")}, mockStream))
+	assert.Equal(t, "ran apply\n", stdout(mockStream.Responses))
+
+	err := tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"plan"}, Meta: stringMeta("drift_detection", "always")}, &MockRunServer{})
+	require.ErrorIs(t, err, engine.ErrInvalidDriftDetection)
+}
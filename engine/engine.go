@@ -8,19 +8,19 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/creack/pty"
 	"github.com/gofrs/flock"
 	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
 	"github.com/hashicorp/go-plugin"
 	"github.com/opentofu/tofudl"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
 	"google.golang.org/grpc"
@@ -35,8 +35,19 @@ const (
 
 type TofuEngine struct {
 	tgengine.UnimplementedEngineServer
+	config     *engineConfig
+	mirror     *providerMirror
+	metrics    *MetricsServer
 	binaryPath string
 	mu         sync.RWMutex
+
+	// health is the health of the plugin, drained by Shutdown. It is nil on the standalone server, where clients
+	// can't drain the shared server.
+	health *engineHealth
+
+	// session is set on the engine of a client connection of the standalone server, whose metrics are served by
+	// the server rather than by the engines of its clients
+	session bool
 }
 
 // setBinaryPath safely sets the binary path
@@ -54,36 +65,101 @@ func (c *TofuEngine) getBinaryPath() string {
 	return c.binaryPath
 }
 
+// binary returns the tofu binary used by Run
+func (c *TofuEngine) binary() string {
+	if binaryPath := c.getBinaryPath(); binaryPath != "" {
+		return binaryPath
+	}
+
+	return iacCommand
+}
+
 func (c *TofuEngine) Init(req *tgengine.InitRequest, stream tgengine.Engine_InitServer) error {
 	log.Info("Init Tofu plugin")
 
+	ctx, span := tracer.Start(traceContext(stream.Context()), "Init",
+		trace.WithAttributes(attrVersion.String(metaString(req.GetMeta(), "tofu_version"))))
+	defer span.End()
+
 	if err := stream.Send(&tgengine.InitResponse{Stdout: "Tofu Initialization started\n"}); err != nil {
 		return err
 	}
 
-	version := ""
-	installDir := ""
+	config, err := parseEngineConfig(req.GetMeta())
+	if err != nil {
+		log.Errorf("Invalid engine configuration: %v", err)
+		spanError(span, err)
 
-	if req.GetMeta() != nil {
-		if versionAny, exists := req.GetMeta()["tofu_version"]; exists {
-			if stringValue := versionAny.GetValue(); stringValue != nil {
-				version = string(stringValue)
-			}
+		if sendErr := stream.Send(&tgengine.InitResponse{Stderr: err.Error(), ResultCode: errorResultCode}); sendErr != nil {
+			return sendErr
 		}
 
-		if installDirAny, exists := req.GetMeta()["tofu_install_dir"]; exists {
-			if stringValue := installDirAny.GetValue(); stringValue != nil {
-				installDir = string(stringValue)
+		return err
+	}
+
+	c.setConfig(config)
+
+	var mirror *providerMirror
+
+	if config.providerMirrorDir != "" {
+		if mirror, err = startProviderMirror(config.providerMirrorDir); err != nil {
+			log.Errorf("Failed to start provider mirror: %v", err)
+			spanError(span, err)
+
+			if sendErr := stream.Send(&tgengine.InitResponse{Stderr: err.Error(), ResultCode: errorResultCode}); sendErr != nil {
+				return sendErr
 			}
+
+			return err
+		}
+	}
+
+	c.setMirror(mirror)
+
+	metricsAddress := config.metricsAddress
+	if c.session && metricsAddress != "" {
+		log.Warnf("Ignoring %s, the server serves its metrics with -metrics-address", metaMetricsAddress)
+
+		metricsAddress = ""
+	}
+
+	if err := c.setMetrics(metricsAddress); err != nil {
+		log.Errorf("Failed to serve metrics: %v", err)
+		spanError(span, err)
+
+		if sendErr := stream.Send(&tgengine.InitResponse{Stderr: err.Error(), ResultCode: errorResultCode}); sendErr != nil {
+			return sendErr
 		}
+
+		return err
 	}
 
-	if version != "" {
+	version := metaString(req.GetMeta(), "tofu_version")
+	installDir := metaString(req.GetMeta(), "tofu_install_dir")
+
+	// the SSH executor runs the tofu of the remote host, a downloaded binary would be unused
+	if executor, ok := config.executor.(*sshExecutor); ok && version != "" {
+		if err := executor.checkVersion(version); err != nil {
+			log.Errorf("Invalid OpenTofu version: %v", err)
+			spanError(span, err)
+
+			if sendErr := stream.Send(&tgengine.InitResponse{Stderr: err.Error(), ResultCode: errorResultCode}); sendErr != nil {
+				return sendErr
+			}
+
+			return err
+		}
+
+		c.setBinaryPath(iacCommand)
+
+		log.Debugf("Using the OpenTofu binary of the remote host (version: %s)", version)
+	} else if version != "" {
 		log.Debugf("Downloading OpenTofu binary (version: %s)...", version)
 
-		binaryPath, downloadErr := c.downloadOpenTofu(version, installDir)
+		binaryPath, downloadErr := c.downloadOpenTofu(ctx, version, installDir)
 		if downloadErr != nil {
 			log.Errorf("Failed to download OpenTofu: %v\n", downloadErr)
+			spanError(span, downloadErr)
 
 			if err := stream.Send(
 				&tgengine.InitResponse{
@@ -98,6 +174,7 @@ func (c *TofuEngine) Init(req *tgengine.InitRequest, stream tgengine.Engine_Init
 		}
 
 		c.setBinaryPath(binaryPath)
+		span.SetAttributes(attrBinary.String(binaryPath))
 
 		log.Debugf("OpenTofu binary downloaded to: %s\n", binaryPath)
 	} else {
@@ -106,6 +183,10 @@ func (c *TofuEngine) Init(req *tgengine.InitRequest, stream tgengine.Engine_Init
 		log.Debug("Using system OpenTofu binary (no version specified)")
 	}
 
+	if c.health != nil {
+		c.health.resume()
+	}
+
 	log.Info("Engine Initialization completed")
 
 	if err := stream.Send(&tgengine.InitResponse{Stdout: "Tofu Initialization completed\n"}); err != nil {
@@ -182,51 +263,126 @@ func getLockFilePath() (string, error) {
 }
 
 // downloadOpenTofu downloads the OpenTofu binary and returns the path to it
-func (c *TofuEngine) downloadOpenTofu(version, installDir string) (string, error) {
+func (c *TofuEngine) downloadOpenTofu(ctx context.Context, version, installDir string) (binaryPath string, err error) {
+	ctx, span := tracer.Start(ctx, "downloadOpenTofu", trace.WithAttributes(attrVersion.String(version)))
+	defer func() { endSpan(span, err) }()
+
 	lockFilePath, err := getLockFilePath()
 	if err != nil {
 		log.Warnf("Failed to get lock file path, continuing without locking: %v", err)
-		return c.downloadOpenTofuUnsafe(version, installDir)
+		return c.downloadOpenTofuUnsafe(ctx, version, installDir)
 	}
 
-	fileLock := flock.New(lockFilePath)
-
 	log.Debugf("Acquiring download lock for OpenTofu version %s: %s", version, lockFilePath)
 
-	locked, err := fileLock.TryLock()
+	_, lockSpan := tracer.Start(ctx, "acquire download lock")
+	unlock, err := acquireFileLock(lockKindDownload, lockFilePath, false)
+	endSpan(lockSpan, err)
+
 	if err != nil {
 		log.Warnf("Failed to acquire download lock, continuing without locking: %v", err)
-		return c.downloadOpenTofuUnsafe(version, installDir)
+		return c.downloadOpenTofuUnsafe(ctx, version, installDir)
+	}
+
+	log.Debugf("Acquired download lock for OpenTofu version %s", version)
+
+	defer func() {
+		unlock()
+		log.Debugf("Released download lock for OpenTofu version %s", version)
+	}()
+
+	return c.downloadOpenTofuUnsafe(ctx, version, installDir)
+}
+
+// acquireFileLock takes an exclusive, or with shared a shared, lock on the file at path, waiting while another
+// process holds a conflicting lock. The wait is recorded in the lock metrics of kind. The returned function
+// releases the lock.
+func acquireFileLock(kind, path string, shared bool) (func(), error) {
+	fileLock := flock.New(path)
+	start := time.Now()
+
+	tryLock, lock := fileLock.TryLock, fileLock.Lock
+	if shared {
+		tryLock, lock = fileLock.TryRLock, fileLock.RLock
+	}
+
+	locked, err := tryLock()
+	if err != nil {
+		return nil, err
 	}
 
 	if !locked {
-		log.Debug("Download lock is held by another process, waiting...")
+		log.Debugf("Lock %s is held by another process, waiting...", path)
+
+		lockQueueDepth.WithLabelValues(kind).Inc()
+		err := lock()
+		lockQueueDepth.WithLabelValues(kind).Dec()
 
-		err = fileLock.Lock()
 		if err != nil {
-			log.Warnf("Failed to acquire blocking download lock, continuing without locking: %v", err)
-			return c.downloadOpenTofuUnsafe(version, installDir)
+			return nil, err
 		}
 	}
 
-	log.Debugf("Acquired download lock for OpenTofu version %s", version)
+	lockWait.WithLabelValues(kind).Observe(time.Since(start).Seconds())
 
-	defer func() {
-		if unlockErr := fileLock.Unlock(); unlockErr != nil {
-			log.Warnf("Failed to release download lock: %v", unlockErr)
-		} else {
-			log.Debugf("Released download lock for OpenTofu version %s", version)
+	return func() {
+		if err := fileLock.Unlock(); err != nil {
+			log.Warnf("Failed to release lock %s: %v", path, err)
 		}
-	}()
-
-	return c.downloadOpenTofuUnsafe(version, installDir)
+	}, nil
 }
 
 var ErrFailedToDownload = errors.New("failed to download OpenTofu")
 
+// resolveVersion returns the release of a requested version, "latest" is the newest stable release
+func resolveVersion(ctx context.Context, mirror tofudl.Mirror, version string) (tofudl.VersionWithArtifacts, error) {
+	var (
+		opts      []tofudl.ListVersionOpt
+		requested tofudl.Version
+	)
+
+	// Handle "latest" version using stability option, otherwise use specific version
+	if version == "latest" {
+		opts = append(opts, tofudl.ListVersionOptMinimumStability(tofudl.StabilityStable))
+
+		log.Debug("Downloading latest stable OpenTofu version")
+	} else {
+		requested = tofudl.Version(normalizeVersion(version))
+		if err := requested.Validate(); err != nil {
+			return tofudl.VersionWithArtifacts{}, err
+		}
+
+		log.Debugf("Downloading OpenTofu version: %s (normalized: %s)", version, requested)
+	}
+
+	releases, err := mirror.ListVersions(ctx, opts...)
+	if err != nil {
+		return tofudl.VersionWithArtifacts{}, err
+	}
+
+	for _, release := range releases {
+		if requested == "" || release.ID == requested {
+			return release, nil
+		}
+	}
+
+	if requested == "" {
+		return tofudl.VersionWithArtifacts{}, errors.New("no stable OpenTofu release found")
+	}
+
+	return tofudl.VersionWithArtifacts{}, &tofudl.NoSuchVersionError{Version: requested}
+}
+
 // downloadOpenTofuUnsafe performs the actual download without locking
 // This is separated to allow fallback when locking fails
-func (c *TofuEngine) downloadOpenTofuUnsafe(version, installDir string) (string, error) {
+func (c *TofuEngine) downloadOpenTofuUnsafe(ctx context.Context, version, installDir string) (binaryPath string, err error) {
+	start := time.Now()
+
+	// the metrics are labeled with the resolved release, the requested version is any string a client sends
+	resolved := unresolvedVersion
+
+	defer func() { observeDownload(resolved, time.Since(start), err) }()
+
 	dl, err := tofudl.New()
 	if err != nil {
 		return "", fmt.Errorf("failed to create downloader: %w", err)
@@ -257,22 +413,18 @@ func (c *TofuEngine) downloadOpenTofuUnsafe(version, installDir string) (string,
 		return "", fmt.Errorf("failed to create mirror: %w", err)
 	}
 
-	var opts []tofudl.DownloadOpt
+	_, downloadSpan := tracer.Start(ctx, "mirror download")
 
-	// Handle "latest" version using stability option, otherwise use specific version
-	if version == "latest" {
-		opts = append(opts, tofudl.DownloadOptMinimumStability(tofudl.StabilityStable))
+	var binary []byte
 
-		log.Debug("Downloading latest stable OpenTofu version")
-	} else {
-		normalizedVersion := normalizeVersion(version)
-		opts = append(opts, tofudl.DownloadOptVersion(tofudl.Version(normalizedVersion)))
-		log.Debugf("Downloading OpenTofu version: %s (normalized: %s)", version, normalizedVersion)
+	release, err := resolveVersion(ctx, mirror, version)
+	if err == nil {
+		resolved = string(release.ID)
+		binary, err = mirror.DownloadVersion(ctx, release, "", "")
 	}
 
-	ctx := context.Background()
+	endSpan(downloadSpan, err)
 
-	binary, err := mirror.Download(ctx, opts...)
 	if err != nil {
 		return "", fmt.Errorf("%w: %w", ErrFailedToDownload, err)
 	}
@@ -296,14 +448,22 @@ func (c *TofuEngine) downloadOpenTofuUnsafe(version, installDir string) (string,
 		binaryName += ".exe"
 	}
 
-	binaryPath := filepath.Join(installDir, binaryName)
+	binaryPath = filepath.Join(installDir, binaryName)
 
 	if info, err := os.Stat(binaryPath); err == nil && info.Size() > 0 {
 		log.Debugf("OpenTofu binary already exists at: %s", binaryPath)
+		downloadCacheHits.WithLabelValues(resolved).Inc()
+
 		return binaryPath, nil
 	}
 
-	if err := os.WriteFile(binaryPath, binary, installDirMode); err != nil {
+	downloadCacheMisses.WithLabelValues(resolved).Inc()
+
+	_, writeSpan := tracer.Start(ctx, "write binary", trace.WithAttributes(attrBinary.String(binaryPath)))
+	err = os.WriteFile(binaryPath, binary, installDirMode)
+	endSpan(writeSpan, err)
+
+	if err != nil {
 		return "", fmt.Errorf("failed to write OpenTofu binary: %w", err)
 	}
 
@@ -313,134 +473,581 @@ func (c *TofuEngine) downloadOpenTofuUnsafe(version, installDir string) (string,
 }
 
 func (c *TofuEngine) Run(req *tgengine.RunRequest, stream tgengine.Engine_RunServer) error {
-	log.Infof("Run Tofu plugin %v", req.GetWorkingDir())
+	runID := newRunID()
 
-	cmdPath := c.getBinaryPath()
-	if cmdPath == "" {
-		cmdPath = iacCommand
+	logger, err := runLogger(req, runID)
+	if err != nil {
+		sendError(stream, err)
+		return err
 	}
 
-	cmd := exec.Command(cmdPath, req.GetArgs()...)
-	cmd.Dir = req.GetWorkingDir()
+	config := c.getConfig()
 
-	env := make([]string, 0, len(req.GetEnvVars()))
-	for key, value := range req.GetEnvVars() {
-		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	run := func(stream tgengine.Engine_RunServer) error {
+		return c.run(req, stream, logger)
+	}
+
+	if runLogs := config.runLogs; runLogs != nil {
+		teed := run
+		run = func(stream tgengine.Engine_RunServer) error {
+			return runLogs.tee(req, stream, runID, c.binary(), logger, teed)
+		}
+	}
+
+	if audit := config.auditLog; audit != nil {
+		audited := run
+		run = func(stream tgengine.Engine_RunServer) error {
+			return audit.audit(req, stream, runID, c.binary(), audited)
+		}
 	}
 
-	cmd.Env = append(cmd.Env, env...)
+	return traceRun(req, stream, func(stream tgengine.Engine_RunServer) error {
+		return observeRun(req, stream, run)
+	})
+}
+
+// run executes a Run request, logging through the logger of the run
+func (c *TofuEngine) run(req *tgengine.RunRequest, stream tgengine.Engine_RunServer, logger *log.Entry) error {
+	logger.Infof("Run Tofu plugin %v", req.GetWorkingDir())
+
+	config := c.getConfig()
+
+	if err := config.commandPolicy.check(req.GetArgs(), req.GetEnvVars()); err != nil {
+		logger.Warnf("Rejected tofu invocation %v: %v", req.GetArgs(), err)
+		sendError(stream, err)
+
+		return err
+	}
 
-	stdoutPipe, err := cmd.StdoutPipe()
+	workingDir, err := resolveWorkingDir(req.GetWorkingDir(), config.allowedRoots, req.GetArgs())
 	if err != nil {
+		logger.Warnf("Rejected working directory %q: %v", req.GetWorkingDir(), err)
 		sendError(stream, err)
+
 		return err
 	}
 
-	stderrPipe, err := cmd.StderrPipe()
+	opts, err := parseRunOptions(req, workingDir, config)
 	if err != nil {
 		sendError(stream, err)
 		return err
 	}
 
-	if req.GetAllocatePseudoTty() {
-		ptmx, err := pty.Start(cmd)
-		if err != nil {
-			log.Errorf("Error allocating pseudo-TTY: %v", err)
-			return err
+	opts.log = logger
+
+	if mirror := c.getMirror(); mirror != nil {
+		mirror.configure(req, opts)
+	}
+
+	var cache *initCache
+
+	if !opts.forceInit {
+		if cache, err = newInitCache(req, opts, c.binary()); err != nil {
+			logger.Debugf("Failed to fingerprint init inputs, running init: %v", err)
 		}
+	}
 
-		defer func() { _ = ptmx.Close() }()
+	if cache != nil && cache.upToDate() {
+		logger.Infof("Skipping init in %s, fingerprint %s matches the last successful init", cache.moduleDir, cache.fingerprint)
 
-		go func() {
-			_, _ = io.Copy(ptmx, os.Stdin)
-		}()
-		go func() {
-			_, _ = io.Copy(os.Stdout, ptmx)
-		}()
-		go func() {
-			_, _ = io.Copy(os.Stderr, ptmx)
-		}()
-	} else {
-		cmd.Stdin = os.Stdin
+		return sendSkippedInit(stream, cache, opts)
 	}
 
-	if err := cmd.Start(); err != nil {
+	plan, err := newPlanRun(req, opts, config.planStoreDir, c.command(req, opts, nil))
+	if err != nil {
+		logger.Warnf("Rejected plan store run %v: %v", req.GetArgs(), err)
 		sendError(stream, err)
+
 		return err
 	}
 
-	var wg sync.WaitGroup
+	if plan != nil && plan.planFile != "" {
+		opts.extraArgs = []string{plan.planFile}
+	}
 
-	// 2 streams to send stdout and stderr
-	wg.Add(wgSize)
+	if config.guardrails != nil && guardedRun(req.GetArgs()) {
+		var planFile string
+		if plan != nil {
+			planFile = plan.planFile
+		}
 
-	// Stream stdout
-	go func() {
-		defer wg.Done()
+		if err := c.checkGuardrails(req, opts, config.guardrails, planFile); err != nil {
+			logger.Errorf("Refusing to run %v: %v", req.GetArgs(), err)
 
-		reader := transform.NewReader(stdoutPipe, unicode.UTF8.NewDecoder())
-		bufReader := bufio.NewReader(reader)
+			if plan != nil {
+				_, _ = plan.finish(errorResultCode)
+			}
 
-		for {
-			char, _, err := bufReader.ReadRune()
-			if err != nil {
-				if !errors.Is(err, io.EOF) {
-					log.Errorf("Error reading stdout: %v", err)
-				}
+			sendError(stream, err)
 
-				break
+			return err
+		}
+	}
+
+	var stateBackup *StateBackup
+
+	if config.stateBackup != nil && mutatesState(req.GetArgs()) {
+		if stateBackup, err = c.backupState(req, opts, config.stateBackup); err != nil {
+			logger.Errorf("Refusing to run %v without a state backup: %v", req.GetArgs(), err)
+
+			if plan != nil {
+				_, _ = plan.finish(errorResultCode)
 			}
 
-			if err = stream.Send(&tgengine.RunResponse{Stdout: string(char)}); err != nil {
-				log.Errorf("Error sending stdout: %v", err)
-				return
+			sendError(stream, err)
+
+			return err
+		}
+
+		if stateBackup != nil {
+			message := fmt.Sprintf("Backed up state (serial %d) to %s\n", stateBackup.Serial, stateBackup.Path)
+			if err := stream.Send(&tgengine.RunResponse{Stdout: message}); err != nil {
+				return err
 			}
 		}
-	}()
+	}
 
-	// Stream stderr
-	go func() {
-		defer wg.Done()
+	var drift *driftRun
 
-		reader := transform.NewReader(stderrPipe, unicode.UTF8.NewDecoder())
-		bufReader := bufio.NewReader(reader)
+	if opts.driftMode != "" {
+		if drift, err = newDriftRun(req, opts); err != nil {
+			sendError(stream, err)
+			return err
+		}
+
+		defer drift.cleanup()
+	}
+
+	var (
+		result  *runResult
+		attempt int
+	)
 
-		for {
-			char, _, err := bufReader.ReadRune()
+	for attempt = 1; ; attempt++ {
+		unlock := lockProviderCacheForRun(req, opts)
+		result, err = c.execute(req, stream, opts)
+
+		unlock()
+
+		if err != nil {
+			return err
+		}
+
+		// with -detailed-exitcode, tofu exits with 2 when the plan has changes
+		if drift != nil && result.resultCode == driftResultCode {
+			result.resultCode = 0
+		}
+
+		if result.resultCode == 0 {
+			break
+		}
+
+		pattern := config.retry.retryable(req.GetArgs(), attempt, result.retryOutput(req.GetArgs()))
+		if pattern == nil {
+			break
+		}
+
+		sleep := config.retry.backoff(attempt)
+		message := fmt.Sprintf("Attempt %d of %d failed with a retryable error (matched %q), retrying in %s\n",
+			attempt, config.retry.maxAttempts, pattern.String(), sleep)
+
+		logger.Warn(strings.TrimSpace(message))
+
+		if err := stream.Send(&tgengine.RunResponse{Stderr: message}); err != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(sleep):
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+
+	if cache != nil {
+		cache.record(req, c.binary(), result.resultCode)
+	}
+
+	recordProviderCacheUse(req, opts)
+
+	final := &tgengine.RunResponse{ResultCode: int32(result.resultCode)}
+
+	var driftReport *DriftReport
+
+	if drift != nil && result.resultCode == 0 {
+		if driftReport, err = drift.report(c, req, opts, config.driftReportDir); err != nil {
+			logger.Errorf("Failed to build drift report: %v", err)
+
+			final.Stderr = fmt.Sprintf("Failed to build drift report: %v\n", err)
+			final.ResultCode = errorResultCode
+		} else {
+			record, err := encodeEventRecord(&Event{Type: EventTypeDrift, Drift: driftReport})
 			if err != nil {
-				if !errors.Is(err, io.EOF) {
-					log.Errorf("Error reading stderr: %v", err)
-				}
+				return err
+			}
+
+			if err := stream.Send(&tgengine.RunResponse{Stdout: record}); err != nil {
+				return err
+			}
+		}
+	}
+
+	var violations []PolicyViolation
 
-				break
+	if planFile := planOutFile(req.GetArgs()); len(config.policies) > 0 && result.resultCode == 0 && planFile != "" {
+		if violations, err = c.checkPlanPolicies(req, opts, config.policies, planFile); err != nil {
+			logger.Errorf("Failed to check plan %s against policies: %v", planFile, err)
+
+			final.Stderr = fmt.Sprintf("%v\n", err)
+			final.ResultCode = errorResultCode
+		} else if len(violations) > 0 {
+			logger.Warnf("Plan %s violates %d policy rule(s), removing it", planFile, len(violations))
+
+			if !filepath.IsAbs(planFile) {
+				planFile = filepath.Join(moduleDir(workingDir, req.GetArgs()), planFile)
 			}
 
-			if err = stream.Send(&tgengine.RunResponse{Stderr: string(char)}); err != nil {
-				log.Errorf("Error sending stderr: %v", err)
-				return
+			if err := os.Remove(planFile); err != nil && !os.IsNotExist(err) {
+				logger.Warnf("Failed to remove plan %s: %v", planFile, err)
 			}
+
+			final.Stderr = renderViolations(violations)
+			final.ResultCode = errorResultCode
 		}
-	}()
-	wg.Wait()
 
-	resultCode := 0
+		if err == nil {
+			record, err := encodeEventRecord(&Event{Type: EventTypePolicyCheck, Violations: violations})
+			if err != nil {
+				return err
+			}
+
+			if err := stream.Send(&tgengine.RunResponse{Stdout: record}); err != nil {
+				return err
+			}
+		}
+	}
+
+	var planID string
+
+	if plan != nil {
+		if planID, err = plan.finish(int(final.GetResultCode())); err != nil {
+			logger.Errorf("Failed to store plan: %v", err)
+
+			final.Stderr = fmt.Sprintf("Failed to store plan: %v\n", err)
+			final.ResultCode = errorResultCode
+		} else if plan.outFile != "" && planID != "" {
+			if err := stream.Send(&tgengine.RunResponse{Stdout: fmt.Sprintf("Stored plan %s, apply it with the %s meta option\n", planID, metaPlanID)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if attempt > 1 {
+		final.Stderr += fmt.Sprintf("Run finished after %d attempts\n", attempt)
+	}
+
+	if opts.report {
+		report := &RunReport{
+			ResultCode:  int(final.GetResultCode()),
+			Attempts:    attempt,
+			PlanID:      planID,
+			Violations:  violations,
+			Drift:       driftReport,
+			Diagnostics: collectDiagnostics(req.GetArgs(), result.stdout, result.stderr),
+		}
 
-	if err := cmd.Wait(); err != nil {
-		var exitError *exec.ExitError
-		if ok := errors.As(err, &exitError); ok {
-			resultCode = exitError.ExitCode()
+		if stateBackup != nil {
+			report.StateBackup = stateBackup.Path
+		}
+
+		record, err := report.record()
+		if err != nil {
+			logger.Errorf("Error encoding run report: %v", err)
 		} else {
-			resultCode = 1
+			final.Stdout = record
 		}
 	}
 
-	if err := stream.Send(&tgengine.RunResponse{ResultCode: int32(resultCode)}); err != nil {
+	if err := stream.Send(final); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// sendSkippedInit completes an init run which was skipped because nothing changed
+func sendSkippedInit(stream tgengine.Engine_RunServer, cache *initCache, opts *runOptions) error {
+	message := fmt.Sprintf("Skipping tofu init: nothing changed since the last successful init (fingerprint %s). "+
+		"Set the %s meta option to force it.\n", cache.fingerprint[:12], metaForceInit)
+
+	if err := stream.Send(&tgengine.RunResponse{Stdout: message}); err != nil {
+		return err
+	}
+
+	final := &tgengine.RunResponse{}
+
+	if opts.report {
+		report := &RunReport{Diagnostics: []Diagnostic{}, InitSkipped: true}
+
+		record, err := report.record()
+		if err != nil {
+			return err
+		}
+
+		final.Stdout = record
+	}
+
+	return stream.Send(final)
+}
+
+// runOptions are the per-run settings parsed from a RunRequest
+type runOptions struct {
+	sandbox *sandboxOptions
+
+	// env are environment variables the engine sets for tofu in addition to the ones of the request
+	env map[string]string
+
+	// extraArgs are appended to the arguments of the request, e.g. the stored plan of an apply
+	extraArgs  []string
+	workingDir string
+
+	// providerCacheDir is the managed provider cache used by the run, empty when tofu uses its own
+	providerCacheDir string
+
+	// driftMode is the drift detection mode of a plan run, empty for other runs
+	driftMode string
+
+	// log is the logger of the run
+	log *log.Entry
+
+	// executor spawns the tofu processes of the run
+	executor Executor
+
+	jsonEvents bool
+	report     bool
+	forceInit  bool
+}
+
+// parseRunOptions parses the per-run settings from Run meta and the engine configuration
+func parseRunOptions(req *tgengine.RunRequest, workingDir string, config *engineConfig) (*runOptions, error) {
+	opts := &runOptions{workingDir: workingDir, executor: config.executor}
+
+	if opts.executor == nil {
+		opts.executor = localExecutor{}
+	}
+
+	var err error
+
+	pluginCacheDir := requestEnv(req, pluginCacheDirEnv)
+	if pluginCacheDir == "" && config.providerCacheDir != "" {
+		pluginCacheDir = config.providerCacheDir
+		opts.providerCacheDir = config.providerCacheDir
+		opts.env = map[string]string{pluginCacheDirEnv: config.providerCacheDir}
+	}
+
+	if opts.jsonEvents, err = jsonEventsEnabled(req); err != nil {
+		return nil, err
+	}
+
+	if opts.report, err = metaBool(req.GetMeta(), metaRunReport); err != nil {
+		return nil, err
+	}
+
+	if opts.forceInit, err = metaBool(req.GetMeta(), metaForceInit); err != nil {
+		return nil, err
+	}
+
+	if opts.driftMode, err = parseDriftDetection(req); err != nil {
+		return nil, err
+	}
+
+	if opts.sandbox, err = sandboxOptionsFromRequest(req, workingDir, pluginCacheDir); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// runResult is the outcome of a single tofu execution
+type runResult struct {
+	stdout     string
+	stderr     string
+	resultCode int
+}
+
+// retryOutput returns the output matched against the retryable errors: stderr, and stdout when tofu reports
+// its errors there with -json
+func (r *runResult) retryOutput(args []string) string {
+	_, flags := splitCommandArgs(args)
+	if slices.Contains(flags, jsonFlag) {
+		return r.stderr + r.stdout
+	}
+
+	return r.stderr
+}
+
+// command describes a tofu process with args for a run
+func (c *TofuEngine) command(req *tgengine.RunRequest, opts *runOptions, args []string) *ExecSpec {
+	spec := &ExecSpec{
+		Binary:  c.binary(),
+		Args:    args,
+		Dir:     opts.workingDir,
+		TTY:     req.GetAllocatePseudoTty(),
+		sandbox: opts.sandbox,
+	}
+
+	if opts.providerCacheDir != "" {
+		spec.Paths = append(spec.Paths, opts.providerCacheDir)
+	} else if pluginCacheDir := req.GetEnvVars()[pluginCacheDirEnv]; pluginCacheDir != "" {
+		spec.Paths = append(spec.Paths, pluginCacheDir)
+	}
+
+	env := make([]string, 0, len(req.GetEnvVars()))
+	for key, value := range req.GetEnvVars() {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	// tofu inherits the engine environment only when the request has none
+	if len(opts.env) > 0 && len(env) == 0 {
+		env = os.Environ()
+	}
+
+	for key, value := range opts.env {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	spec.Env = env
+
+	if opts.sandbox != nil {
+		opts.log.Debugf("Running tofu in sandbox, writable paths: %v", opts.sandbox.WritablePaths)
+	}
+
+	return spec
+}
+
+// capture runs an auxiliary tofu command for a run, e.g. `state pull`, and returns its stdout.
+// Global flags of the run such as -chdir are passed on.
+func (c *TofuEngine) capture(req *tgengine.RunRequest, opts *runOptions, args ...string) ([]byte, error) {
+	var globalFlags []string
+
+	for _, arg := range req.GetArgs() {
+		if !strings.HasPrefix(arg, "-") {
+			break
+		}
+
+		globalFlags = append(globalFlags, arg)
+	}
+
+	spec := c.command(req, opts, slices.Concat(globalFlags, args))
+	spec.TTY = false
+	// the plan file of a speculative plan is the only output the run needs from the working directory
+	spec.Capture = planOutFile(args) == ""
+
+	exitCode, stdout, stderr, err := runProcess(context.Background(), opts.executor, spec)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("tofu %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(stderr)))
+	}
+
+	return stdout, nil
+}
+
+// execute runs tofu once, streaming its output, and returns the result code together with the captured output.
+// Errors are returned only when tofu could not be started, in which case they are already sent on the stream.
+func (c *TofuEngine) execute(req *tgengine.RunRequest, stream tgengine.Engine_RunServer, opts *runOptions) (*runResult, error) {
+	spec := c.command(req, opts, slices.Concat(req.GetArgs(), opts.extraArgs))
+
+	ctx, spawnSpan := tracer.Start(stream.Context(), "spawn", trace.WithAttributes(attrBinary.String(spec.Binary)))
+
+	process, err := opts.executor.Start(ctx, spec)
+	if err != nil {
+		opts.log.Errorf("Error starting tofu: %v", err)
+		endSpan(spawnSpan, err)
+		sendError(stream, err)
+
+		return nil, err
+	}
+
+	spawnSpan.End()
+
+	_, streamSpan := tracer.Start(stream.Context(), "stream")
+
+	var (
+		wg             sync.WaitGroup
+		stdout, stderr strings.Builder
+	)
+
+	// 2 streams to send stdout and stderr
+	wg.Add(wgSize)
+
+	// Stream stdout
+	go func() {
+		defer wg.Done()
+
+		sendStdout := func(output string) error {
+			stdout.WriteString(output)
+			return stream.Send(&tgengine.RunResponse{Stdout: output})
+		}
+
+		if opts.jsonEvents {
+			streamEvents(opts.log, process.Stdout(), subcommand(req.GetArgs()) == validateCommand, sendStdout)
+			return
+		}
+
+		streamRunes(opts.log, process.Stdout(), "stdout", sendStdout)
+	}()
+
+	// Stream stderr
+	go func() {
+		defer wg.Done()
+
+		streamRunes(opts.log, process.Stderr(), "stderr", func(output string) error {
+			stderr.WriteString(output)
+			return stream.Send(&tgengine.RunResponse{Stderr: output})
+		})
+	}()
+	wg.Wait()
+	streamSpan.End()
+
+	_, waitSpan := tracer.Start(stream.Context(), "wait")
+
+	resultCode, err := process.Wait()
+	if err != nil {
+		opts.log.Errorf("Error waiting for tofu: %v", err)
+		resultCode = 1
+	}
+
+	waitSpan.SetAttributes(attrExitCode.Int(resultCode))
+	waitSpan.End()
+
+	return &runResult{resultCode: resultCode, stdout: stdout.String(), stderr: stderr.String()}, nil
+}
+
+// streamRunes forwards the output of pipe character by character
+func streamRunes(logger *log.Entry, pipe io.Reader, name string, send func(string) error) {
+	reader := transform.NewReader(pipe, unicode.UTF8.NewDecoder())
+	bufReader := bufio.NewReader(reader)
+
+	for {
+		char, _, err := bufReader.ReadRune()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Errorf("Error reading %s: %v", name, err)
+			}
+
+			return
+		}
+
+		if err = send(string(char)); err != nil {
+			logger.Errorf("Error sending %s: %v", name, err)
+			return
+		}
+	}
+}
+
 func sendError(stream tgengine.Engine_RunServer, err error) {
 	if err = stream.Send(&tgengine.RunResponse{Stderr: fmt.Sprintf("%v", err), ResultCode: errorResultCode}); err != nil {
 		log.Warnf("Error sending response: %v", err)
@@ -450,6 +1057,18 @@ func sendError(stream tgengine.Engine_RunServer, err error) {
 func (c *TofuEngine) Shutdown(req *tgengine.ShutdownRequest, stream tgengine.Engine_ShutdownServer) error {
 	log.Info("Shutdown Tofu plugin")
 
+	if c.health != nil {
+		c.health.drain()
+	}
+
+	c.setMirror(nil)
+
+	if err := c.setMetrics(""); err != nil {
+		log.Warnf("Failed to stop metrics server: %v", err)
+	}
+
+	flushTraces(stream.Context())
+
 	if err := stream.Send(&tgengine.ShutdownResponse{Stdout: "Tofu Shutdown completed\n", Stderr: "", ResultCode: 0}); err != nil {
 		return err
 	}
@@ -2,6 +2,8 @@ package engine_test
 
 import (
 	"context"
+	"path/filepath"
+	"runtime"
 	"testing"
 
 	"os"
@@ -13,6 +15,7 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
 // MockInitServer is a mock implementation of the InitServer interface
@@ -183,6 +186,19 @@ func TestTofuEngineError(t *testing.T) {
 	assert.NotEqual(t, 0, code)
 }
 
+func TestTofuEngine_RunInheritsEnvironment(t *testing.T) {
+	t.Setenv("TOFU_ENGINE_TEST_VAR", "inherited")
+
+	tofuEngine := &engine.TofuEngine{}
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "var=$TOFU_ENGINE_TEST_VAR"`))
+
+	// without env vars, tofu runs with the environment of the engine
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"plan"}}, mockStream))
+	assert.Equal(t, "var=inherited\n", stdout(mockStream.Responses))
+	assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+}
+
 func TestTofuEngine_Shutdown(t *testing.T) {
 	t.Parallel()
 	engine := &engine.TofuEngine{}
@@ -203,3 +219,56 @@ func TestHelperProcess(*testing.T) {
 	cmd.Stderr = os.Stderr
 	_ = cmd.Run()
 }
+
+// fakeTofu writes a shell script acting as the tofu binary and returns its path
+func fakeTofu(t *testing.T, script string) string {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("fake tofu binaries are shell scripts")
+	}
+
+	path := filepath.Join(t.TempDir(), "tofu")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755))
+
+	return path
+}
+
+// stringMeta builds request meta from key/value pairs
+func stringMeta(pairs ...string) map[string]*anypb.Any {
+	meta := make(map[string]*anypb.Any, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		meta[pairs[i]] = &anypb.Any{Value: []byte(pairs[i+1])}
+	}
+
+	return meta
+}
+
+// stdout merges stdout from all responses
+func stdout(responses []*tgengine.RunResponse) string {
+	var output string
+	for _, response := range responses {
+		output += response.GetStdout()
+	}
+
+	return output
+}
+
+// stderr merges stderr from all responses
+func stderr(responses []*tgengine.RunResponse) string {
+	var output string
+	for _, response := range responses {
+		output += response.GetStderr()
+	}
+
+	return output
+}
+
+// resultCode returns the result code of the last response
+func resultCode(responses []*tgengine.RunResponse) int32 {
+	if len(responses) == 0 {
+		return -1
+	}
+
+	return responses[len(responses)-1].GetResultCode()
+}
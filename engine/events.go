@@ -0,0 +1,345 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+const (
+	metaJSONEvents = "json_events"
+	jsonFlag       = "-json"
+
+	// EventRecordSeparator prefixes every event record sent on stdout, following RFC 7464 JSON text sequences
+	EventRecordSeparator = "\x1e"
+
+	EventTypeDiagnostic    = "diagnostic"
+	EventTypeChangeSummary = "change_summary"
+	EventTypeOutputs       = "outputs"
+	EventTypeValidation    = "validation"
+
+	validateCommand = "validate"
+)
+
+// Event is a typed message parsed from the machine readable UI of `tofu -json`.
+// Type is the tofu message type, e.g. planned_change, apply_complete, diagnostic or change_summary.
+type Event struct {
+	Resource   *ResourceEvent         `json:"resource,omitempty"`
+	Diagnostic *Diagnostic            `json:"diagnostic,omitempty"`
+	Changes    *ChangeSummary         `json:"changes,omitempty"`
+	Validation *ValidationResult      `json:"validation,omitempty"`
+	Report     *RunReport             `json:"report,omitempty"`
+	Violations []PolicyViolation      `json:"violations,omitempty"`
+	Drift      *DriftReport           `json:"drift,omitempty"`
+	Outputs    map[string]OutputValue `json:"outputs,omitempty"`
+	Type       string                 `json:"type"`
+	Level      string                 `json:"level,omitempty"`
+	Message    string                 `json:"message,omitempty"`
+	Timestamp  string                 `json:"timestamp,omitempty"`
+}
+
+// ResourceEvent describes the progress of a single resource
+type ResourceEvent struct {
+	Address        string  `json:"address"`
+	ResourceType   string  `json:"resource_type,omitempty"`
+	Action         string  `json:"action,omitempty"`
+	Reason         string  `json:"reason,omitempty"`
+	IDKey          string  `json:"id_key,omitempty"`
+	IDValue        string  `json:"id_value,omitempty"`
+	ElapsedSeconds float64 `json:"elapsed_seconds,omitempty"`
+}
+
+// Diagnostic is an error or warning reported by tofu
+type Diagnostic struct {
+	Range    *DiagnosticRange `json:"range,omitempty"`
+	Severity string           `json:"severity"`
+	Summary  string           `json:"summary"`
+	Detail   string           `json:"detail,omitempty"`
+	Address  string           `json:"address,omitempty"`
+}
+
+// DiagnosticRange is the source location of a diagnostic
+type DiagnosticRange struct {
+	Filename string        `json:"filename"`
+	Start    DiagnosticPos `json:"start"`
+	End      DiagnosticPos `json:"end"`
+}
+
+// DiagnosticPos is a position in a source file
+type DiagnosticPos struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Byte   int `json:"byte"`
+}
+
+// ChangeSummary counts the changes of a plan or apply
+type ChangeSummary struct {
+	Operation string `json:"operation"`
+	Add       int    `json:"add"`
+	Change    int    `json:"change"`
+	Import    int    `json:"import"`
+	Remove    int    `json:"remove"`
+}
+
+// OutputValue is a root module output
+type OutputValue struct {
+	Value     json.RawMessage `json:"value,omitempty"`
+	Type      json.RawMessage `json:"type,omitempty"`
+	Action    string          `json:"action,omitempty"`
+	Sensitive bool            `json:"sensitive"`
+}
+
+// ValidationResult is the result of `tofu validate -json`
+type ValidationResult struct {
+	Diagnostics  []Diagnostic `json:"diagnostics,omitempty"`
+	ErrorCount   int          `json:"error_count"`
+	WarningCount int          `json:"warning_count"`
+	Valid        bool         `json:"valid"`
+}
+
+// uiMessage is a single line of the tofu machine readable UI
+type uiMessage struct {
+	Hook       *uiHook                `json:"hook"`
+	Change     *uiHook                `json:"change"`
+	Diagnostic *Diagnostic            `json:"diagnostic"`
+	Changes    *ChangeSummary         `json:"changes"`
+	Outputs    map[string]OutputValue `json:"outputs"`
+	Level      string                 `json:"@level"`
+	Message    string                 `json:"@message"`
+	Timestamp  string                 `json:"@timestamp"`
+	Type       string                 `json:"type"`
+}
+
+// uiHook is the resource part of hook and change messages
+type uiHook struct {
+	Resource struct {
+		Addr         string `json:"addr"`
+		ResourceType string `json:"resource_type"`
+	} `json:"resource"`
+	Action         string  `json:"action"`
+	Reason         string  `json:"reason"`
+	IDKey          string  `json:"id_key"`
+	IDValue        string  `json:"id_value"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// jsonEventsEnabled reports whether the run output should be parsed into events:
+// the json_events meta option must be set and tofu must be invoked with -json.
+func jsonEventsEnabled(req *tgengine.RunRequest) (bool, error) {
+	enabled, err := metaBool(req.GetMeta(), metaJSONEvents)
+	if err != nil || !enabled {
+		return false, err
+	}
+
+	_, flags := splitCommandArgs(req.GetArgs())
+
+	return slices.Contains(flags, jsonFlag), nil
+}
+
+// parseUILine parses a line of the tofu machine readable UI into an event
+func parseUILine(line string) (*Event, bool) {
+	var msg uiMessage
+	if err := json.Unmarshal([]byte(line), &msg); err != nil || msg.Type == "" || msg.Message == "" {
+		return nil, false
+	}
+
+	event := &Event{
+		Type:       msg.Type,
+		Level:      msg.Level,
+		Message:    msg.Message,
+		Timestamp:  msg.Timestamp,
+		Diagnostic: msg.Diagnostic,
+		Changes:    msg.Changes,
+		Outputs:    msg.Outputs,
+	}
+
+	hook := msg.Hook
+	if hook == nil {
+		hook = msg.Change
+	}
+
+	if hook != nil && hook.Resource.Addr != "" {
+		event.Resource = &ResourceEvent{
+			Address:        hook.Resource.Addr,
+			ResourceType:   hook.Resource.ResourceType,
+			Action:         hook.Action,
+			Reason:         hook.Reason,
+			IDKey:          hook.IDKey,
+			IDValue:        hook.IDValue,
+			ElapsedSeconds: hook.ElapsedSeconds,
+		}
+	}
+
+	return event, true
+}
+
+// parseValidateOutput parses the output of `tofu validate -json` into events
+func parseValidateOutput(data []byte) ([]*Event, bool) {
+	var result ValidationResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, false
+	}
+
+	events := make([]*Event, 0, len(result.Diagnostics)+1)
+
+	for i := range result.Diagnostics {
+		diagnostic := result.Diagnostics[i]
+		events = append(events, &Event{
+			Type:       EventTypeDiagnostic,
+			Level:      diagnostic.Severity,
+			Message:    diagnosticTitle(&diagnostic),
+			Diagnostic: &diagnostic,
+		})
+	}
+
+	message := "Success! The configuration is valid."
+	if !result.Valid {
+		message = fmt.Sprintf("The configuration is invalid: %d error(s), %d warning(s).", result.ErrorCount, result.WarningCount)
+	}
+
+	result.Diagnostics = nil
+	events = append(events, &Event{Type: EventTypeValidation, Message: message, Validation: &result})
+
+	return events, true
+}
+
+// renderEvent renders an event as human readable text
+func renderEvent(event *Event) string {
+	var builder strings.Builder
+
+	builder.WriteString(event.Message)
+	builder.WriteString("\n")
+
+	if diagnostic := event.Diagnostic; diagnostic != nil {
+		if diagnostic.Range != nil {
+			fmt.Fprintf(&builder, "\n  on %s line %d", diagnostic.Range.Filename, diagnostic.Range.Start.Line)
+
+			if diagnostic.Address != "" {
+				fmt.Fprintf(&builder, ", in %s", diagnostic.Address)
+			}
+
+			builder.WriteString(":\n")
+		}
+
+		if diagnostic.Detail != "" {
+			fmt.Fprintf(&builder, "\n%s\n", diagnostic.Detail)
+		}
+
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// diagnosticTitle returns the human readable title of a diagnostic, e.g. "Error: Missing required argument"
+func diagnosticTitle(diagnostic *Diagnostic) string {
+	severity := diagnostic.Severity
+	if severity != "" {
+		severity = strings.ToUpper(severity[:1]) + severity[1:]
+	}
+
+	return fmt.Sprintf("%s: %s", severity, diagnostic.Summary)
+}
+
+// encodeEventRecord encodes an event as a JSON text sequence record
+func encodeEventRecord(event *Event) (string, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	return EventRecordSeparator + string(data) + "\n", nil
+}
+
+// ParseEventRecord decodes an event record sent on stdout by a run with json_events enabled.
+// It returns false for regular output.
+func ParseEventRecord(stdout string) (*Event, bool) {
+	data, found := strings.CutPrefix(stdout, EventRecordSeparator)
+	if !found {
+		return nil, false
+	}
+
+	var event Event
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return nil, false
+	}
+
+	return &event, true
+}
+
+// streamEvents reads the machine readable UI from pipe and sends every parsed event both rendered as text and
+// as an event record. Lines which aren't UI messages are forwarded unchanged.
+func streamEvents(logger *log.Entry, pipe io.Reader, validate bool, send func(string) error) {
+	reader := bufio.NewReader(transform.NewReader(pipe, unicode.UTF8.NewDecoder()))
+
+	if validate {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			logger.Errorf("Error reading stdout: %v", err)
+		}
+
+		events, ok := parseValidateOutput(data)
+		if !ok {
+			if err := send(string(data)); err != nil {
+				logger.Errorf("Error sending stdout: %v", err)
+			}
+
+			return
+		}
+
+		for _, event := range events {
+			if err := sendEvent(event, send); err != nil {
+				logger.Errorf("Error sending event: %v", err)
+				return
+			}
+		}
+
+		return
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if event, ok := parseUILine(strings.TrimSpace(line)); ok {
+				if sendErr := sendEvent(event, send); sendErr != nil {
+					logger.Errorf("Error sending event: %v", sendErr)
+					return
+				}
+			} else if sendErr := send(line); sendErr != nil {
+				logger.Errorf("Error sending stdout: %v", sendErr)
+				return
+			}
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Errorf("Error reading stdout: %v", err)
+			}
+
+			return
+		}
+	}
+}
+
+// sendEvent sends the rendered text of an event followed by its record
+func sendEvent(event *Event, send func(string) error) error {
+	record, err := encodeEventRecord(event)
+	if err != nil {
+		return err
+	}
+
+	if err := send(renderEvent(event)); err != nil {
+		return err
+	}
+
+	return send(record)
+}
@@ -0,0 +1,108 @@
+package engine_test
+
+import (
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const planJSONOutput = `{"@level":"info","@message":"OpenTofu 1.10.2","@module":"tofu.ui","@timestamp":"2025-01-01T00:00:00Z","terraform":"1.10.2","type":"version","ui":"1.2"}
+{"@level":"info","@message":"null_resource.example: Plan to create","@module":"tofu.ui","@timestamp":"2025-01-01T00:00:01Z","change":{"resource":{"addr":"null_resource.example","module":"","resource":"null_resource.example","implied_provider":"null","resource_type":"null_resource","resource_name":"example","resource_key":null},"action":"create"},"type":"planned_change"}
+{"@level":"error","@message":"Error: Unsupported argument","@module":"tofu.ui","@timestamp":"2025-01-01T00:00:02Z","diagnostic":{"severity":"error","summary":"Unsupported argument","detail":"An argument named \"foo\" is not expected here.","address":"null_resource.example","range":{"filename":"main.tf","start":{"line":3,"column":3,"byte":40},"end":{"line":3,"column":6,"byte":43}}},"type":"diagnostic"}
+{"@level":"info","@message":"Plan: 1 to add, 0 to change, 0 to destroy.","@module":"tofu.ui","@timestamp":"2025-01-01T00:00:03Z","changes":{"add":1,"change":0,"import":0,"remove":0,"operation":"plan"},"type":"change_summary"}
+not a json line
+`
+
+// runEvents returns the events and the remaining text sent on stdout
+func runEvents(t *testing.T, script string, args []string) ([]*engine.Event, string) {
+	t.Helper()
+
+	tofuEngine := &engine.TofuEngine{}
+	tofuEngine.SetBinaryPath(fakeTofu(t, script))
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{Args: args, Meta: stringMeta("json_events", "true")}, mockStream))
+
+	var (
+		events []*engine.Event
+		text   string
+	)
+
+	for _, response := range mockStream.Responses {
+		if event, ok := engine.ParseEventRecord(response.GetStdout()); ok {
+			events = append(events, event)
+			continue
+		}
+
+		text += response.GetStdout()
+	}
+
+	return events, text
+}
+
+func TestTofuEngine_RunJSONEvents(t *testing.T) {
+	t.Parallel()
+
+	events, text := runEvents(t, "cat <<'EOF'\n"+planJSONOutput+"EOF\n", []string{"plan", "-json"})
+	require.Len(t, events, 4)
+
+	assert.Equal(t, "version", events[0].Type)
+
+	assert.Equal(t, "planned_change", events[1].Type)
+	require.NotNil(t, events[1].Resource)
+	assert.Equal(t, "null_resource.example", events[1].Resource.Address)
+	assert.Equal(t, "create", events[1].Resource.Action)
+
+	assert.Equal(t, engine.EventTypeDiagnostic, events[2].Type)
+	require.NotNil(t, events[2].Diagnostic)
+	assert.Equal(t, "error", events[2].Diagnostic.Severity)
+	assert.Equal(t, "main.tf", events[2].Diagnostic.Range.Filename)
+	assert.Equal(t, 3, events[2].Diagnostic.Range.Start.Line)
+
+	assert.Equal(t, engine.EventTypeChangeSummary, events[3].Type)
+	require.NotNil(t, events[3].Changes)
+	assert.Equal(t, 1, events[3].Changes.Add)
+
+	assert.Contains(t, text, "null_resource.example: Plan to create\n")
+	assert.Contains(t, text, "Error: Unsupported argument\n\n  on main.tf line 3, in null_resource.example:\n")
+	assert.Contains(t, text, "Plan: 1 to add, 0 to change, 0 to destroy.\n")
+	assert.Contains(t, text, "not a json line\n")
+	assert.NotContains(t, text, `"@level"`)
+}
+
+func TestTofuEngine_RunJSONEventsValidate(t *testing.T) {
+	t.Parallel()
+
+	script := `cat <<'EOF'
+{
+  "format_version": "1.0",
+  "valid": false,
+  "error_count": 1,
+  "warning_count": 0,
+  "diagnostics": [
+    {"severity": "error", "summary": "Missing required argument", "range": {"filename": "main.tf", "start": {"line": 1, "column": 1, "byte": 0}, "end": {"line": 1, "column": 2, "byte": 1}}}
+  ]
+}
+EOF
+`
+	events, text := runEvents(t, script, []string{"validate", "-json"})
+	require.Len(t, events, 2)
+	assert.Equal(t, engine.EventTypeDiagnostic, events[0].Type)
+	assert.Equal(t, "Missing required argument", events[0].Diagnostic.Summary)
+	assert.Equal(t, engine.EventTypeValidation, events[1].Type)
+	assert.False(t, events[1].Validation.Valid)
+	assert.Equal(t, 1, events[1].Validation.ErrorCount)
+	assert.Contains(t, text, "Error: Missing required argument")
+	assert.Contains(t, text, "The configuration is invalid: 1 error(s), 0 warning(s).")
+}
+
+func TestTofuEngine_RunJSONEventsWithoutJSONFlag(t *testing.T) {
+	t.Parallel()
+
+	events, text := runEvents(t, "cat <<'EOF'\n"+planJSONOutput+"EOF\n", []string{"plan"})
+	assert.Empty(t, events)
+	assert.Equal(t, planJSONOutput, text)
+}
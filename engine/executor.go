@@ -0,0 +1,243 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/creack/pty"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaExecutor = "executor"
+
+	executorLocal  = "local"
+	executorDocker = "docker"
+	executorSSH    = "ssh"
+)
+
+var (
+	ErrInvalidExecutor = errors.New("invalid executor configuration")
+
+	// hostEnv are variables which describe the engine host, remote executors don't pass them on, as they would
+	// break the environment of the remote process
+	hostEnv = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "PWD", "OLDPWD", "TMPDIR", "HOSTNAME", "SHLVL", "_"}
+)
+
+// Executor spawns the tofu processes of runs. The local executor runs them on the engine host, others run them in
+// a remote environment.
+type Executor interface {
+	// Start spawns a process. Its stdout and stderr must be read until EOF before Wait is called.
+	Start(ctx context.Context, spec *ExecSpec) (Process, error)
+}
+
+// ExecSpec describes a tofu process
+type ExecSpec struct {
+	// Binary is the tofu binary on the engine host
+	Binary string
+	Args   []string
+	// Dir is the working directory of the process
+	Dir string
+	// Env holds KEY=VALUE variables, the local executor passes its own environment when it is empty. Remote
+	// executors leave out the variables of the engine host, see hostEnv.
+	Env []string
+	// Paths are host directories the process uses besides Dir, such as the provider cache
+	Paths []string
+	// TTY attaches the stdin of the engine to a pseudo-terminal, where the executor supports it
+	TTY bool
+	// Capture marks auxiliary commands whose output is all the run uses, remote executors don't sync their working
+	// directory back
+	Capture bool
+
+	// sandbox restricts the process, nil when it isn't sandboxed
+	sandbox *sandboxOptions
+}
+
+// Process is a spawned tofu process
+type Process interface {
+	Stdout() io.Reader
+	Stderr() io.Reader
+	// Wait waits for the process to exit and returns its exit code. An error is returned when the exit code can't
+	// be determined.
+	Wait() (int, error)
+}
+
+// parseExecutor builds the executor selected by Init meta, the local executor by default
+func parseExecutor(meta map[string]*anypb.Any) (Executor, error) {
+	switch name := metaString(meta, metaExecutor); name {
+	case "", executorLocal:
+		return localExecutor{}, nil
+	case executorDocker:
+		return parseDockerExecutor(meta)
+	case executorSSH:
+		return parseSSHExecutor(meta)
+	default:
+		return nil, fmt.Errorf("%w: unknown executor %q, must be %s, %s or %s", ErrInvalidExecutor, name, executorLocal, executorDocker, executorSSH)
+	}
+}
+
+// NewExecutor builds an executor from options holding the executor meta keys of Init, e.g. executor=ssh and
+// ssh_host=bastion. The local executor is returned when the options select none.
+func NewExecutor(options map[string]string) (Executor, error) {
+	meta := make(map[string]*anypb.Any, len(options))
+	for key, value := range options {
+		meta[key] = &anypb.Any{Value: []byte(value)}
+	}
+
+	return parseExecutor(meta)
+}
+
+// localExecutor runs tofu on the engine host
+type localExecutor struct{}
+
+// localProcess is a tofu process on the engine host
+type localProcess struct {
+	cmd    *exec.Cmd
+	stdout io.Reader
+	stderr io.Reader
+	ptmx   *os.File
+}
+
+func (localExecutor) Start(_ context.Context, spec *ExecSpec) (Process, error) {
+	cmd := exec.Command(spec.Binary, spec.Args...)
+	cmd.Dir = spec.Dir
+
+	// a nil Env makes the process inherit the engine environment
+	if len(spec.Env) > 0 {
+		cmd.Env = spec.Env
+	}
+
+	if spec.sandbox != nil {
+		if err := configureSandbox(cmd, spec.sandbox); err != nil {
+			return nil, err
+		}
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	process := &localProcess{cmd: cmd, stdout: stdout, stderr: stderr}
+
+	if spec.TTY {
+		if process.ptmx, err = pty.Start(cmd); err != nil {
+			return nil, fmt.Errorf("error allocating pseudo-TTY: %w", startError(spec, err))
+		}
+
+		go func() {
+			_, _ = io.Copy(process.ptmx, os.Stdin)
+		}()
+		go func() {
+			_, _ = io.Copy(os.Stdout, process.ptmx)
+		}()
+		go func() {
+			_, _ = io.Copy(os.Stderr, process.ptmx)
+		}()
+
+		return process, nil
+	}
+
+	cmd.Stdin = os.Stdin
+
+	if err := cmd.Start(); err != nil {
+		return nil, startError(spec, err)
+	}
+
+	return process, nil
+}
+
+// startError explains why a sandboxed process could not be started
+func startError(spec *ExecSpec, err error) error {
+	if spec.sandbox != nil {
+		return sandboxStartError(err)
+	}
+
+	return err
+}
+
+func (p *localProcess) Stdout() io.Reader {
+	return p.stdout
+}
+
+func (p *localProcess) Stderr() io.Reader {
+	return p.stderr
+}
+
+func (p *localProcess) Wait() (int, error) {
+	if p.ptmx != nil {
+		defer func() { _ = p.ptmx.Close() }()
+	}
+
+	err := p.cmd.Wait()
+	if err == nil {
+		return 0, nil
+	}
+
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		return exitError.ExitCode(), nil
+	}
+
+	return 0, err
+}
+
+// runProcess starts a process and returns its exit code and output once it exits
+func runProcess(ctx context.Context, executor Executor, spec *ExecSpec) (int, []byte, []byte, error) {
+	process, err := executor.Start(ctx, spec)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	var (
+		wg             sync.WaitGroup
+		stdout, stderr bytes.Buffer
+	)
+
+	wg.Add(wgSize)
+
+	go func() {
+		defer wg.Done()
+
+		_, _ = io.Copy(&stdout, process.Stdout())
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		_, _ = io.Copy(&stderr, process.Stderr())
+	}()
+
+	wg.Wait()
+
+	exitCode, err := process.Wait()
+
+	return exitCode, stdout.Bytes(), stderr.Bytes(), err
+}
+
+// remoteEnv returns the variables of env which aren't specific to the engine host
+func remoteEnv(env []string) []string {
+	remote := make([]string, 0, len(env))
+
+	for _, variable := range env {
+		key, _, _ := strings.Cut(variable, "=")
+		if !slices.Contains(hostEnv, key) {
+			remote = append(remote, variable)
+		}
+	}
+
+	return remote
+}
@@ -0,0 +1,514 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaDockerHost   = "docker_host"
+	metaDockerImage  = "docker_image"
+	metaDockerBinary = "docker_binary"
+	metaDockerMounts = "docker_mounts"
+	metaDockerUser   = "docker_user"
+
+	dockerHostEnv     = "DOCKER_HOST"
+	defaultDockerHost = "unix:///var/run/docker.sock"
+	dockerAPIVersion  = "v1.41"
+
+	// dockerFrameHeaderSize is the size of the header of a frame of a multiplexed attach stream
+	dockerFrameHeaderSize = 8
+	dockerStreamStdout    = 1
+	dockerStreamStderr    = 2
+
+	dockerRemoveTimeout = 30 * time.Second
+
+	// dockerSandboxTmpfs are the options of the /tmp tmpfs of sandboxed containers
+	dockerSandboxTmpfs = "rw,nosuid,nodev"
+)
+
+var ErrDockerAPI = errors.New("docker API error")
+
+// dockerExecutor runs tofu in a container through a Docker compatible API. The working directory and the other
+// paths of a run are mounted at the same paths, so that arguments and environment variables keep referring to them.
+type dockerExecutor struct {
+	client *http.Client
+	host   string
+	image  string
+
+	// binary is the tofu binary in the image, empty when the binary of the engine is mounted into the container
+	binary string
+
+	// mounts are additional host paths mounted into every container
+	mounts []string
+
+	// user runs tofu in the container, the user of the engine by default so that it owns the files tofu writes
+	user string
+}
+
+// parseDockerExecutor builds the Docker executor from Init meta
+func parseDockerExecutor(meta map[string]*anypb.Any) (*dockerExecutor, error) {
+	executor := &dockerExecutor{
+		image:  metaString(meta, metaDockerImage),
+		binary: metaString(meta, metaDockerBinary),
+		user:   metaString(meta, metaDockerUser),
+	}
+
+	if executor.image == "" {
+		return nil, fmt.Errorf("%w: %s is required with the %s executor", ErrInvalidExecutor, metaDockerImage, executorDocker)
+	}
+
+	host := metaString(meta, metaDockerHost)
+	if host == "" {
+		host = os.Getenv(dockerHostEnv)
+	}
+
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	var err error
+
+	if executor.client, executor.host, err = dockerClient(host); err != nil {
+		return nil, err
+	}
+
+	for _, mount := range metaStrings(meta, metaDockerMounts) {
+		if !filepath.IsAbs(mount) {
+			return nil, fmt.Errorf("%w: %s must hold absolute paths, got %q", ErrInvalidExecutor, metaDockerMounts, mount)
+		}
+
+		executor.mounts = append(executor.mounts, filepath.Clean(mount))
+	}
+
+	if executor.user == "" && os.Getuid() >= 0 {
+		executor.user = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	}
+
+	return executor, nil
+}
+
+// dockerClient returns an HTTP client which connects to a unix:// or tcp:// Docker host, and the base URL of its API
+func dockerClient(host string) (*http.Client, string, error) {
+	parsed, err := url.Parse(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: invalid %s %q: %w", ErrInvalidExecutor, metaDockerHost, host, err)
+	}
+
+	var network, address string
+
+	switch parsed.Scheme {
+	case "unix":
+		network, address = "unix", parsed.Path
+	case "tcp":
+		network, address = "tcp", parsed.Host
+	default:
+		return nil, "", fmt.Errorf("%w: %s %q must be unix:///PATH or tcp://HOST:PORT", ErrInvalidExecutor, metaDockerHost, host)
+	}
+
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+
+	return &http.Client{Transport: transport}, "http://docker/" + dockerAPIVersion, nil
+}
+
+// dockerContainerConfig is the body of a container create request
+type dockerContainerConfig struct {
+	Image        string
+	Cmd          []string
+	Env          []string
+	WorkingDir   string
+	User         string `json:",omitempty"`
+	AttachStdout bool
+	AttachStderr bool
+	HostConfig   dockerHostConfig
+}
+
+type dockerHostConfig struct {
+	NetworkMode    string            `json:",omitempty"`
+	ReadonlyRootfs bool              `json:",omitempty"`
+	Tmpfs          map[string]string `json:",omitempty"`
+	Binds          []string
+}
+
+func (e *dockerExecutor) Start(ctx context.Context, spec *ExecSpec) (Process, error) {
+	config := &dockerContainerConfig{
+		Image:        e.image,
+		Cmd:          append([]string{spec.Binary}, spec.Args...),
+		Env:          remoteEnv(spec.Env),
+		WorkingDir:   spec.Dir,
+		User:         e.user,
+		AttachStdout: true,
+		AttachStderr: true,
+		HostConfig:   dockerHostConfig{Binds: e.binds(spec)},
+	}
+
+	if e.binary != "" {
+		config.Cmd[0] = e.binary
+	}
+
+	// like the namespace sandbox, the container may only write to the writable paths of the sandbox and to a
+	// private /tmp
+	if spec.sandbox != nil {
+		config.HostConfig.ReadonlyRootfs = true
+		config.HostConfig.Tmpfs = map[string]string{"/tmp": dockerSandboxTmpfs}
+
+		if spec.sandbox.IsolateNetwork {
+			config.HostConfig.NetworkMode = "none"
+		}
+	}
+
+	if spec.TTY {
+		log.Warnf("The %s executor doesn't allocate a pseudo-TTY, tofu runs without one", executorDocker)
+	}
+
+	id, err := e.create(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	process, err := e.attach(ctx, id)
+	if err != nil {
+		e.remove(id)
+
+		return nil, err
+	}
+
+	if err := e.call(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil); err != nil {
+		process.close()
+		e.remove(id)
+
+		return nil, err
+	}
+
+	return process, nil
+}
+
+// binds returns the mounts of a container: the working directory and the other paths of the run, read-only paths
+// of the sandbox, and the tofu binary of the engine when the image doesn't provide one
+func (e *dockerExecutor) binds(spec *ExecSpec) []string {
+	var binds []string
+
+	added := map[string]bool{}
+	add := func(path, mode string) {
+		if path != "" && !added[path] {
+			added[path] = true
+			binds = append(binds, path+":"+path+mode)
+		}
+	}
+
+	if spec.sandbox != nil {
+		// the sandbox lists the working directory and the provider cache among its writable paths
+		for _, path := range spec.sandbox.WritablePaths {
+			add(path, "")
+		}
+
+		for _, path := range spec.sandbox.ReadOnlyPaths {
+			add(path, ":ro")
+		}
+	} else {
+		add(spec.Dir, "")
+
+		for _, path := range spec.Paths {
+			add(path, "")
+		}
+	}
+
+	// the extra mounts are read-only in the sandbox, it only allows writes to its writable paths
+	mountMode := ""
+	if spec.sandbox != nil {
+		mountMode = ":ro"
+	}
+
+	for _, path := range e.mounts {
+		add(path, mountMode)
+	}
+
+	if e.binary == "" {
+		add(spec.Binary, ":ro")
+	}
+
+	return binds
+}
+
+// create creates the container of a process, pulling its image when it is missing, and returns its ID
+func (e *dockerExecutor) create(ctx context.Context, config *dockerContainerConfig) (string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+
+	err := e.call(ctx, http.MethodPost, "/containers/create", config, &created)
+
+	var apiErr *dockerAPIError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+		log.Infof("Pulling image %s", e.image)
+
+		if err := e.pull(ctx); err != nil {
+			return "", err
+		}
+
+		err = e.call(ctx, http.MethodPost, "/containers/create", config, &created)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return created.ID, nil
+}
+
+// pull pulls the image of the executor
+func (e *dockerExecutor) pull(ctx context.Context) error {
+	image, tag := e.image, "latest"
+
+	// a colon after the last slash separates the tag, one before it belongs to the registry port
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, tag = image[:i], image[i+1:]
+	}
+
+	response, err := e.request(ctx, http.MethodPost, "/images/create?"+url.Values{"fromImage": {image}, "tag": {tag}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// the progress of the pull is streamed as JSON messages, the pull is done when the stream ends
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var message struct {
+			Error string `json:"error"`
+		}
+
+		if json.Unmarshal(scanner.Bytes(), &message) == nil && message.Error != "" {
+			return fmt.Errorf("%w: failed to pull %s: %s", ErrDockerAPI, e.image, message.Error)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// attach attaches to the output of a container before it is started, so that none of it is missed
+func (e *dockerExecutor) attach(ctx context.Context, id string) (*dockerProcess, error) {
+	response, err := e.request(ctx, http.MethodPost, "/containers/"+id+"/attach?stream=1&stdout=1&stderr=1", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+
+	process := &dockerProcess{
+		executor: e,
+		id:       id,
+		body:     response.Body,
+		stdout:   stdoutReader,
+		stderr:   stderrReader,
+		done:     make(chan struct{}),
+	}
+
+	go process.demultiplex(stdoutWriter, stderrWriter)
+
+	return process, nil
+}
+
+// remove removes a container with its anonymous volumes
+func (e *dockerExecutor) remove(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRemoveTimeout)
+	defer cancel()
+
+	if err := e.call(ctx, http.MethodDelete, "/containers/"+id+"?force=1&v=1", nil, nil); err != nil {
+		log.Warnf("Failed to remove container %s: %v", id, err)
+	}
+}
+
+// dockerAPIError is an error response of the Docker API
+type dockerAPIError struct {
+	status  int
+	message string
+}
+
+func (e *dockerAPIError) Error() string {
+	return fmt.Sprintf("%s: %d %s", ErrDockerAPI, e.status, e.message)
+}
+
+func (e *dockerAPIError) Unwrap() error {
+	return ErrDockerAPI
+}
+
+// request sends a request with an optional JSON body to the Docker API. Error statuses are returned as a
+// dockerAPIError.
+func (e *dockerExecutor) request(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, e.host+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDockerAPI, err)
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		defer response.Body.Close()
+
+		var message struct {
+			Message string `json:"message"`
+		}
+
+		content, _ := io.ReadAll(response.Body)
+		if json.Unmarshal(content, &message) != nil || message.Message == "" {
+			message.Message = strings.TrimSpace(string(content))
+		}
+
+		return nil, &dockerAPIError{status: response.StatusCode, message: message.Message}
+	}
+
+	return response, nil
+}
+
+// call sends a request to the Docker API and decodes its JSON response into result, unless it is nil
+func (e *dockerExecutor) call(ctx context.Context, method, path string, body, result any) error {
+	response, err := e.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if result == nil {
+		_, _ = io.Copy(io.Discard, response.Body)
+
+		return nil
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("%w: invalid response to %s %s: %w", ErrDockerAPI, method, path, err)
+	}
+
+	return nil
+}
+
+// dockerProcess is tofu running in a container
+type dockerProcess struct {
+	executor *dockerExecutor
+	body     io.ReadCloser
+	stdout   io.Reader
+	stderr   io.Reader
+	done     chan struct{}
+	id       string
+	once     sync.Once
+}
+
+func (p *dockerProcess) Stdout() io.Reader {
+	return p.stdout
+}
+
+func (p *dockerProcess) Stderr() io.Reader {
+	return p.stderr
+}
+
+// demultiplex splits the attach stream into stdout and stderr. Each frame starts with a header of the stream type
+// and the big endian size of its payload.
+func (p *dockerProcess) demultiplex(stdout, stderr *io.PipeWriter) {
+	defer close(p.done)
+
+	var err error
+
+	defer func() {
+		stdout.CloseWithError(err)
+		stderr.CloseWithError(err)
+	}()
+
+	header := make([]byte, dockerFrameHeaderSize)
+
+	for {
+		if _, err = io.ReadFull(p.body, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+
+			return
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+
+		switch header[0] {
+		case dockerStreamStdout:
+			_, err = io.CopyN(stdout, p.body, size)
+		case dockerStreamStderr:
+			_, err = io.CopyN(stderr, p.body, size)
+		default:
+			_, err = io.CopyN(io.Discard, p.body, size)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close stops reading the output of the container
+func (p *dockerProcess) close() {
+	p.once.Do(func() { _ = p.body.Close() })
+	<-p.done
+}
+
+func (p *dockerProcess) Wait() (int, error) {
+	defer p.executor.remove(p.id)
+
+	var result struct {
+		StatusCode int
+		Error      *struct {
+			Message string
+		}
+	}
+
+	err := p.executor.call(context.Background(), http.MethodPost, "/containers/"+p.id+"/wait", nil, &result)
+
+	p.close()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if result.Error != nil && result.Error.Message != "" {
+		return 0, fmt.Errorf("%w: container %s: %s", ErrDockerAPI, p.id, result.Error.Message)
+	}
+
+	return result.StatusCode, nil
+}
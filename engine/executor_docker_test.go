@@ -0,0 +1,290 @@
+package engine_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDocker serves the parts of the Docker API the Docker executor uses on a unix socket. Its containers write
+// stdout and stderr and exit with exitCode once they are started.
+type fakeDocker struct {
+	images   map[string]bool
+	created  []dockerCreateRequest
+	pulled   []string
+	removed  []string
+	started  map[string]chan struct{}
+	stdout   string
+	stderr   string
+	exitCode int
+	mu       sync.Mutex
+}
+
+type dockerCreateRequest struct {
+	Image      string
+	Cmd        []string
+	Env        []string
+	WorkingDir string
+	User       string
+	HostConfig struct {
+		NetworkMode    string
+		ReadonlyRootfs bool
+		Tmpfs          map[string]string
+		Binds          []string
+	}
+}
+
+// startFakeDocker serves a fake Docker API and returns its unix:// host
+func startFakeDocker(t *testing.T, docker *fakeDocker) string {
+	t.Helper()
+
+	// unix socket paths are limited to about 100 bytes, test temp dirs may be longer
+	dir, err := os.MkdirTemp("", "docker")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "docker.sock")
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	docker.started = map[string]chan struct{}{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1.41/containers/create", docker.create)
+	mux.HandleFunc("POST /v1.41/images/create", docker.pull)
+	mux.HandleFunc("POST /v1.41/containers/{id}/attach", docker.attach)
+	mux.HandleFunc("POST /v1.41/containers/{id}/start", docker.start)
+	mux.HandleFunc("POST /v1.41/containers/{id}/wait", docker.wait)
+	mux.HandleFunc("DELETE /v1.41/containers/{id}", docker.remove)
+
+	server := &http.Server{Handler: mux}
+
+	go func() { _ = server.Serve(listener) }()
+
+	t.Cleanup(func() { server.Close() })
+
+	return "unix://" + socket
+}
+
+func (d *fakeDocker) create(w http.ResponseWriter, r *http.Request) {
+	var req dockerCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.images[req.Image] {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"message":"No such image: ` + req.Image + `"}`))
+
+		return
+	}
+
+	id := fmt.Sprintf("container%d", len(d.created))
+	d.created = append(d.created, req)
+	d.started[id] = make(chan struct{})
+
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(`{"Id":"` + id + `"}`))
+}
+
+func (d *fakeDocker) pull(w http.ResponseWriter, r *http.Request) {
+	image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+
+	d.mu.Lock()
+	d.images[image] = true
+	d.pulled = append(d.pulled, image)
+	d.mu.Unlock()
+
+	_, _ = w.Write([]byte(`{"status":"Pulling from library"}` + "\n" + `{"status":"Downloaded newer image"}` + "\n"))
+}
+
+func (d *fakeDocker) attach(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	started := d.started[r.PathValue("id")]
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	<-started
+
+	for _, frame := range []struct {
+		stream byte
+		data   string
+	}{{1, d.stdout}, {2, d.stderr}} {
+		header := make([]byte, 8)
+		header[0] = frame.stream
+		binary.BigEndian.PutUint32(header[4:], uint32(len(frame.data)))
+
+		_, _ = w.Write(append(header, frame.data...))
+	}
+}
+
+func (d *fakeDocker) start(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	close(d.started[r.PathValue("id")])
+	d.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *fakeDocker) wait(w http.ResponseWriter, _ *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]int{"StatusCode": d.exitCode})
+}
+
+func (d *fakeDocker) remove(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	d.removed = append(d.removed, r.PathValue("id"))
+	d.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestTofuEngine_DockerExecutor(t *testing.T) {
+	t.Parallel()
+
+	docker := &fakeDocker{images: map[string]bool{}, stdout: "planned in container\n", stderr: "warning\n", exitCode: 2}
+	host := startFakeDocker(t, docker)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta("executor", "docker", "docker_host", host, "docker_image", "example/tofu:1.9"),
+	}, &MockInitServer{}))
+
+	binaryPath := fakeTofu(t, `echo "ran on the host"; exit 1`)
+	tofuEngine.SetBinaryPath(binaryPath)
+
+	workingDir := t.TempDir()
+	stream := &MockRunServer{}
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: workingDir,
+		Args:       []string{"plan", "-input=false"},
+		EnvVars:    map[string]string{"TF_VAR_region": "eu-west-1", "PATH": "/opt/homebrew/bin", "HOME": "/Users/dev"},
+	}, stream))
+
+	assert.Equal(t, "planned in container\n", stdout(stream.Responses))
+	assert.Equal(t, "warning\n", stderr(stream.Responses))
+	assert.Equal(t, int32(2), stream.Responses[len(stream.Responses)-1].GetResultCode())
+
+	docker.mu.Lock()
+	defer docker.mu.Unlock()
+
+	// the image was missing and pulled before the container was created
+	assert.Equal(t, []string{"example/tofu:1.9"}, docker.pulled)
+	require.Len(t, docker.created, 1)
+
+	created := docker.created[0]
+	assert.Equal(t, "example/tofu:1.9", created.Image)
+	assert.Equal(t, []string{binaryPath, "plan", "-input=false"}, created.Cmd)
+	// variables of the engine host aren't passed into the container
+	assert.Equal(t, []string{"TF_VAR_region=eu-west-1"}, created.Env)
+	assert.Equal(t, workingDir, created.WorkingDir)
+	assert.NotEmpty(t, created.User)
+	assert.Contains(t, created.HostConfig.Binds, workingDir+":"+workingDir)
+	assert.Contains(t, created.HostConfig.Binds, binaryPath+":"+binaryPath+":ro")
+
+	assert.Equal(t, []string{"container0"}, docker.removed)
+}
+
+func TestTofuEngine_DockerExecutorBinary(t *testing.T) {
+	t.Parallel()
+
+	docker := &fakeDocker{images: map[string]bool{"example/tofu:1.9": true}, stdout: "state\n"}
+	host := startFakeDocker(t, docker)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta(
+			"executor", "docker",
+			"docker_host", host,
+			"docker_image", "example/tofu:1.9",
+			"docker_binary", "/usr/local/bin/tofu",
+			"docker_mounts", "/etc/ssl/certs",
+			"docker_user", "1000:1000",
+		),
+	}, &MockInitServer{}))
+
+	binaryPath := fakeTofu(t, `exit 1`)
+	tofuEngine.SetBinaryPath(binaryPath)
+
+	workingDir := t.TempDir()
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"state", "list"}}, &MockRunServer{}))
+
+	docker.mu.Lock()
+	defer docker.mu.Unlock()
+
+	assert.Empty(t, docker.pulled)
+	require.Len(t, docker.created, 1)
+	assert.Equal(t, []string{"/usr/local/bin/tofu", "state", "list"}, docker.created[0].Cmd)
+	assert.Equal(t, "1000:1000", docker.created[0].User)
+	assert.Equal(t, []string{workingDir + ":" + workingDir, "/etc/ssl/certs:/etc/ssl/certs"}, docker.created[0].HostConfig.Binds)
+}
+
+func TestTofuEngine_DockerExecutorSandbox(t *testing.T) {
+	t.Parallel()
+
+	docker := &fakeDocker{images: map[string]bool{"example/tofu:1.9": true}}
+	host := startFakeDocker(t, docker)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta("executor", "docker", "docker_host", host, "docker_image", "example/tofu:1.9", "docker_mounts", "/etc/ssl/certs"),
+	}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `exit 1`))
+
+	workingDir := t.TempDir()
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: workingDir,
+		Args:       []string{"plan"},
+		Meta:       stringMeta("sandbox", "true", "sandbox_isolate_network", "true"),
+	}, &MockRunServer{}))
+
+	docker.mu.Lock()
+	defer docker.mu.Unlock()
+
+	require.Len(t, docker.created, 1)
+
+	// the container may only write to the working directory and its own /tmp
+	hostConfig := docker.created[0].HostConfig
+	assert.True(t, hostConfig.ReadonlyRootfs)
+	assert.Contains(t, hostConfig.Tmpfs, "/tmp")
+	assert.Equal(t, "none", hostConfig.NetworkMode)
+	assert.Contains(t, hostConfig.Binds, workingDir+":"+workingDir)
+	assert.Contains(t, hostConfig.Binds, "/etc/ssl/certs:/etc/ssl/certs:ro")
+}
+
+func TestTofuEngine_InvalidExecutor(t *testing.T) {
+	t.Parallel()
+
+	for name, meta := range map[string][]string{
+		"unknown executor":     {"executor", "kubernetes"},
+		"missing image":        {"executor", "docker"},
+		"invalid host":         {"executor", "docker", "docker_image", "tofu", "docker_host", "ssh://example.com"},
+		"relative mount":       {"executor", "docker", "docker_image", "tofu", "docker_mounts", "certs"},
+		"missing ssh host":     {"executor", "ssh"},
+		"relative remote root": {"executor", "ssh", "ssh_host", "bastion", "ssh_remote_root", "work"},
+	} {
+		err := (&engine.TofuEngine{}).Init(&tgengine.InitRequest{Meta: stringMeta(meta...)}, &MockInitServer{})
+		require.ErrorIs(t, err, engine.ErrInvalidExecutor, name)
+	}
+}
@@ -0,0 +1,678 @@
+package engine
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaSSHHost         = "ssh_host"
+	metaSSHUser         = "ssh_user"
+	metaSSHIdentityFile = "ssh_identity_file"
+	metaSSHKnownHosts   = "ssh_known_hosts"
+	metaSSHBinary       = "ssh_binary"
+	metaSSHRemoteRoot   = "ssh_remote_root"
+
+	sshAuthSockEnv    = "SSH_AUTH_SOCK"
+	defaultSSHPort    = "22"
+	defaultSSHBinary  = "tofu"
+	sshConnectTimeout = 30 * time.Second
+
+	// sshRunRootPattern is the mktemp template of the remote directory of a run
+	sshRunRootPattern = "terragrunt-engine.XXXXXX"
+
+	// sshCacheDirName is the remote directory, in ssh_remote_root or the cache directory of the remote user, which
+	// keeps the provider caches and the installed providers of the units between runs
+	sshCacheDirName = "terragrunt-engine-cache"
+
+	// sshProvidersDir is the directory of the working directory tofu installs the providers into. It isn't synced,
+	// the remote copy links it to a directory in the remote cache, so that it stays valid between runs.
+	sshProvidersDir = ".terraform/providers"
+)
+
+var ErrSSHSync = errors.New("failed to sync the working directory")
+
+// sshExecutor runs tofu on a remote host over SSH. Every run gets its own remote directory, created with mktemp. The
+// working directory is streamed into it as a tar before tofu runs, the changes tofu made to it are streamed back once
+// it exits, and the directory is removed. The remote tofu is the binary of ssh_binary, the engine doesn't install it.
+type sshExecutor struct {
+	config  *ssh.ClientConfig
+	address string
+
+	// identityFile is a private key to authenticate with, the SSH agent is used as well when it is available
+	identityFile string
+
+	// binary is the tofu binary on the remote host
+	binary string
+
+	// remoteRoot is the remote directory the directories of the runs are created in, the temporary directory of the
+	// remote host when it is empty
+	remoteRoot string
+}
+
+// parseSSHExecutor builds the SSH executor from Init meta
+func parseSSHExecutor(meta map[string]*anypb.Any) (*sshExecutor, error) {
+	host := metaString(meta, metaSSHHost)
+	if host == "" {
+		return nil, fmt.Errorf("%w: %s is required with the %s executor", ErrInvalidExecutor, metaSSHHost, executorSSH)
+	}
+
+	username := metaString(meta, metaSSHUser)
+	if name, rest, found := strings.Cut(host, "@"); found {
+		username, host = name, rest
+	}
+
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is not set and the current user is unknown: %w", ErrInvalidExecutor, metaSSHUser, err)
+		}
+
+		username = current.Username
+	}
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, defaultSSHPort)
+	}
+
+	executor := &sshExecutor{
+		address:      host,
+		identityFile: metaString(meta, metaSSHIdentityFile),
+		binary:       metaString(meta, metaSSHBinary),
+		remoteRoot:   metaString(meta, metaSSHRemoteRoot),
+	}
+
+	if executor.binary == "" {
+		executor.binary = defaultSSHBinary
+	}
+
+	if executor.remoteRoot != "" && !path.IsAbs(executor.remoteRoot) {
+		return nil, fmt.Errorf("%w: %s must be an absolute path, got %q", ErrInvalidExecutor, metaSSHRemoteRoot, executor.remoteRoot)
+	}
+
+	if executor.identityFile == "" && os.Getenv(sshAuthSockEnv) == "" {
+		return nil, fmt.Errorf("%w: %s is required when no SSH agent is running", ErrInvalidExecutor, metaSSHIdentityFile)
+	}
+
+	knownHostsFile := metaString(meta, metaSSHKnownHosts)
+	if knownHostsFile == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user home directory: %w", err)
+		}
+
+		knownHostsFile = filepath.Join(homeDir, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read %s: %w", ErrInvalidExecutor, metaSSHKnownHosts, err)
+	}
+
+	executor.config = &ssh.ClientConfig{
+		User:            username,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshConnectTimeout,
+	}
+
+	return executor, nil
+}
+
+// connect opens an SSH connection to the host, authenticating with the agent and the identity file
+func (e *sshExecutor) connect(ctx context.Context) (*ssh.Client, error) {
+	config := *e.config
+
+	if socket := os.Getenv(sshAuthSockEnv); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Warnf("Failed to connect to the SSH agent: %v", err)
+		} else {
+			defer conn.Close()
+
+			config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	if e.identityFile != "" {
+		key, err := os.ReadFile(e.identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH identity file: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH identity file %s, keys with a passphrase must be added to the SSH agent: %w", e.identityFile, err)
+		}
+
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+
+	dialer := &net.Dialer{Timeout: sshConnectTimeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", e.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", e.address, err)
+	}
+
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, e.address, &config)
+	if err != nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("failed to connect to %s: %w", e.address, err)
+	}
+
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
+
+// remotePath returns the path under a remote directory of a path on the engine host
+func remotePath(remoteRoot, local string) string {
+	return path.Join(remoteRoot, filepath.ToSlash(local))
+}
+
+func (e *sshExecutor) Start(ctx context.Context, spec *ExecSpec) (Process, error) {
+	client, err := e.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	process := &sshProcess{executor: e, client: client, localDir: spec.Dir, capture: spec.Capture}
+
+	var cacheRoot string
+
+	if process.runRoot, cacheRoot, err = e.createRunRoot(client); err != nil {
+		process.close()
+
+		return nil, err
+	}
+
+	// arguments, environment variables and symlinks which refer to the synced paths refer to their remote copies.
+	// The caches of the run, such as the provider cache, are kept in the remote cache between runs.
+	process.remoteDir = process.runRoot
+	if spec.Dir != "" {
+		process.remoteDir = remotePath(process.runRoot, spec.Dir)
+		process.pairs = append(process.pairs, spec.Dir, process.remoteDir)
+	}
+
+	for _, local := range spec.Paths {
+		process.pairs = append(process.pairs, local, remotePath(path.Join(cacheRoot, "paths"), local))
+	}
+
+	rewrite := strings.NewReplacer(process.pairs...)
+
+	if spec.Dir != "" {
+		providersDir := path.Join(cacheRoot, "providers", unitFileName(spec.Dir))
+
+		log.Debugf("Syncing %s to %s:%s", spec.Dir, e.address, process.remoteDir)
+
+		if process.uploaded, err = e.upload(client, spec.Dir, process.remoteDir, providersDir, process.pairs); err != nil {
+			process.close()
+
+			return nil, err
+		}
+	}
+
+	if process.session, err = client.NewSession(); err != nil {
+		process.close()
+
+		return nil, err
+	}
+
+	// the script is sent on stdin, so that the values of the environment variables don't show up in the process
+	// list of the remote host
+	script := []string{"cd " + shellQuote(process.remoteDir) + " || exit 1"}
+	for _, variable := range remoteEnv(spec.Env) {
+		script = append(script, "export "+shellQuote(rewrite.Replace(variable)))
+	}
+
+	command := []string{"exec", shellQuote(e.binary)}
+	for _, arg := range spec.Args {
+		command = append(command, shellQuote(rewrite.Replace(arg)))
+	}
+
+	script = append(script, strings.Join(command, " ")+" </dev/null", "")
+
+	stdin, err := process.session.StdinPipe()
+	if err != nil {
+		process.close()
+
+		return nil, err
+	}
+
+	if process.stdout, err = process.session.StdoutPipe(); err != nil {
+		process.close()
+
+		return nil, err
+	}
+
+	if process.stderr, err = process.session.StderrPipe(); err != nil {
+		process.close()
+
+		return nil, err
+	}
+
+	if err := process.session.Start("sh -s"); err != nil {
+		process.close()
+
+		return nil, err
+	}
+
+	_, err = io.WriteString(stdin, strings.Join(script, "\n"))
+	if err := errors.Join(err, stdin.Close()); err != nil {
+		process.close()
+
+		return nil, err
+	}
+
+	return process, nil
+}
+
+// checkVersion fails when the remote tofu isn't the pinned version, the engine doesn't install tofu on the remote
+// host. The latest version isn't resolved, the remote tofu is used as is.
+func (e *sshExecutor) checkVersion(version string) error {
+	if version == "latest" {
+		log.Warnf("Not checking the version of %s on %s, tofu_version is %s", e.binary, e.address, version)
+
+		return nil
+	}
+
+	remote, err := tofuVersion(e, &ExecSpec{Binary: e.binary})
+	if err != nil {
+		return fmt.Errorf("%w: %s on %s: %w", ErrInvalidExecutor, e.binary, e.address, err)
+	}
+
+	if normalizeVersion(remote) != normalizeVersion(version) {
+		return fmt.Errorf("%w: %s on %s is OpenTofu %s, tofu_version requires %s", ErrInvalidExecutor, e.binary, e.address, remote, version)
+	}
+
+	return nil
+}
+
+// createRunRoot creates the remote directory of a run, and the remote cache when it doesn't exist. It returns their
+// absolute paths.
+func (e *sshExecutor) createRunRoot(client *ssh.Client) (string, string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer session.Close()
+
+	cacheRoot := `"${XDG_CACHE_HOME:-$HOME/.cache}/"` + shellQuote(sshCacheDirName)
+	runRoot := `"${TMPDIR:-/tmp}/"` + shellQuote(sshRunRootPattern)
+
+	if e.remoteRoot != "" {
+		cacheRoot = shellQuote(path.Join(e.remoteRoot, sshCacheDirName))
+		runRoot = shellQuote(path.Join(e.remoteRoot, sshRunRootPattern))
+	}
+
+	output, err := session.Output(fmt.Sprintf("mkdir -p %s && cd %s && pwd -P && mktemp -d %s", cacheRoot, cacheRoot, runRoot))
+	if err != nil {
+		return "", "", fmt.Errorf("%w: failed to create the run directory on %s: %w", ErrSSHSync, e.address, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 2 || !path.IsAbs(lines[0]) || !path.IsAbs(lines[1]) {
+		return "", "", fmt.Errorf("%w: unexpected output of mktemp on %s: %q", ErrSSHSync, e.address, output)
+	}
+
+	return lines[1], lines[0], nil
+}
+
+// removeRunRoot removes the remote directory of a run
+func (e *sshExecutor) removeRunRoot(client *ssh.Client, runRoot string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.Run("rm -rf " + shellQuote(runRoot))
+}
+
+// upload extracts the working directory into its remote copy and links its providers directory to providersDir. It
+// creates the other remote paths and returns the names of the uploaded files.
+func (e *sshExecutor) upload(client *ssh.Client, localDir, remoteDir, providersDir string, pairs []string) ([]string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []string{shellQuote(providersDir)}
+	for i := 1; i < len(pairs); i += 2 {
+		dirs = append(dirs, shellQuote(pairs[i]))
+	}
+
+	remoteProviders := path.Join(remoteDir, sshProvidersDir)
+
+	command := fmt.Sprintf(`mkdir -p %s && tar -xf - -C %s && mkdir -p %s && ln -s %s %s`, strings.Join(dirs, " "),
+		shellQuote(remoteDir), shellQuote(path.Dir(remoteProviders)), shellQuote(providersDir), shellQuote(remoteProviders))
+
+	if err := session.Start(command); err != nil {
+		return nil, fmt.Errorf("%w to %s: %w", ErrSSHSync, e.address, err)
+	}
+
+	uploaded, writeErr := writeTar(stdin, localDir, sshProvidersDir, strings.NewReplacer(pairs...).Replace)
+	stdin.Close()
+
+	if err := errors.Join(writeErr, session.Wait()); err != nil {
+		return nil, fmt.Errorf("%w to %s: %w", ErrSSHSync, e.address, err)
+	}
+
+	return uploaded, nil
+}
+
+// download extracts the remote copy of the working directory over the local one, and removes the uploaded files
+// tofu removed
+func (e *sshExecutor) download(client *ssh.Client, remoteDir, localDir string, pairs, uploaded []string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := session.Start("tar -cf - -C " + shellQuote(remoteDir) + " ."); err != nil {
+		return fmt.Errorf("%w from %s: %w", ErrSSHSync, e.address, err)
+	}
+
+	// symlinks to the remote paths point to the local ones again
+	reverse := make([]string, 0, len(pairs))
+	for i := 0; i+1 < len(pairs); i += 2 {
+		reverse = append(reverse, pairs[i+1], pairs[i])
+	}
+
+	extracted, extractErr := extractTar(stdout, localDir, sshProvidersDir, strings.NewReplacer(reverse...).Replace)
+	_, _ = io.Copy(io.Discard, stdout)
+
+	if err := errors.Join(extractErr, session.Wait()); err != nil {
+		return fmt.Errorf("%w from %s: %w", ErrSSHSync, e.address, err)
+	}
+
+	removeMissing(localDir, uploaded, extracted)
+
+	return nil
+}
+
+// removeMissing removes the uploaded entries of dir which weren't extracted again
+func removeMissing(dir string, uploaded []string, extracted map[string]bool) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		log.Warnf("Failed to remove the files tofu removed from %s: %v", dir, err)
+
+		return
+	}
+	defer root.Close()
+
+	// the entries were uploaded parents first, the contents of a directory are removed before it
+	for i := len(uploaded) - 1; i >= 0; i-- {
+		if extracted[uploaded[i]] {
+			continue
+		}
+
+		if err := root.Remove(filepath.FromSlash(uploaded[i])); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warnf("Failed to remove %s, which tofu removed from the remote copy: %v", filepath.Join(dir, uploaded[i]), err)
+		}
+	}
+}
+
+// sshProcess is tofu running on a remote host
+type sshProcess struct {
+	executor  *sshExecutor
+	client    *ssh.Client
+	session   *ssh.Session
+	stdout    io.Reader
+	stderr    io.Reader
+	localDir  string
+	remoteDir string
+	// runRoot is the remote directory of the run, removed once the process is closed
+	runRoot string
+	// pairs are the local paths of the run followed by their remote paths
+	pairs []string
+	// uploaded are the names of the files of the working directory which were uploaded
+	uploaded []string
+	// capture processes only produce output, the working directory isn't synced back
+	capture bool
+}
+
+func (p *sshProcess) Stdout() io.Reader {
+	return p.stdout
+}
+
+func (p *sshProcess) Stderr() io.Reader {
+	return p.stderr
+}
+
+// Wait waits for tofu to exit and syncs the working directory back
+func (p *sshProcess) Wait() (int, error) {
+	defer p.close()
+
+	exitCode := 0
+
+	if err := p.session.Wait(); err != nil {
+		var exitError *ssh.ExitError
+		if !errors.As(err, &exitError) {
+			return 0, err
+		}
+
+		exitCode = exitError.ExitStatus()
+	}
+
+	if p.localDir != "" && !p.capture {
+		if err := p.executor.download(p.client, p.remoteDir, p.localDir, p.pairs, p.uploaded); err != nil {
+			return 0, err
+		}
+	}
+
+	return exitCode, nil
+}
+
+// close closes the session, removes the remote directory of the run and closes the connection
+func (p *sshProcess) close() {
+	if p.session != nil {
+		_ = p.session.Close()
+	}
+
+	if p.runRoot != "" {
+		if err := p.executor.removeRunRoot(p.client, p.runRoot); err != nil {
+			log.Warnf("Failed to remove %s:%s: %v", p.executor.address, p.runRoot, err)
+		}
+	}
+
+	_ = p.client.Close()
+}
+
+// shellQuote quotes a word for a POSIX shell
+func shellQuote(word string) string {
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// excluded reports whether the slash separated name is exclude or in it
+func excluded(name, exclude string) bool {
+	return name == exclude || strings.HasPrefix(name, exclude+"/")
+}
+
+// writeTar writes the directories, regular files and symlinks of dir, but exclude, as a tar stream. The targets of
+// the symlinks are passed through rewriteLink. It returns the names of the written entries, parents first.
+func writeTar(writer io.Writer, dir, exclude string, rewriteLink func(string) string) ([]string, error) {
+	archive := tar.NewWriter(writer)
+
+	var names []string
+
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, file)
+		if err != nil || name == "." {
+			return err
+		}
+
+		name = filepath.ToSlash(name)
+		if excluded(name, exclude) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+
+			link = rewriteLink(link)
+		case !info.IsDir() && !info.Mode().IsRegular():
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = name
+		header.Uname, header.Gname = "", ""
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		names = append(names, name)
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		content, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+
+		_, err = io.Copy(archive, content)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, archive.Close()
+}
+
+// extractTar extracts the directories, regular files and symlinks of a tar stream, but exclude, into dir, replacing
+// the files which exist. The targets of the symlinks are passed through rewriteLink. Entries which would leave dir,
+// directly or through a symlink, are refused. It returns the slash separated names of the entries of the stream.
+func extractTar(reader io.Reader, dir, exclude string, rewriteLink func(string) string) (map[string]bool, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	archive := tar.NewReader(reader)
+	names := map[string]bool{}
+
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return names, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		slashName := path.Clean(header.Name)
+		if slashName == "." || excluded(slashName, exclude) {
+			continue
+		}
+
+		names[slashName] = true
+		name := filepath.FromSlash(slashName)
+
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("refusing to extract %q outside of %s", header.Name, dir)
+		}
+
+		// resolving the parent through the root fails when a symlink leads out of dir
+		if _, err := root.Stat(filepath.Dir(name)); err != nil {
+			return nil, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := root.Mkdir(name, header.FileInfo().Mode().Perm()|0700); err != nil && !errors.Is(err, fs.ErrExist) {
+				return nil, err
+			}
+		case tar.TypeReg:
+			if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+
+			file, err := root.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := io.Copy(file, archive); err != nil {
+				file.Close()
+
+				return nil, err
+			}
+
+			if err := file.Close(); err != nil {
+				return nil, err
+			}
+
+			_ = os.Chtimes(filepath.Join(dir, name), header.ModTime, header.ModTime)
+		case tar.TypeSymlink:
+			if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+
+			if err := os.Symlink(rewriteLink(header.Linkname), filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+		default:
+			log.Debugf("Skipping %s of type %s in the synced working directory", header.Name, strconv.QuoteRune(rune(header.Typeflag)))
+		}
+	}
+}
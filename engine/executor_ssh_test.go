@@ -0,0 +1,367 @@
+package engine_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTestHost is an in-process SSH server which runs the commands of its sessions with sh on the test host
+type sshTestHost struct {
+	hostKey    ssh.Signer
+	address    string
+	clientKey  string
+	knownHosts string
+	// home is the home directory of the remote user
+	home string
+	// commands are the commands of the sessions, as the remote process list shows them
+	commands []string
+	mu       sync.Mutex
+}
+
+// newSSHSigner returns a new ed25519 signer and its private key in OpenSSH format
+func newSSHSigner(t *testing.T) (ssh.Signer, []byte) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+
+	return signer, pem.EncodeToMemory(block)
+}
+
+// startSSHHost serves SSH on a local port, accepting the returned client key and trusted by the returned known_hosts
+func startSSHHost(t *testing.T) *sshTestHost {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	hostKey, _ := newSSHSigner(t)
+	clientSigner, clientKey := newSSHSigner(t)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return &ssh.Permissions{}, nil
+			}
+
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	host := &sshTestHost{
+		address:    listener.Addr().String(),
+		hostKey:    hostKey,
+		clientKey:  filepath.Join(dir, "id_ed25519"),
+		knownHosts: filepath.Join(dir, "known_hosts"),
+		home:       t.TempDir(),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go host.serveConn(conn, config)
+		}
+	}()
+
+	require.NoError(t, os.WriteFile(host.clientKey, clientKey, 0600))
+	require.NoError(t, os.WriteFile(host.knownHosts, []byte(knownhosts.Line([]string{host.address}, hostKey.PublicKey())+"\n"), 0600))
+
+	return host
+}
+
+func (h *sshTestHost) serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go h.serveSession(channel, requests)
+	}
+}
+
+func (h *sshTestHost) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+
+		_ = req.Reply(true, nil)
+
+		h.mu.Lock()
+		h.commands = append(h.commands, payload.Command)
+		h.mu.Unlock()
+
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Env = append(os.Environ(), "HOME="+h.home, "XDG_CACHE_HOME=")
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+
+		status := uint32(0)
+
+		if err := cmd.Run(); err != nil {
+			var exitError *exec.ExitError
+			if errors.As(err, &exitError) {
+				status = uint32(exitError.ExitCode())
+			} else {
+				status = 127
+			}
+		}
+
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+
+		return
+	}
+}
+
+// sshMeta is the Init meta of the SSH executor for host, running tofu under remoteRoot
+func sshMeta(host *sshTestHost, binary, remoteRoot string) []string {
+	return []string{
+		"executor", "ssh",
+		"ssh_host", "tester@" + host.address,
+		"ssh_identity_file", host.clientKey,
+		"ssh_known_hosts", host.knownHosts,
+		"ssh_binary", binary,
+		"ssh_remote_root", remoteRoot,
+	}
+}
+
+func TestTofuEngine_SSHExecutor(t *testing.T) {
+	t.Parallel()
+
+	host := startSSHHost(t)
+	remoteRoot := t.TempDir()
+
+	binary := fakeTofu(t, `ls
+echo "region=$TF_VAR_region"
+echo "path=$PATH"
+echo "dir=$(pwd)"
+echo "args=$*"
+echo "planned" > plan.out
+echo "warning" >&2
+exit 2`)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta(sshMeta(host, binary, remoteRoot)...)}, &MockInitServer{}))
+
+	workingDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "main.tf"), []byte("# unit\n"), 0600))
+
+	stream := &MockRunServer{}
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: workingDir,
+		Args:       []string{"plan", "-var-file=" + filepath.Join(workingDir, "prod.tfvars")},
+		EnvVars:    map[string]string{"TF_VAR_region": "eu-west-1", "PATH": "/engine/host/bin"},
+	}, stream))
+
+	output := stdout(stream.Responses)
+
+	// the run has its own directory under the remote root
+	remoteDir := outputValue(output, "dir")
+	runRoot := strings.TrimSuffix(remoteDir, workingDir)
+	assert.Equal(t, remoteRoot, filepath.Dir(runRoot))
+
+	assert.Contains(t, output, "main.tf\n")
+	assert.Contains(t, output, "region=eu-west-1\n")
+	assert.Equal(t, os.Getenv("PATH"), outputValue(output, "path"))
+	assert.Contains(t, output, "args=plan -var-file="+filepath.Join(remoteDir, "prod.tfvars")+"\n")
+	assert.Equal(t, "warning\n", stderr(stream.Responses))
+	assert.Equal(t, int32(2), stream.Responses[len(stream.Responses)-1].GetResultCode())
+
+	// the values of the environment variables aren't part of the remote commands
+	host.mu.Lock()
+	for _, command := range host.commands {
+		assert.NotContains(t, command, "eu-west-1")
+	}
+	host.mu.Unlock()
+
+	// the directory of the run is removed, the remote cache is kept
+	assert.NoDirExists(t, runRoot)
+	entries, err := os.ReadDir(remoteRoot)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "terragrunt-engine-cache", entries[0].Name())
+
+	// the files tofu wrote are synced back
+	content, err := os.ReadFile(filepath.Join(workingDir, "plan.out"))
+	require.NoError(t, err)
+	assert.Equal(t, "planned\n", string(content))
+}
+
+func TestTofuEngine_SSHExecutorTempRunRoot(t *testing.T) {
+	t.Parallel()
+
+	host := startSSHHost(t)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta(sshMeta(host, fakeTofu(t, `echo "dir=$(pwd)"`), "")...),
+	}, &MockInitServer{}))
+
+	workingDir := t.TempDir()
+	stream := &MockRunServer{}
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"plan"}}, stream))
+
+	// without a remote root, the run has its own temporary directory on the remote host and never uses the
+	// working directory path itself
+	remoteDir := outputValue(stdout(stream.Responses), "dir")
+	assert.NotEqual(t, workingDir, remoteDir)
+	assert.True(t, strings.HasSuffix(remoteDir, workingDir), remoteDir)
+	assert.NoDirExists(t, strings.TrimSuffix(remoteDir, workingDir))
+	assert.DirExists(t, workingDir)
+
+	// the remote cache is in the cache directory of the remote user
+	assert.DirExists(t, filepath.Join(host.home, ".cache", "terragrunt-engine-cache"))
+}
+
+func TestTofuEngine_SSHExecutorKeepsProviders(t *testing.T) {
+	t.Parallel()
+
+	host := startSSHHost(t)
+
+	// init installs the provider into the plugin cache and links it from the working directory, like tofu does
+	binary := fakeTofu(t, `case "$1" in
+init)
+	mkdir -p "$TF_PLUGIN_CACHE_DIR/null" .terraform/providers
+	echo "null provider" > "$TF_PLUGIN_CACHE_DIR/null/bin"
+	ln -s "$TF_PLUGIN_CACHE_DIR/null" .terraform/providers/null
+	echo "lock" > .terraform.lock.hcl
+	rm stale.tfvars
+	;;
+plan)
+	cat .terraform/providers/null/bin
+	;;
+esac`)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta(sshMeta(host, binary, t.TempDir())...)}, &MockInitServer{}))
+
+	workingDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "stale.tfvars"), []byte("region = \"eu-west-1\"\n"), 0600))
+
+	pluginCacheDir := filepath.Join(t.TempDir(), "plugins")
+	env := map[string]string{"TF_PLUGIN_CACHE_DIR": pluginCacheDir}
+
+	stream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"init"}, EnvVars: env}, stream))
+	require.Equal(t, int32(0), resultCode(stream.Responses), stderr(stream.Responses))
+
+	// the files tofu removed are removed locally, the providers stay on the remote host
+	assert.FileExists(t, filepath.Join(workingDir, ".terraform.lock.hcl"))
+	assert.NoFileExists(t, filepath.Join(workingDir, "stale.tfvars"))
+	assert.NoDirExists(t, filepath.Join(workingDir, ".terraform", "providers"))
+
+	// later runs, in other run directories, still find the installed providers
+	for range 2 {
+		stream = &MockRunServer{}
+		require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"plan"}, EnvVars: env}, stream))
+		require.Equal(t, int32(0), resultCode(stream.Responses), stderr(stream.Responses))
+		assert.Equal(t, "null provider\n", stdout(stream.Responses))
+	}
+}
+
+func TestTofuEngine_SSHExecutorChecksVersion(t *testing.T) {
+	t.Parallel()
+
+	host := startSSHHost(t)
+	binary := fakeTofu(t, `echo '{"terraform_version": "1.9.0"}'`)
+
+	for version, valid := range map[string]bool{"1.9.0": true, "v1.9.0": true, "latest": true, "1.8.0": false} {
+		tofuEngine := &engine.TofuEngine{}
+		meta := append(sshMeta(host, binary, t.TempDir()), "tofu_version", version)
+
+		err := tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta(meta...)}, &MockInitServer{})
+		if valid {
+			require.NoError(t, err, version)
+		} else {
+			require.ErrorIs(t, err, engine.ErrInvalidExecutor, version)
+			assert.Contains(t, err.Error(), "1.9.0", version)
+		}
+	}
+}
+
+// outputValue returns the value of the first key=value line of output
+func outputValue(output, key string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if value, found := strings.CutPrefix(line, key+"="); found {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func TestTofuEngine_SSHExecutorUnknownHostKey(t *testing.T) {
+	t.Parallel()
+
+	host := startSSHHost(t)
+
+	// trust another key for the address of the host
+	otherKey, _ := newSSHSigner(t)
+	require.NoError(t, os.WriteFile(host.knownHosts, []byte(knownhosts.Line([]string{host.address}, otherKey.PublicKey())+"\n"), 0600))
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta(sshMeta(host, "tofu", t.TempDir())...)}, &MockInitServer{}))
+
+	stream := &MockRunServer{}
+	err := tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"plan"}}, stream)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "key mismatch")
+	assert.Contains(t, stderr(stream.Responses), "key mismatch")
+}
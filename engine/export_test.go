@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+)
+
+// TestPluginEnv makes the test binary serve the engine as a go-plugin plugin
+const TestPluginEnv = "TG_ENGINE_TEST_PLUGIN"
+
+func init() {
+	// the test binary acts as the engine executable when tofu is started in a sandbox
+	if len(os.Args) > 1 && os.Args[1] == SandboxInitCommand {
+		if err := SandboxInit(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		}
+
+		os.Exit(1)
+	}
+
+	if os.Getenv(TestPluginEnv) != "" {
+		plugin.Serve(PluginServeConfig(hclog.NewNullLogger()))
+		os.Exit(0)
+	}
+}
+
+// ProviderMirrorSupported reports whether the provider mirror is started on goos
+func ProviderMirrorSupported(goos string) bool {
+	return providerMirrorSupported(goos)
+}
+
+// SetBinaryPath overrides the tofu binary used by Run
+func (c *TofuEngine) SetBinaryPath(path string) {
+	c.setBinaryPath(path)
+}
@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaMaxDeletes        = "max_deletes"
+	metaMaxChanges        = "max_changes"
+	metaProtectAddresses  = "protect_addresses"
+	metaGuardrailOverride = "guardrail_override"
+
+	destroyCommand      = "destroy"
+	autoApproveFlag     = "-auto-approve"
+	guardrailPlanPrefix = "terragrunt-engine-guardrail-*.tfplan"
+	overrideTokenLength = 12
+)
+
+var (
+	ErrInvalidGuardrails  = errors.New("invalid guardrails")
+	ErrGuardrailViolation = errors.New("guardrail violation")
+)
+
+// guardrails limit the changes of apply and destroy runs, nil when none are configured
+type guardrails struct {
+	protected  []*regexp.Regexp
+	maxDeletes int
+	maxChanges int
+}
+
+// parseGuardrails reads the guardrails from Init meta, negative limits are disabled
+func parseGuardrails(meta map[string]*anypb.Any) (*guardrails, error) {
+	maxDeletes, err := metaInt(meta, metaMaxDeletes, -1)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidGuardrails, err)
+	}
+
+	maxChanges, err := metaInt(meta, metaMaxChanges, -1)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidGuardrails, err)
+	}
+
+	patterns := metaStrings(meta, metaProtectAddresses)
+	if maxDeletes < 0 && maxChanges < 0 && len(patterns) == 0 {
+		return nil, nil
+	}
+
+	config := &guardrails{maxDeletes: maxDeletes, maxChanges: maxChanges}
+
+	for _, pattern := range patterns {
+		config.protected = append(config.protected, addressPattern(pattern))
+	}
+
+	return config, nil
+}
+
+// addressPattern compiles a glob of resource addresses where * matches any characters, e.g. module.db.*.
+// Brackets are literal so that instance keys like aws_instance.web[0] match as written.
+func addressPattern(glob string) *regexp.Regexp {
+	parts := strings.Split(glob, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// guardedRun reports whether args apply changes which the guardrails are checked against
+func guardedRun(args []string) bool {
+	command := subcommand(args)
+
+	return command == applyCommand || command == destroyCommand
+}
+
+// check evaluates the guardrails on the change summary of a plan and returns the violations
+func (g *guardrails) check(plan *Plan) []string {
+	var (
+		violations []string
+		deletes    []string
+		changes    int
+	)
+
+	for _, change := range plan.ResourceChanges {
+		actions := change.Change.Actions
+		if len(actions) == 0 || slices.Equal(actions, []string{"no-op"}) || slices.Equal(actions, []string{"read"}) {
+			continue
+		}
+
+		changes++
+
+		if !slices.Contains(actions, "delete") {
+			continue
+		}
+
+		deletes = append(deletes, change.Address)
+
+		for _, pattern := range g.protected {
+			if pattern.MatchString(change.Address) {
+				violations = append(violations, fmt.Sprintf("%s is protected but would be %s", change.Address, deleteVerb(actions)))
+				break
+			}
+		}
+	}
+
+	if g.maxDeletes >= 0 && len(deletes) > g.maxDeletes {
+		violations = append(violations, fmt.Sprintf("the plan deletes %d resources, more than %s = %d", len(deletes), metaMaxDeletes, g.maxDeletes))
+	}
+
+	if g.maxChanges >= 0 && changes > g.maxChanges {
+		violations = append(violations, fmt.Sprintf("the plan changes %d resources, more than %s = %d", changes, metaMaxChanges, g.maxChanges))
+	}
+
+	return violations
+}
+
+// deleteVerb describes a change which deletes a resource
+func deleteVerb(actions []string) string {
+	if slices.Contains(actions, "create") {
+		return "replaced"
+	}
+
+	return "deleted"
+}
+
+// overrideToken derives the token which overrides exactly the given violations
+func overrideToken(violations []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(violations, "\n")))
+
+	return hex.EncodeToString(sum[:])[:overrideTokenLength]
+}
+
+// checkGuardrails evaluates the guardrails on the plan of an apply or destroy run before it is allowed to start.
+// A run which applies a plan file is checked against that file, any other run against a speculative plan of the
+// same arguments. Violations are returned as an error unless the run passes their override token.
+func (c *TofuEngine) checkGuardrails(req *tgengine.RunRequest, opts *runOptions, config *guardrails, planFile string) error {
+	words, _ := splitCommandArgs(req.GetArgs())
+	if planFile == "" && len(words) > 1 {
+		planFile = words[1]
+	}
+
+	if planFile == "" {
+		speculative, err := c.speculativePlan(req, opts)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrGuardrailViolation, err)
+		}
+
+		defer func() {
+			if err := os.Remove(speculative); err != nil && !os.IsNotExist(err) {
+				opts.log.Warnf("Failed to remove speculative plan %s: %v", speculative, err)
+			}
+		}()
+
+		planFile = speculative
+	}
+
+	plan, err := c.showPlan(req, opts, planFile)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrGuardrailViolation, err)
+	}
+
+	violations := config.check(plan)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	token := overrideToken(violations)
+	if metaString(req.GetMeta(), metaGuardrailOverride) == token {
+		opts.log.Warnf("Guardrails of %v overridden with token %s: %s", req.GetArgs(), token, strings.Join(violations, "; "))
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s. Set the %s meta option to %s to run it anyway",
+		ErrGuardrailViolation, strings.Join(violations, "; "), metaGuardrailOverride, token)
+}
+
+// speculativePlan saves a plan of the changes an apply or destroy run would make and returns its path
+func (c *TofuEngine) speculativePlan(req *tgengine.RunRequest, opts *runOptions) (string, error) {
+	planFile, err := tempPlanFile(moduleDir(opts.workingDir, req.GetArgs()), guardrailPlanPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{planCommand, "-input=false", outFlag + "=" + planFile}
+	if subcommand(req.GetArgs()) == destroyCommand {
+		args = append(args, "-destroy")
+	}
+
+	// the arguments of the run after the subcommand, e.g. -var and -target, shape the plan too
+	seenCommand := false
+
+	for _, arg := range req.GetArgs() {
+		switch {
+		case !seenCommand:
+			seenCommand = !strings.HasPrefix(arg, "-")
+		case normalizeFlag(arg) != autoApproveFlag && normalizeFlag(arg) != "-input":
+			args = append(args, arg)
+		}
+	}
+
+	if _, err := c.capture(req, opts, args...); err != nil {
+		_ = os.Remove(planFile)
+
+		return "", err
+	}
+
+	return planFile, nil
+}
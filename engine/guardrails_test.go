@@ -0,0 +1,112 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// guardrailTofu fakes a plan which deletes the database and the cache and updates the network.
+// A destroy plan deletes all three, apply and destroy leave a marker in the working directory.
+const guardrailTofu = `case "$1" in
+plan)
+  case "$*" in
+  *-destroy*) echo '["delete"] ["delete"] ["delete"]' > "${3#-out=}" ;;
+  *) echo '["delete","create"] ["delete"] ["update"]' > "${3#-out=}" ;;
+  esac ;;
+show) set -- $(cat "$3"); cat <<JSON
+{"resource_changes": [
+  {"address": "module.db.aws_db_instance.main[0]", "change": {"actions": $1}},
+  {"address": "aws_elasticache_cluster.cache", "change": {"actions": $2}},
+  {"address": "aws_vpc.main", "change": {"actions": $3}},
+  {"address": "data.aws_ami.ubuntu", "change": {"actions": ["read"]}}
+]}
+JSON
+;;
+apply|destroy) echo "ran $*" > marker ;;
+esac
+`
+
+func TestTofuEngine_RunChecksGuardrails(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta(
+		"max_deletes", "2",
+		"protect_addresses", "module.db.*",
+	)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, guardrailTofu))
+
+	workingDir := t.TempDir()
+
+	run := func(args []string, meta ...string) (*MockRunServer, error) {
+		t.Helper()
+
+		mockStream := &MockRunServer{}
+		err := tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: args, Meta: stringMeta(meta...)}, mockStream)
+
+		return mockStream, err
+	}
+
+	mockStream, err := run([]string{"apply", "-auto-approve"})
+	require.ErrorIs(t, err, engine.ErrGuardrailViolation)
+	assert.Contains(t, stderr(mockStream.Responses), "module.db.aws_db_instance.main[0] is protected but would be replaced")
+	assert.NotContains(t, stderr(mockStream.Responses), "max_deletes")
+
+	_, err = os.Stat(filepath.Join(workingDir, "marker"))
+	assert.True(t, os.IsNotExist(err), "apply must not run")
+
+	// the speculative plan is removed
+	planFiles, err := filepath.Glob(filepath.Join(workingDir, "*.tfplan"))
+	require.NoError(t, err)
+	assert.Empty(t, planFiles)
+
+	mockStream, err = run([]string{"destroy", "-auto-approve"})
+	require.ErrorIs(t, err, engine.ErrGuardrailViolation)
+	assert.Contains(t, stderr(mockStream.Responses), "the plan deletes 3 resources, more than max_deletes = 2")
+
+	// a token for other violations does not override them
+	token := regexp.MustCompile(`guardrail_override meta option to ([0-9a-f]+)`).FindStringSubmatch(stderr(mockStream.Responses))
+	require.NotNil(t, token)
+
+	_, err = run([]string{"apply", "-auto-approve"}, "guardrail_override", token[1])
+	require.ErrorIs(t, err, engine.ErrGuardrailViolation)
+
+	mockStream, err = run([]string{"destroy", "-auto-approve"}, "guardrail_override", token[1])
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+	marker, err := os.ReadFile(filepath.Join(workingDir, "marker"))
+	require.NoError(t, err)
+	assert.Equal(t, "ran destroy -auto-approve\n", string(marker))
+}
+
+func TestTofuEngine_RunChecksGuardrailsOfPlanFile(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("max_changes", "2")}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, guardrailTofu))
+
+	workingDir := t.TempDir()
+
+	// no-op changes and data sources don't count
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "tfplan"), []byte(`["create"] ["update"] ["no-op"]`), 0644))
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"apply", "tfplan"}}, mockStream))
+	assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "tfplan"), []byte(`["create"] ["update"] ["delete"]`), 0644))
+
+	mockStream = &MockRunServer{}
+	err := tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"apply", "tfplan"}}, mockStream)
+	require.ErrorIs(t, err, engine.ErrGuardrailViolation)
+	assert.Contains(t, stderr(mockStream.Responses), "the plan changes 3 resources, more than max_changes = 2")
+}
@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// healthServices are the services the engine reports the health of: the server as a whole and the engine
+var healthServices = []string{"", tgengine.Engine_ServiceDesc.ServiceName}
+
+// engineHealth reports the health of the engine through the standard grpc.health.v1 service: NOT_SERVING while
+// the server drains or when the tofu binary is missing
+type engineHealth struct {
+	*health.Server
+	engine *TofuEngine
+
+	// stopped ends the watches, which would otherwise keep a graceful stop waiting
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newEngineHealth(engine *TofuEngine) *engineHealth {
+	h := &engineHealth{Server: health.NewServer(), engine: engine, stopped: make(chan struct{})}
+	h.refresh()
+
+	return h
+}
+
+// refresh updates the serving status from the availability of the tofu binary, a draining server stays
+// NOT_SERVING
+func (h *engineHealth) refresh() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if _, err := exec.LookPath(h.engine.binary()); err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	for _, service := range healthServices {
+		h.SetServingStatus(service, status)
+	}
+}
+
+// drain reports NOT_SERVING until resume is called
+func (h *engineHealth) drain() {
+	h.Shutdown()
+}
+
+// stop drains and ends the watches after they were told NOT_SERVING
+func (h *engineHealth) stop() {
+	h.drain()
+	h.stopOnce.Do(func() { close(h.stopped) })
+}
+
+// resume reports the status of the engine again after a drain
+func (h *engineHealth) resume() {
+	h.Resume()
+	h.refresh()
+}
+
+func (h *engineHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	h.refresh()
+
+	return h.Server.Check(ctx, req)
+}
+
+func (h *engineHealth) List(ctx context.Context, req *healthpb.HealthListRequest) (*healthpb.HealthListResponse, error) {
+	h.refresh()
+
+	return h.Server.List(ctx, req)
+}
+
+func (h *engineHealth) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	h.refresh()
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-h.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	watch := &watchStream{Health_WatchServer: stream, ctx: ctx}
+
+	err := h.Server.Watch(req, watch)
+
+	select {
+	case <-h.stopped:
+		// the watch ended with the server, make sure it saw the drain even when it lost the race with the stop
+		if watch.last != healthpb.HealthCheckResponse_NOT_SERVING {
+			return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+		}
+
+		return nil
+	default:
+		return err
+	}
+}
+
+// watchStream is a watch which ends when its context is cancelled and remembers the last status it sent
+type watchStream struct {
+	healthpb.Health_WatchServer
+	ctx  context.Context
+	last healthpb.HealthCheckResponse_ServingStatus
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchStream) Send(response *healthpb.HealthCheckResponse) error {
+	s.last = response.GetStatus()
+
+	return s.Health_WatchServer.Send(response)
+}
+
+// serverOptions answers the health checks of the engine services on a server whose grpc.health.v1 service is
+// registered by someone else, like the one of go-plugin. Checks of other services reach that service.
+func (h *engineHealth) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if check, ok := req.(*healthpb.HealthCheckRequest); ok && info.FullMethod == healthpb.Health_Check_FullMethodName &&
+				slices.Contains(healthServices, check.GetService()) {
+				return h.Check(ctx, check)
+			}
+
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if info.FullMethod != healthpb.Health_Watch_FullMethodName {
+				return handler(srv, stream)
+			}
+
+			req := &healthpb.HealthCheckRequest{}
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+
+			if !slices.Contains(healthServices, req.GetService()) {
+				return handler(srv, &replayStream{ServerStream: stream, req: req})
+			}
+
+			return h.Watch(req, &grpc.GenericServerStream[healthpb.HealthCheckRequest, healthpb.HealthCheckResponse]{ServerStream: stream})
+		}),
+	}
+}
+
+// replayStream hands a request message which was already received to the handler of a stream
+type replayStream struct {
+	grpc.ServerStream
+	req proto.Message
+}
+
+func (s *replayStream) RecvMsg(m any) error {
+	if s.req == nil {
+		return s.ServerStream.RecvMsg(m)
+	}
+
+	proto.Merge(m.(proto.Message), s.req)
+	s.req = nil
+
+	return nil
+}
+
+// isHealthMethod reports whether a method belongs to the health service, which probes call without credentials
+func isHealthMethod(method string) bool {
+	return strings.HasPrefix(method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
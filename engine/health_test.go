@@ -0,0 +1,177 @@
+package engine_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+)
+
+// healthStatus returns the serving status of a service
+func healthStatus(t *testing.T, client healthpb.HealthClient, service string) healthpb.HealthCheckResponse_ServingStatus {
+	t.Helper()
+
+	response, err := client.Check(t.Context(), &healthpb.HealthCheckRequest{Service: service})
+	require.NoError(t, err)
+
+	return response.GetStatus()
+}
+
+func TestServer_Health(t *testing.T) {
+	// the health follows the tofu of PATH
+	t.Setenv("PATH", t.TempDir())
+
+	path := socketPath(t)
+
+	listener, err := engine.Listen("unix://" + path)
+	require.NoError(t, err)
+
+	server, _ := startServer(t, listener)
+
+	conn, err := grpc.NewClient("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	client := healthpb.NewHealthClient(conn)
+
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, healthStatus(t, client, ""))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, healthStatus(t, client, "proto.Engine"))
+
+	t.Setenv("PATH", filepath.Dir(fakeTofu(t, `sleep 1; echo "ran $*"`)))
+
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, healthStatus(t, client, ""))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, healthStatus(t, client, "proto.Engine"))
+
+	// a watch sees the drain of the stop while a request still runs
+	watch, err := client.Watch(t.Context(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	response, err := watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, response.GetStatus())
+
+	running := make(chan error, 1)
+
+	go func() {
+		_, _, err := runOutput(context.Background(), engineClient(t, "unix://"+path), &tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"plan"}})
+		running <- err
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		server.Stop(context.Background())
+		close(stopped)
+	}()
+
+	response, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, response.GetStatus())
+
+	require.NoError(t, <-running)
+	<-stopped
+}
+
+func TestServer_Reflection(t *testing.T) {
+	t.Parallel()
+
+	listener, err := engine.Listen("unix://" + socketPath(t))
+	require.NoError(t, err)
+
+	server := engine.NewServer(listener)
+	server.EnableReflection()
+
+	go func() { _ = server.Serve() }()
+
+	t.Cleanup(func() { server.Stop(context.Background()) })
+
+	conn, err := grpc.NewClient("unix://"+listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}))
+
+	response, err := stream.Recv()
+	require.NoError(t, err)
+
+	var services []string
+	for _, service := range response.GetListServicesResponse().GetService() {
+		services = append(services, service.GetName())
+	}
+
+	assert.Contains(t, services, "proto.Engine")
+	assert.Contains(t, services, "grpc.health.v1.Health")
+}
+
+func TestPluginClient_Health(t *testing.T) {
+	t.Parallel()
+
+	// go-plugin passes the environment of the test to the plugin, which serves when it finds tofu on PATH
+	serving := healthpb.HealthCheckResponse_SERVING
+	if _, err := exec.LookPath("tofu"); err != nil {
+		serving = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), engine.TestPluginEnv+"=1")
+
+	client := engine.NewPluginClient(cmd, hclog.NewNullLogger())
+	t.Cleanup(client.Kill)
+
+	rpcClient, err := client.Client()
+	require.NoError(t, err)
+
+	grpcClient, ok := rpcClient.(*plugin.GRPCClient)
+	require.True(t, ok)
+
+	health := healthpb.NewHealthClient(grpcClient.Conn)
+
+	// the plugin service of go-plugin is still answered by go-plugin
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, healthStatus(t, health, "plugin"))
+	assert.Equal(t, serving, healthStatus(t, health, "proto.Engine"))
+
+	raw, err := rpcClient.Dispense(engine.PluginName)
+	require.NoError(t, err)
+
+	engineClient, ok := raw.(tgengine.EngineClient)
+	require.True(t, ok)
+
+	shutdown, err := engineClient.Shutdown(t.Context(), &tgengine.ShutdownRequest{})
+	require.NoError(t, err)
+
+	for {
+		_, err := shutdown.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, healthStatus(t, health, ""))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, healthStatus(t, health, "proto.Engine"))
+
+	// the next Init serves again
+	require.NoError(t, canInit(t, engineClient))
+	assert.Equal(t, serving, healthStatus(t, health, "proto.Engine"))
+}
@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metaForceInit = "force_init"
+
+	initCommand             = "init"
+	initFingerprintFileName = "terragrunt-engine-init.fingerprint"
+	defaultDataDir          = ".terraform"
+	lockFileName            = ".terraform.lock.hcl"
+	dataDirEnv              = "TF_DATA_DIR"
+	backendConfigFlag       = "-backend-config"
+	upgradeFlag             = "-upgrade"
+	fingerprintFileMode     = 0644
+)
+
+// initFingerprintEnv are the environment variables which change the result of init
+var initFingerprintEnv = []string{dataDirEnv, pluginCacheDirEnv, "TF_CLI_CONFIG_FILE", "TF_WORKSPACE"}
+
+// initCache tracks the inputs of the last successful init of a module, so that redundant inits can be skipped
+type initCache struct {
+	log         *log.Entry
+	moduleDir   string
+	path        string
+	fingerprint string
+}
+
+// newInitCache returns the init cache for an init run. A nil cache is returned for other subcommands and when init
+// must run anyway because of -upgrade.
+func newInitCache(req *tgengine.RunRequest, opts *runOptions, binaryPath string) (*initCache, error) {
+	words, flags := splitCommandArgs(req.GetArgs())
+	if len(words) == 0 || words[0] != initCommand || slices.Contains(flags, upgradeFlag) {
+		return nil, nil
+	}
+
+	moduleDir := moduleDir(opts.workingDir, req.GetArgs())
+
+	dataDir := requestEnv(req, dataDirEnv)
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+
+	if !filepath.IsAbs(dataDir) {
+		dataDir = filepath.Join(moduleDir, dataDir)
+	}
+
+	fingerprint, err := computeInitFingerprint(binaryPath, moduleDir, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &initCache{
+		log:         opts.log,
+		moduleDir:   moduleDir,
+		path:        filepath.Join(dataDir, initFingerprintFileName),
+		fingerprint: fingerprint,
+	}, nil
+}
+
+// upToDate reports whether the previous successful init had the same fingerprint
+func (c *initCache) upToDate() bool {
+	previous, err := os.ReadFile(c.path)
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSpace(string(previous)) == c.fingerprint
+}
+
+// record stores the fingerprint after an init run, or forgets it when the init failed
+func (c *initCache) record(req *tgengine.RunRequest, binaryPath string, resultCode int) {
+	if resultCode != 0 {
+		if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+			c.log.Warnf("Failed to remove init fingerprint %s: %v", c.path, err)
+		}
+
+		return
+	}
+
+	// init may have updated the lock file, so the fingerprint is computed again
+	fingerprint, err := computeInitFingerprint(binaryPath, c.moduleDir, req)
+	if err != nil {
+		c.log.Warnf("Failed to compute init fingerprint: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(c.path, []byte(fingerprint+"\n"), fingerprintFileMode); err != nil {
+		c.log.Warnf("Failed to write init fingerprint %s: %v", c.path, err)
+	}
+}
+
+// computeInitFingerprint hashes everything which affects the result of init: the binary, the init arguments
+// and backend config files, the relevant environment, the lock file, and the terraform blocks, module sources
+// and resource types of the module and its local modules.
+func computeInitFingerprint(binaryPath, moduleDir string, req *tgengine.RunRequest) (string, error) {
+	hasher := sha256.New()
+	args := req.GetArgs()
+
+	resolvedBinary, err := exec.LookPath(binaryPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", binaryPath, err)
+	}
+
+	binaryInfo, err := os.Stat(resolvedBinary)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %w", resolvedBinary, err)
+	}
+
+	fmt.Fprintf(hasher, "binary\x00%s\x00%d\x00%d\x00", resolvedBinary, binaryInfo.Size(), binaryInfo.ModTime().UnixNano())
+	fmt.Fprintf(hasher, "args\x00%s\x00", strings.Join(args, "\x00"))
+
+	for i, arg := range args {
+		file, found := strings.CutPrefix(arg, backendConfigFlag+"=")
+		if !found && arg == backendConfigFlag && i+1 < len(args) {
+			file, found = args[i+1], true
+		}
+
+		if !found || strings.Contains(file, "=") {
+			continue
+		}
+
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(moduleDir, file)
+		}
+
+		if err := hashFile(hasher, "backend-config", file); err != nil {
+			return "", err
+		}
+	}
+
+	for _, key := range initFingerprintEnv {
+		fmt.Fprintf(hasher, "env\x00%s=%s\x00", key, requestEnv(req, key))
+	}
+
+	if err := hashFile(hasher, "lock", filepath.Join(moduleDir, lockFileName)); err != nil {
+		return "", err
+	}
+
+	if err := hashModule(hasher, moduleDir, map[string]bool{}); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// requestEnv returns an environment variable of the run, falling back to the engine environment which tofu inherits
+func requestEnv(req *tgengine.RunRequest, key string) string {
+	if value, exists := req.GetEnvVars()[key]; exists {
+		return value
+	}
+
+	return os.Getenv(key)
+}
+
+// hashFile adds the content of a file to the hash, a missing file is hashed as such
+func hashFile(hasher hash.Hash, label, path string) error {
+	fmt.Fprintf(hasher, "%s\x00%s\x00", label, path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Fprint(hasher, "missing\x00")
+			return nil
+		}
+
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(hasher, file); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// configFiles returns the sorted native syntax and JSON configuration files of a module, with the .tf and the
+// OpenTofu specific .tofu extensions
+func configFiles(moduleDir string) ([]string, []string, error) {
+	var files, jsonFiles []string
+
+	for _, pattern := range []string{"*.tf", "*.tofu"} {
+		matches, err := filepath.Glob(filepath.Join(moduleDir, pattern))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, matches...)
+	}
+
+	for _, pattern := range []string{"*.tf.json", "*.tofu.json"} {
+		matches, err := filepath.Glob(filepath.Join(moduleDir, pattern))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		jsonFiles = append(jsonFiles, matches...)
+	}
+
+	sort.Strings(files)
+	sort.Strings(jsonFiles)
+
+	return files, jsonFiles, nil
+}
+
+// hashModule adds the init relevant parts of the configuration files of a module to the hash and recurses
+// into local modules
+func hashModule(hasher hash.Hash, moduleDir string, visited map[string]bool) error {
+	if visited[moduleDir] {
+		return nil
+	}
+
+	visited[moduleDir] = true
+
+	files, jsonFiles, err := configFiles(moduleDir)
+	if err != nil {
+		return err
+	}
+
+	// JSON configuration is rare, it is hashed as a whole
+	for _, file := range jsonFiles {
+		if err := hashFile(hasher, "config", file); err != nil {
+			return err
+		}
+	}
+
+	var localModules []string
+
+	resourceTypes := map[string]bool{}
+
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		var body *hclsyntax.Body
+
+		parsed, diags := hclsyntax.ParseConfig(src, file, hcl.InitialPos)
+		if parsed != nil {
+			body, _ = parsed.Body.(*hclsyntax.Body)
+		}
+
+		if diags.HasErrors() || body == nil {
+			// invalid files are hashed as a whole, init reports the errors
+			fmt.Fprintf(hasher, "config\x00%s\x00", file)
+			hasher.Write(src)
+
+			continue
+		}
+
+		for _, block := range body.Blocks {
+			switch block.Type {
+			case "terraform":
+				hasher.Write(block.Range().SliceBytes(src))
+			case "module":
+				for _, name := range []string{"source", "version"} {
+					if attr, exists := block.Body.Attributes[name]; exists {
+						fmt.Fprintf(hasher, "module\x00%s\x00", name)
+						hasher.Write(attr.Expr.Range().SliceBytes(src))
+					}
+				}
+
+				if attr, exists := block.Body.Attributes["source"]; exists {
+					if source, ok := attr.Expr.(*hclsyntax.TemplateExpr); ok && source.IsStringLiteral() {
+						value, _ := source.Value(nil)
+						if path := value.AsString(); strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") {
+							localModules = append(localModules, filepath.Join(moduleDir, path))
+						}
+					}
+				}
+			case "resource", "data":
+				// new resource types may need new providers, more resources of known types don't
+				if len(block.Labels) > 0 {
+					resourceTypes[block.Type+"."+block.Labels[0]] = true
+				}
+			}
+		}
+	}
+
+	types := make([]string, 0, len(resourceTypes))
+	for resourceType := range resourceTypes {
+		types = append(types, resourceType)
+	}
+
+	sort.Strings(types)
+	fmt.Fprintf(hasher, "types\x00%s\x00", strings.Join(types, "\x00"))
+
+	for _, localModule := range localModules {
+		if err := hashModule(hasher, localModule, visited); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
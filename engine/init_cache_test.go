@@ -0,0 +1,122 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const initFixtureConfig = `terraform {
+  backend "local" {
+    path = "state.tfstate"
+  }
+}
+
+module "network" {
+  source = "./modules/network"
+}
+
+resource "null_resource" "a" {}
+`
+
+func TestTofuEngine_RunSkipsRedundantInit(t *testing.T) {
+	t.Parallel()
+
+	workingDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(workingDir, "modules", "network"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "main.tf"), []byte(initFixtureConfig), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "modules", "network", "main.tf"), []byte(`resource "null_resource" "n" {}`), 0644))
+
+	counter := filepath.Join(t.TempDir(), "inits")
+	tofuEngine := &engine.TofuEngine{}
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo init >> "`+counter+`"
+mkdir -p .terraform
+[ -f .terraform.lock.hcl ] || echo 'provider "registry.opentofu.org/hashicorp/null" {}' > .terraform.lock.hcl
+echo "OpenTofu has been successfully initialized!"
+`))
+
+	runInit := func(args []string, meta ...string) string {
+		t.Helper()
+
+		mockStream := &MockRunServer{}
+		require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: args, Meta: stringMeta(meta...)}, mockStream))
+		assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+		return stdout(mockStream.Responses)
+	}
+
+	inits := func() int {
+		t.Helper()
+
+		return attempts(t, counter)
+	}
+
+	writeConfig := func(path, content string) {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(workingDir, path), []byte(content), 0644))
+	}
+
+	assert.Contains(t, runInit([]string{"init"}), "successfully initialized")
+	assert.Equal(t, 1, inits())
+
+	assert.Contains(t, runInit([]string{"init"}), "Skipping tofu init")
+	assert.Equal(t, 1, inits())
+
+	// more resources of a known type don't need init
+	writeConfig("extra.tf", `resource "null_resource" "b" {}`)
+	runInit([]string{"init"})
+	assert.Equal(t, 1, inits())
+
+	runInit([]string{"init"}, "force_init", "true")
+	assert.Equal(t, 2, inits())
+
+	runInit([]string{"init", "-upgrade"})
+	assert.Equal(t, 3, inits())
+
+	testCases := []struct {
+		change func()
+		name   string
+	}{
+		{name: "lock file", change: func() { writeConfig(".terraform.lock.hcl", "# changed\n") }},
+		{name: "backend", change: func() { writeConfig("main.tf", strings.Replace(initFixtureConfig, "state.tfstate", "new.tfstate", 1)) }},
+		{name: "local module", change: func() { writeConfig("modules/network/main.tf", `resource "random_id" "n" {}`) }},
+		{name: "new resource type", change: func() { writeConfig("extra.tf", `resource "local_file" "f" {}`) }},
+		{name: "tofu file", change: func() {
+			writeConfig("versions.tofu", `terraform { required_providers { null = { source = "hashicorp/null" } } }`)
+		}},
+		{name: "edited tofu file", change: func() {
+			writeConfig("versions.tofu", `terraform { required_providers { null = { source = "opentofu/null" } } }`)
+		}},
+		{name: "tofu json file", change: func() { writeConfig("module.tofu.json", `{"module": {"dns": {"source": "./modules/network"}}}`) }},
+		{name: "data dir removed", change: func() { require.NoError(t, os.RemoveAll(filepath.Join(workingDir, ".terraform"))) }},
+	}
+
+	for _, tc := range testCases {
+		before := inits()
+		tc.change()
+
+		assert.Contains(t, runInit([]string{"init"}), "successfully initialized", tc.name)
+		assert.Equal(t, before+1, inits(), tc.name)
+		assert.Contains(t, runInit([]string{"init"}), "Skipping tofu init", tc.name)
+	}
+
+	// comments outside of the terraform block don't matter, -backend-config args do
+	before := inits()
+
+	writeConfig("main.tf", strings.Replace(initFixtureConfig, "state.tfstate", "new.tfstate", 1)+"\n# comment\n")
+	runInit([]string{"init"})
+	assert.Equal(t, before, inits())
+
+	runInit([]string{"init", "-backend-config=path=other.tfstate"})
+	assert.Equal(t, before+1, inits())
+
+	report, _ := runReportRequest(t, tofuEngine, &tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"init", "-backend-config=path=other.tfstate"}})
+	assert.True(t, report.InitSkipped)
+	assert.Equal(t, before+1, inits())
+}
@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/hashicorp/go-hclog"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// LogLevelEnv sets the level of the engine logs
+	LogLevelEnv = "TG_ENGINE_LOG_LEVEL"
+	// LogFormatEnv selects the format of the engine logs, text or json
+	LogFormatEnv = "TG_ENGINE_LOG_FORMAT"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	metaLogLevel = "log_level"
+
+	// fields of the log lines of a run
+	logFieldRunID      = "run_id"
+	logFieldWorkingDir = "working_dir"
+	logFieldSubcommand = "subcommand"
+)
+
+var (
+	ErrInvalidLogFormat = errors.New("invalid log format")
+	ErrInvalidLogLevel  = errors.New("invalid log level")
+)
+
+// LogConfig configures the engine logs
+type LogConfig struct {
+	// Format is text or json, the hclog JSON format which go-plugin forwards to Terragrunt with levels and fields
+	Format string
+	// Level is a logrus level, info by default
+	Level  string
+	Output io.Writer
+}
+
+// ConfigureLogging sends the engine logs through a single hclog logger and returns it, for go-plugin to log through
+// as well. Invalid settings fall back to the defaults and are returned as an error.
+func ConfigureLogging(config LogConfig) (hclog.Logger, error) {
+	var errs []error
+
+	level := log.InfoLevel
+
+	if config.Level != "" {
+		parsed, err := log.ParseLevel(config.Level)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w %q", ErrInvalidLogLevel, config.Level))
+		} else {
+			level = parsed
+		}
+	}
+
+	jsonFormat := false
+
+	switch strings.ToLower(config.Format) {
+	case "", LogFormatText:
+	case LogFormatJSON:
+		jsonFormat = true
+	default:
+		errs = append(errs, fmt.Errorf("%w %q, must be %s or %s", ErrInvalidLogFormat, config.Format, LogFormatText, LogFormatJSON))
+	}
+
+	options := func(level hclog.Level) *hclog.LoggerOptions {
+		return &hclog.LoggerOptions{Level: level, Output: config.Output, JSONFormat: jsonFormat}
+	}
+
+	// logrus filters by the level of the run, so the hook logger lets every line through
+	log.SetLevel(level)
+	log.SetOutput(io.Discard)
+	log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	log.AddHook(&hclogHook{logger: hclog.New(options(hclog.Trace))})
+
+	return hclog.New(options(hclogLevel(level))), errors.Join(errs...)
+}
+
+// hclogHook writes logrus entries with their fields through an hclog logger
+type hclogHook struct {
+	logger hclog.Logger
+}
+
+func (h *hclogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *hclogHook) Fire(entry *log.Entry) error {
+	args := make([]any, 0, 2*len(entry.Data))
+
+	for _, key := range slices.Sorted(maps.Keys(entry.Data)) {
+		value := entry.Data[key]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		args = append(args, key, value)
+	}
+
+	h.logger.Log(hclogLevel(entry.Level), strings.TrimRight(entry.Message, "\n"), args...)
+
+	return nil
+}
+
+// hclogLevel returns the hclog level of a logrus level
+func hclogLevel(level log.Level) hclog.Level {
+	switch level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return hclog.Error
+	case log.WarnLevel:
+		return hclog.Warn
+	case log.InfoLevel:
+		return hclog.Info
+	case log.DebugLevel:
+		return hclog.Debug
+	default:
+		return hclog.Trace
+	}
+}
+
+// runLogger returns the logger of a run. Its lines carry the run ID, working directory and subcommand, and with the
+// log_level meta option they are logged at that level instead of the engine level.
+func runLogger(req *tgengine.RunRequest, runID string) (*log.Entry, error) {
+	logger := log.StandardLogger()
+
+	if level := metaString(req.GetMeta(), metaLogLevel); level != "" {
+		parsed, err := log.ParseLevel(level)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q in %s", ErrInvalidLogLevel, level, metaLogLevel)
+		}
+
+		logger = &log.Logger{
+			Out:       logger.Out,
+			Hooks:     logger.Hooks,
+			Formatter: logger.Formatter,
+			ExitFunc:  logger.ExitFunc,
+			Level:     parsed,
+		}
+	}
+
+	return logger.WithFields(log.Fields{
+		logFieldRunID:      runID,
+		logFieldWorkingDir: req.GetWorkingDir(),
+		logFieldSubcommand: subcommand(req.GetArgs()),
+	}), nil
+}
@@ -0,0 +1,145 @@
+package engine_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// restoreLogging restores the global logrus state after the test, tests which configure logging can't run in parallel
+func restoreLogging(t *testing.T) {
+	t.Helper()
+
+	logger := log.StandardLogger()
+	previousLevel, previousOut := logger.GetLevel(), logger.Out
+	previousHooks := logger.ReplaceHooks(log.LevelHooks{})
+
+	t.Cleanup(func() {
+		logger.SetLevel(previousLevel)
+		logger.SetOutput(previousOut)
+		logger.ReplaceHooks(previousHooks)
+	})
+}
+
+// configureJSONLogging logs the engine in JSON into a buffer at level
+func configureJSONLogging(t *testing.T, level string) *bytes.Buffer {
+	t.Helper()
+
+	restoreLogging(t)
+
+	var output bytes.Buffer
+
+	_, err := engine.ConfigureLogging(engine.LogConfig{Format: engine.LogFormatJSON, Level: level, Output: &output})
+	require.NoError(t, err)
+
+	return &output
+}
+
+// logLines returns the JSON log lines of output
+func logLines(t *testing.T, output *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var lines []map[string]any
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		line := map[string]any{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line), scanner.Text())
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// findLogLine returns the first log line with message, or nil
+func findLogLine(lines []map[string]any, message string) map[string]any {
+	for _, line := range lines {
+		if line["@message"] == message {
+			return line
+		}
+	}
+
+	return nil
+}
+
+func TestConfigureLogging_JSON(t *testing.T) {
+	output := configureJSONLogging(t, "info")
+
+	log.WithField("unit", "vpc").Warn("Something happened\n")
+	log.Debug("Filtered out")
+
+	lines := logLines(t, output)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "warn", lines[0]["@level"])
+	assert.Equal(t, "Something happened", lines[0]["@message"])
+	assert.Equal(t, "vpc", lines[0]["unit"])
+	assert.Contains(t, lines[0], "@timestamp")
+}
+
+func TestConfigureLogging_Invalid(t *testing.T) {
+	restoreLogging(t)
+
+	var output bytes.Buffer
+
+	hclogger, err := engine.ConfigureLogging(engine.LogConfig{Format: "xml", Level: "loud", Output: &output})
+	require.ErrorIs(t, err, engine.ErrInvalidLogFormat)
+	require.ErrorIs(t, err, engine.ErrInvalidLogLevel)
+
+	// the defaults are used instead
+	assert.Equal(t, log.InfoLevel, log.GetLevel())
+	assert.True(t, hclogger.IsInfo())
+	assert.False(t, hclogger.IsDebug())
+}
+
+func TestTofuEngine_RunLogFields(t *testing.T) {
+	output := configureJSONLogging(t, "warn")
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "planned"`))
+
+	workingDir := t.TempDir()
+	message := "Run Tofu plugin " + workingDir
+
+	// at the engine level the info line of the run is filtered out
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"plan"}}, &MockRunServer{}))
+	assert.Nil(t, findLogLine(logLines(t, output), message))
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: workingDir,
+		Args:       []string{"plan", "-input=false"},
+		Meta:       stringMeta("log_level", "info"),
+	}, &MockRunServer{}))
+
+	line := findLogLine(logLines(t, output), message)
+	require.NotNil(t, line)
+	assert.Equal(t, "info", line["@level"])
+	assert.Equal(t, workingDir, line["working_dir"])
+	assert.Equal(t, "plan", line["subcommand"])
+	assert.NotEmpty(t, line["run_id"])
+}
+
+func TestTofuEngine_RunInvalidLogLevel(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{}, &MockInitServer{}))
+
+	stream := &MockRunServer{}
+	err := tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: t.TempDir(),
+		Args:       []string{"plan"},
+		Meta:       stringMeta("log_level", "loud"),
+	}, stream)
+	require.ErrorIs(t, err, engine.ErrInvalidLogLevel)
+	require.NotEmpty(t, stream.Responses)
+	assert.Contains(t, stream.Responses[0].GetStderr(), "invalid log level")
+}
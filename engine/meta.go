@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// metaString returns the string value of a meta key, or an empty string if the key is not set.
+// Values packed as structpb.Value (as sent by Terragrunt) are unpacked, anything else is read as raw bytes.
+func metaString(meta map[string]*anypb.Any, key string) string {
+	value, exists := meta[key]
+	if !exists || value == nil {
+		return ""
+	}
+
+	var structValue structpb.Value
+	if value.MessageIs(&structValue) {
+		if err := value.UnmarshalTo(&structValue); err == nil {
+			return structValueString(&structValue)
+		}
+	}
+
+	return string(value.GetValue())
+}
+
+// metaStrings returns the list value of a meta key.
+// Lists are accepted either as structpb lists or as comma separated strings.
+func metaStrings(meta map[string]*anypb.Any, key string) []string {
+	return metaList(meta, key, ",")
+}
+
+// metaPatterns returns the list value of a meta key holding regular expressions.
+// Lists are accepted either as structpb lists or as strings with one pattern per line, since patterns may contain commas.
+func metaPatterns(meta map[string]*anypb.Any, key string) []string {
+	return metaList(meta, key, "\n")
+}
+
+// metaList returns the list value of a meta key, splitting string values on sep
+func metaList(meta map[string]*anypb.Any, key, sep string) []string {
+	value, exists := meta[key]
+	if !exists || value == nil {
+		return nil
+	}
+
+	var structValue structpb.Value
+	if value.MessageIs(&structValue) {
+		if err := value.UnmarshalTo(&structValue); err == nil && structValue.GetListValue() != nil {
+			items := structValue.GetListValue().GetValues()
+			result := make([]string, 0, len(items))
+
+			for _, item := range items {
+				if s := strings.TrimSpace(structValueString(item)); s != "" {
+					result = append(result, s)
+				}
+			}
+
+			return result
+		}
+	}
+
+	return splitList(metaString(meta, key), sep)
+}
+
+// metaBool returns the boolean value of a meta key, or false if the key is not set.
+func metaBool(meta map[string]*anypb.Any, key string) (bool, error) {
+	value := strings.TrimSpace(metaString(meta, key))
+	if value == "" {
+		return false, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean value %q for meta key %s: %w", value, key, err)
+	}
+
+	return parsed, nil
+}
+
+// metaInt returns the integer value of a meta key, or fallback if the key is not set.
+func metaInt(meta map[string]*anypb.Any, key string, fallback int) (int, error) {
+	value := strings.TrimSpace(metaString(meta, key))
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer value %q for meta key %s: %w", value, key, err)
+	}
+
+	return parsed, nil
+}
+
+// metaDuration returns the duration value of a meta key, e.g. "30s", or fallback if the key is not set.
+func metaDuration(meta map[string]*anypb.Any, key string, fallback time.Duration) (time.Duration, error) {
+	value := strings.TrimSpace(metaString(meta, key))
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration value %q for meta key %s: %w", value, key, err)
+	}
+
+	return parsed, nil
+}
+
+// structValueString renders a structpb.Value as a plain string
+func structValueString(value *structpb.Value) string {
+	switch kind := value.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return kind.StringValue
+	case *structpb.Value_BoolValue:
+		return strconv.FormatBool(kind.BoolValue)
+	case *structpb.Value_NumberValue:
+		return strconv.FormatFloat(kind.NumberValue, 'f', -1, 64)
+	case *structpb.Value_ListValue:
+		items := make([]string, 0, len(kind.ListValue.GetValues()))
+		for _, item := range kind.ListValue.GetValues() {
+			items = append(items, structValueString(item))
+		}
+
+		return strings.Join(items, ",")
+	default:
+		return ""
+	}
+}
+
+// splitList splits a string on sep, dropping empty entries
+func splitList(value, sep string) []string {
+	var result []string
+
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
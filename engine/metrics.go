@@ -0,0 +1,284 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaMetricsAddress = "metrics_address"
+
+	metricsNamespace = "tofu_engine"
+	metricsPath      = "/metrics"
+
+	metricsReadHeaderTimeout = 10 * time.Second
+	metricsShutdownTimeout   = 5 * time.Second
+)
+
+// lock kinds of the lock metrics
+const (
+	lockKindDownload      = "download"
+	lockKindProviderCache = "provider_cache"
+	lockKindProvider      = "provider"
+	lockKindAuditLog      = "audit_log"
+)
+
+var ErrInvalidMetricsAddress = errors.New("invalid metrics address")
+
+// metricsRegistry holds the engine metrics, next to the Go runtime and process metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+// metricsCommands are the tofu subcommands the run metrics are labeled with. Runs of other subcommands are labeled
+// otherCommand, so that clients can't create an unbounded number of series.
+var metricsCommands = []string{
+	"apply", "console", "destroy", "fmt", "force-unlock", "get", "graph", "import", "init", "login", "logout",
+	"metadata", "output", "plan", "providers", "refresh", "show", "state", "taint", "test", "untaint", "validate",
+	"version", "workspace",
+}
+
+const (
+	otherCommand = "other"
+
+	// unresolvedVersion labels the downloads which failed before the requested version was resolved to a release
+	unresolvedVersion = "unresolved"
+)
+
+var (
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "runs_total",
+		Help:      "Runs by tofu subcommand and exit code.",
+	}, []string{"command", "exit_code"})
+
+	runDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of runs by tofu subcommand, including retries and checks.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"command"})
+
+	activeRuns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_runs",
+		Help:      "Runs in progress.",
+	})
+
+	lockQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "lock_queue_depth",
+		Help:      "Operations waiting for a lock held by another process, by lock.",
+	}, []string{"lock"})
+
+	lockWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent acquiring file locks, by lock.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"lock"})
+
+	streamedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "streamed_bytes_total",
+		Help:      "Output bytes streamed to clients, by stream.",
+	}, []string{"stream"})
+
+	downloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloads_total",
+		Help:      "OpenTofu downloads by resolved version and result.",
+	}, []string{"version", "result"})
+
+	downloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_duration_seconds",
+		Help:      "Duration of OpenTofu downloads by resolved version, excluding the wait for the download lock.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"version"})
+
+	downloadCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_cache_hits_total",
+		Help:      "OpenTofu downloads served by an already installed binary, by resolved version.",
+	}, []string{"version"})
+
+	downloadCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_cache_misses_total",
+		Help:      "OpenTofu downloads which installed a new binary, by resolved version.",
+	}, []string{"version"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		runsTotal,
+		runDuration,
+		activeRuns,
+		lockQueueDepth,
+		lockWait,
+		streamedBytes,
+		downloadsTotal,
+		downloadDuration,
+		downloadCacheHits,
+		downloadCacheMisses,
+	)
+}
+
+// MetricsHandler serves the engine metrics in the Prometheus exposition format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// MetricsServer serves the engine metrics on /metrics
+type MetricsServer struct {
+	server   *http.Server
+	listener net.Listener
+	address  string
+}
+
+// StartMetricsServer starts serving the engine metrics on a host:port address
+func StartMetricsServer(address string) (*MetricsServer, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMetricsAddress, err)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, MetricsHandler())
+
+	metrics := &MetricsServer{
+		server:   &http.Server{Handler: mux, ReadHeaderTimeout: metricsReadHeaderTimeout},
+		listener: listener,
+		address:  address,
+	}
+
+	go func() {
+		if err := metrics.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+
+	log.Infof("Serving metrics at http://%s%s", listener.Addr(), metricsPath)
+
+	return metrics, nil
+}
+
+// Addr returns the address the metrics are served on
+func (m *MetricsServer) Addr() net.Addr {
+	return m.listener.Addr()
+}
+
+// Close stops the server
+func (m *MetricsServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+
+	return m.server.Shutdown(ctx)
+}
+
+// parseMetricsAddress returns the address of the metrics endpoint from Init meta, or an empty string when it is
+// disabled
+func parseMetricsAddress(meta map[string]*anypb.Any) (string, error) {
+	address := metaString(meta, metaMetricsAddress)
+	if address == "" {
+		return "", nil
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", fmt.Errorf("%w %q: %w", ErrInvalidMetricsAddress, address, err)
+	}
+
+	return address, nil
+}
+
+// setMetrics serves the metrics on address, or stops serving them when it is empty. A server already listening on
+// address is kept, so that Init runs don't interrupt scrapes.
+func (c *TofuEngine) setMetrics(address string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.metrics != nil && c.metrics.address == address {
+		return nil
+	}
+
+	if c.metrics != nil {
+		if err := c.metrics.Close(); err != nil {
+			log.Warnf("Failed to stop metrics server: %v", err)
+		}
+
+		c.metrics = nil
+	}
+
+	if address == "" {
+		return nil
+	}
+
+	metrics, err := StartMetricsServer(address)
+	if err != nil {
+		return err
+	}
+
+	c.metrics = metrics
+
+	return nil
+}
+
+// observeRun runs a Run through run and records its metrics
+func observeRun(req *tgengine.RunRequest, stream tgengine.Engine_RunServer, run func(tgengine.Engine_RunServer) error) error {
+	observed := newResultStream(stream, func(response *tgengine.RunResponse) {
+		streamedBytes.WithLabelValues("stdout").Add(float64(len(response.GetStdout())))
+		streamedBytes.WithLabelValues("stderr").Add(float64(len(response.GetStderr())))
+	})
+	command := metricsCommand(req.GetArgs())
+	start := time.Now()
+
+	activeRuns.Inc()
+	defer activeRuns.Dec()
+
+	err := run(observed)
+
+	exitCode := observed.exitCode(err)
+
+	runsTotal.WithLabelValues(command, strconv.Itoa(exitCode)).Inc()
+	runDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// metricsCommand returns the command label of a run
+func metricsCommand(args []string) string {
+	if command := subcommand(args); slices.Contains(metricsCommands, command) {
+		return command
+	}
+
+	return otherCommand
+}
+
+// observeDownload records the metrics of an OpenTofu download
+func observeDownload(version string, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	downloadsTotal.WithLabelValues(version, result).Inc()
+	downloadDuration.WithLabelValues(version).Observe(duration.Seconds())
+}
@@ -0,0 +1,133 @@
+package engine_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// metricValue scrapes the engine metrics and returns the value of a series, 0 when it doesn't exist yet
+func metricValue(t *testing.T, series string) float64 {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	engine.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), series+" "); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			require.NoError(t, err)
+
+			return parsed
+		}
+	}
+
+	return 0
+}
+
+func TestTofuEngine_RunRecordsMetrics(t *testing.T) {
+	t.Parallel()
+
+	// the metrics are shared by all tests, a subcommand no other test runs keeps the counts apart
+	const (
+		runs     = `tofu_engine_runs_total{command="providers",exit_code="3"}`
+		duration = `tofu_engine_run_duration_seconds_count{command="providers"}`
+		stdout   = `tofu_engine_streamed_bytes_total{stream="stdout"}`
+		lockWait = `tofu_engine_lock_wait_seconds_count{lock="audit_log"}`
+	)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta("audit_log_file", filepath.Join(t.TempDir(), "audit.jsonl")),
+	}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "providers output"; exit 3`))
+
+	runsBefore, durationBefore, stdoutBefore, lockWaitBefore := metricValue(t, runs), metricValue(t, duration), metricValue(t, stdout), metricValue(t, lockWait)
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"providers"}}, &MockRunServer{}))
+
+	assert.Equal(t, runsBefore+1, metricValue(t, runs))
+	assert.Equal(t, durationBefore+1, metricValue(t, duration))
+	assert.GreaterOrEqual(t, metricValue(t, stdout)-stdoutBefore, float64(len("providers output\n")))
+	assert.Equal(t, lockWaitBefore+1, metricValue(t, lockWait))
+	assert.Equal(t, float64(0), metricValue(t, "tofu_engine_active_runs"))
+}
+
+func TestTofuEngine_RunMetricsBoundCommands(t *testing.T) {
+	t.Parallel()
+
+	const runs = `tofu_engine_runs_total{command="other",exit_code="7"}`
+
+	tofuEngine := &engine.TofuEngine{}
+	tofuEngine.SetBinaryPath(fakeTofu(t, `exit 7`))
+
+	before := metricValue(t, runs)
+
+	for _, command := range []string{"made-up-command-1", "made-up-command-2"} {
+		require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{command}}, &MockRunServer{}))
+	}
+
+	// subcommands tofu doesn't know share one series
+	assert.Equal(t, before+2, metricValue(t, runs))
+	assert.Zero(t, metricValue(t, `tofu_engine_runs_total{command="made-up-command-1",exit_code="7"}`))
+}
+
+func TestTofuEngine_InitServesMetrics(t *testing.T) {
+	t.Parallel()
+
+	// reserve a free port for the metrics address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	tofuEngine := &engine.TofuEngine{}
+	meta := stringMeta("metrics_address", address)
+
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: meta}, &MockInitServer{}))
+
+	scrape := func() (string, error) {
+		response, err := http.Get("http://" + address + "/metrics")
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+
+		return string(body), err
+	}
+
+	body, err := scrape()
+	require.NoError(t, err)
+	assert.Contains(t, body, "tofu_engine_active_runs")
+	assert.Contains(t, body, "go_goroutines")
+
+	// another Init with the same address keeps the server
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: meta}, &MockInitServer{}))
+
+	_, err = scrape()
+	require.NoError(t, err)
+
+	require.NoError(t, tofuEngine.Shutdown(&tgengine.ShutdownRequest{}, &MockShutdownServer{}))
+
+	_, err = scrape()
+	require.Error(t, err)
+
+	err = (&engine.TofuEngine{}).Init(&tgengine.InitRequest{Meta: stringMeta("metrics_address", "9464")}, &MockInitServer{})
+	require.ErrorIs(t, err, engine.ErrInvalidMetricsAddress)
+}
@@ -0,0 +1,426 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaPlanStore    = "plan_store"
+	metaPlanStoreDir = "plan_store_dir"
+	metaPlanID       = "plan_id"
+
+	planCommand      = "plan"
+	applyCommand     = "apply"
+	outFlag          = "-out"
+	planFileSuffix   = ".tfplan"
+	planMetaSuffix   = ".json"
+	planStoreDirMode = 0700
+	planFileMode     = 0600
+)
+
+var (
+	ErrPlanStoreDisabled = errors.New("plan store is not enabled, set the plan_store Init meta option")
+	ErrPlanNotFound      = errors.New("plan not found in the plan store")
+	ErrPlanMismatch      = errors.New("stored plan can't be applied")
+	ErrInvalidPlanApply  = errors.New("invalid apply of a stored plan")
+
+	planIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+	// planInputSuffixes are the files whose content determines the result of a plan
+	planInputSuffixes = []string{".tf", ".tf.json", ".tfvars", ".tfvars.json", ".tofu", ".tofu.json", lockFileName}
+)
+
+// PlanMetadata describes a plan file in the plan store. The ID is the SHA-256 of the plan file.
+type PlanMetadata struct {
+	CreatedAt        time.Time `json:"created_at"`
+	ID               string    `json:"id"`
+	UnitPath         string    `json:"unit_path"`
+	BinaryVersion    string    `json:"binary_version"`
+	InputFingerprint string    `json:"input_fingerprint"`
+	Args             []string  `json:"args"`
+}
+
+// planStore is a content-addressed store of plan files with their metadata
+type planStore struct {
+	dir string
+}
+
+// parsePlanStoreDir returns the plan store directory from Init meta, or an empty string when the store is disabled
+func parsePlanStoreDir(meta map[string]*anypb.Any) (string, error) {
+	enabled, err := metaBool(meta, metaPlanStore)
+	if err != nil || !enabled {
+		return "", err
+	}
+
+	dir := metaString(meta, metaPlanStoreDir)
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get user home directory: %w", err)
+		}
+
+		dir = filepath.Join(homeDir, ".cache", "terragrunt", "tofudl", "plans")
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve plan store directory %s: %w", dir, err)
+	}
+
+	if err := os.MkdirAll(absDir, planStoreDirMode); err != nil {
+		return "", fmt.Errorf("failed to create plan store directory %s: %w", absDir, err)
+	}
+
+	return absDir, nil
+}
+
+// paths returns the plan file and metadata paths of a plan ID
+func (s planStore) paths(id string) (string, string) {
+	dir := filepath.Join(s.dir, id[:2])
+	return filepath.Join(dir, id+planFileSuffix), filepath.Join(dir, id+planMetaSuffix)
+}
+
+// save copies planFile into the store and writes its metadata, the ID is set from the plan content
+func (s planStore) save(planFile string, metadata *PlanMetadata) error {
+	content, err := os.ReadFile(planFile)
+	if err != nil {
+		return fmt.Errorf("failed to read plan file %s: %w", planFile, err)
+	}
+
+	sum := sha256.Sum256(content)
+	metadata.ID = hex.EncodeToString(sum[:])
+
+	planPath, metaPath := s.paths(metadata.ID)
+	if err := os.MkdirAll(filepath.Dir(planPath), planStoreDirMode); err != nil {
+		return fmt.Errorf("failed to create plan store directory: %w", err)
+	}
+
+	encoded, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plan metadata: %w", err)
+	}
+
+	if err := writeFileAtomic(planPath, content); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(metaPath, encoded)
+}
+
+// load returns the metadata and plan file path of a stored plan
+func (s planStore) load(id string) (*PlanMetadata, string, error) {
+	if !planIDPattern.MatchString(id) {
+		return nil, "", fmt.Errorf("%w: invalid plan ID %q", ErrPlanNotFound, id)
+	}
+
+	planPath, metaPath := s.paths(id)
+
+	encoded, err := os.ReadFile(metaPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", fmt.Errorf("%w: %s", ErrPlanNotFound, id)
+		}
+
+		return nil, "", fmt.Errorf("failed to read plan metadata %s: %w", metaPath, err)
+	}
+
+	var metadata PlanMetadata
+	if err := json.Unmarshal(encoded, &metadata); err != nil {
+		return nil, "", fmt.Errorf("failed to decode plan metadata %s: %w", metaPath, err)
+	}
+
+	if _, err := os.Stat(planPath); err != nil {
+		return nil, "", fmt.Errorf("%w: %s: %w", ErrPlanNotFound, id, err)
+	}
+
+	return &metadata, planPath, nil
+}
+
+// planRun tracks the plan store side of a plan or apply run
+type planRun struct {
+	log      *log.Entry
+	store    planStore
+	metadata *PlanMetadata
+	outFile  string
+	planFile string
+}
+
+// newPlanRun prepares a run for the plan store: a plan run with -out has its plan captured after it succeeded, and
+// an apply run with the plan_id meta option gets the stored plan after verifying that it still matches the unit.
+// A nil planRun is returned for other runs.
+func newPlanRun(req *tgengine.RunRequest, opts *runOptions, storeDir string, tofu *ExecSpec) (*planRun, error) {
+	words, _ := splitCommandArgs(req.GetArgs())
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	planID := metaString(req.GetMeta(), metaPlanID)
+
+	switch {
+	case planID != "":
+		if storeDir == "" {
+			return nil, ErrPlanStoreDisabled
+		}
+
+		if words[0] != applyCommand || len(words) > 1 {
+			return nil, fmt.Errorf("%w: the %s meta option needs an apply run without a plan file, got %v", ErrInvalidPlanApply, metaPlanID, req.GetArgs())
+		}
+
+		return prepareStoredPlan(req, opts, planStore{dir: storeDir}, planID, tofu)
+	case storeDir != "" && words[0] == planCommand:
+		outFile := planOutFile(req.GetArgs())
+		if outFile == "" {
+			return nil, nil
+		}
+
+		metadata, err := currentPlanMetadata(req, opts, tofu)
+		if err != nil {
+			return nil, err
+		}
+
+		if !filepath.IsAbs(outFile) {
+			outFile = filepath.Join(metadata.UnitPath, outFile)
+		}
+
+		return &planRun{log: opts.log, store: planStore{dir: storeDir}, metadata: metadata, outFile: outFile}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// prepareStoredPlan verifies a stored plan against the unit and copies it where the apply run reads it
+func prepareStoredPlan(req *tgengine.RunRequest, opts *runOptions, store planStore, id string, tofu *ExecSpec) (*planRun, error) {
+	stored, storedFile, err := store.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := currentPlanMetadata(req, opts, tofu)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case stored.UnitPath != current.UnitPath:
+		return nil, fmt.Errorf("%w: plan %s was created for %s, not %s", ErrPlanMismatch, id, stored.UnitPath, current.UnitPath)
+	case stored.BinaryVersion != current.BinaryVersion:
+		return nil, fmt.Errorf("%w: plan %s was created by OpenTofu %s, the engine runs %s", ErrPlanMismatch, id, stored.BinaryVersion, current.BinaryVersion)
+	case stored.InputFingerprint != current.InputFingerprint:
+		return nil, fmt.Errorf("%w: the configuration of %s changed since plan %s was created", ErrPlanMismatch, current.UnitPath, id)
+	}
+
+	// the plan is placed in the unit, which stays reachable when tofu runs in a sandbox
+	planFile := filepath.Join(current.UnitPath, "terragrunt-engine-"+id[:12]+planFileSuffix)
+
+	content, err := os.ReadFile(storedFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stored plan %s: %w", storedFile, err)
+	}
+
+	if err := os.WriteFile(planFile, content, planFileMode); err != nil {
+		return nil, fmt.Errorf("failed to write plan file %s: %w", planFile, err)
+	}
+
+	opts.log.Infof("Applying stored plan %s created at %s", id, stored.CreatedAt.Format(time.RFC3339))
+
+	return &planRun{log: opts.log, store: store, metadata: stored, planFile: planFile}, nil
+}
+
+// currentPlanMetadata describes the unit of a run as it is now, with the version of the tofu the run executes
+func currentPlanMetadata(req *tgengine.RunRequest, opts *runOptions, tofu *ExecSpec) (*PlanMetadata, error) {
+	unitPath := moduleDir(opts.workingDir, req.GetArgs())
+
+	version, err := tofuVersion(opts.executor, tofu)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := computePlanFingerprint(unitPath, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PlanMetadata{
+		CreatedAt:        time.Now().UTC(),
+		UnitPath:         unitPath,
+		BinaryVersion:    version,
+		InputFingerprint: fingerprint,
+		Args:             req.GetArgs(),
+	}, nil
+}
+
+// finish stores the plan of a successful plan run, or removes the plan file written for an apply run.
+// The ID of the stored plan is returned.
+func (p *planRun) finish(resultCode int) (string, error) {
+	if p.planFile != "" {
+		if err := os.Remove(p.planFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			p.log.Warnf("Failed to remove plan file %s: %v", p.planFile, err)
+		}
+
+		return p.metadata.ID, nil
+	}
+
+	if resultCode != 0 {
+		return "", nil
+	}
+
+	if err := p.store.save(p.outFile, p.metadata); err != nil {
+		return "", err
+	}
+
+	p.log.Infof("Stored plan %s of %s", p.metadata.ID, p.metadata.UnitPath)
+
+	return p.metadata.ID, nil
+}
+
+// planOutFile returns the plan file of a -out argument, or an empty string
+func planOutFile(args []string) string {
+	for i, arg := range args {
+		if value, found := strings.CutPrefix(arg, outFlag+"="); found {
+			return value
+		}
+
+		if value, found := strings.CutPrefix(arg, "-"+outFlag+"="); found {
+			return value
+		}
+
+		if (arg == outFlag || arg == "-"+outFlag) && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return ""
+}
+
+// tofuVersion returns the version reported by `tofu version -json`, run by executor like the tofu process of spec
+func tofuVersion(executor Executor, spec *ExecSpec) (string, error) {
+	versionSpec := *spec
+	versionSpec.Args = []string{"version", jsonFlag}
+	versionSpec.TTY = false
+	versionSpec.Capture = true
+
+	exitCode, output, stderr, err := runProcess(context.Background(), executor, &versionSpec)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d: %s", exitCode, strings.TrimSpace(string(stderr)))
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get the OpenTofu version: %w", err)
+	}
+
+	var version struct {
+		Version string `json:"terraform_version"`
+	}
+
+	if err := json.Unmarshal(output, &version); err != nil || version.Version == "" {
+		return "", fmt.Errorf("failed to parse the OpenTofu version from %q", strings.TrimSpace(string(output)))
+	}
+
+	return version.Version, nil
+}
+
+// computePlanFingerprint hashes the configuration, variable and lock files of a unit, skipping hidden directories
+// such as .terraform, and the selected workspace
+func computePlanFingerprint(unitPath string, req *tgengine.RunRequest) (string, error) {
+	var files []string
+
+	err := filepath.WalkDir(unitPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if path != unitPath && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		for _, suffix := range planInputSuffixes {
+			if strings.HasSuffix(entry.Name(), suffix) {
+				files = append(files, path)
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read configuration of %s: %w", unitPath, err)
+	}
+
+	sort.Strings(files)
+
+	hasher := sha256.New()
+
+	for _, file := range files {
+		rel, err := filepath.Rel(unitPath, file)
+		if err != nil {
+			return "", err
+		}
+
+		if err := hashFile(hasher, rel, file); err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Fprintf(hasher, "env\x00TF_WORKSPACE=%s\x00", requestEnv(req, "TF_WORKSPACE"))
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// tempPlanFile creates an empty plan file in dir for tofu to save a plan to, pattern is as for os.CreateTemp
+func tempPlanFile(dir, pattern string) (string, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// writeFileAtomic writes a file through a temporary file in the same directory, so readers never see partial content
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	_, err = tmp.Write(content)
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
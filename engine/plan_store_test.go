@@ -0,0 +1,120 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// planTofu fakes tofu version, plan -out and apply of a plan file
+func planTofu(t *testing.T, version string) string {
+	t.Helper()
+
+	return fakeTofu(t, `case "$1" in
+version) echo '{"terraform_version":"`+version+`"}' ;;
+plan) echo "plan of $(cat main.tf)" > "${2#-out=}" ;;
+apply) echo "applying $2"; cat "$2" ;;
+esac
+`)
+}
+
+func TestTofuEngine_RunPlanStore(t *testing.T) {
+	t.Parallel()
+
+	workingDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "main.tf"), []byte(`resource "null_resource" "a" {}`), 0644))
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("plan_store", "true", "plan_store_dir", t.TempDir())}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(planTofu(t, "1.9.0"))
+
+	run := func(args []string, meta ...string) (*MockRunServer, error) {
+		t.Helper()
+
+		mockStream := &MockRunServer{}
+		err := tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: args, Meta: stringMeta(meta...)}, mockStream)
+
+		return mockStream, err
+	}
+
+	mockStream, err := run([]string{"plan", "-out=tfplan"})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+	match := regexp.MustCompile(`Stored plan ([0-9a-f]{64})`).FindStringSubmatch(stdout(mockStream.Responses))
+	require.NotNil(t, match, stdout(mockStream.Responses))
+
+	planID := match[1]
+
+	mockStream, err = run([]string{"apply"}, "plan_id", planID)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+	assert.Contains(t, stdout(mockStream.Responses), `plan of resource "null_resource" "a" {}`)
+
+	// the plan file written for the apply is removed afterwards
+	planFiles, err := filepath.Glob(filepath.Join(workingDir, "terragrunt-engine-*.tfplan"))
+	require.NoError(t, err)
+	assert.Empty(t, planFiles)
+
+	_, err = run([]string{"apply"}, "plan_id", "0000000000000000000000000000000000000000000000000000000000000000")
+	require.ErrorIs(t, err, engine.ErrPlanNotFound)
+
+	_, err = run([]string{"apply", "tfplan"}, "plan_id", planID)
+	require.ErrorIs(t, err, engine.ErrInvalidPlanApply)
+
+	// a different OpenTofu version
+	tofuEngine.SetBinaryPath(planTofu(t, "1.10.0"))
+
+	mockStream, err = run([]string{"apply"}, "plan_id", planID)
+	require.ErrorIs(t, err, engine.ErrPlanMismatch)
+	assert.Contains(t, stderr(mockStream.Responses), "created by OpenTofu 1.9.0, the engine runs 1.10.0")
+
+	// a changed configuration
+	tofuEngine.SetBinaryPath(planTofu(t, "1.9.0"))
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "main.tf"), []byte(`resource "null_resource" "b" {}`), 0644))
+
+	mockStream, err = run([]string{"apply"}, "plan_id", planID)
+	require.ErrorIs(t, err, engine.ErrPlanMismatch)
+	assert.Contains(t, stderr(mockStream.Responses), "changed since plan")
+}
+
+func TestTofuEngine_RunPlanIDWithoutStore(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	tofuEngine.SetBinaryPath(planTofu(t, "1.9.0"))
+
+	err := tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"apply"}, Meta: stringMeta("plan_id", "abc")}, &MockRunServer{})
+	require.ErrorIs(t, err, engine.ErrPlanStoreDisabled)
+}
+
+func TestTofuEngine_RunPlanStoreExecutor(t *testing.T) {
+	t.Parallel()
+
+	docker := &fakeDocker{images: map[string]bool{"example/tofu:1.9": true}, stdout: `{"terraform_version":"1.9.0"}` + "\n"}
+	host := startFakeDocker(t, docker)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta("plan_store", "true", "plan_store_dir", t.TempDir(), "executor", "docker", "docker_host", host, "docker_image", "example/tofu:1.9"),
+	}, &MockInitServer{}))
+
+	// the binary of the engine host reports another version, it must not be run
+	binaryPath := planTofu(t, "1.10.0")
+	tofuEngine.SetBinaryPath(binaryPath)
+
+	_ = tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"plan", "-out=tfplan"}}, &MockRunServer{})
+
+	docker.mu.Lock()
+	defer docker.mu.Unlock()
+
+	require.Len(t, docker.created, 2)
+	assert.Equal(t, []string{binaryPath, "version", "-json"}, docker.created[0].Cmd)
+	assert.Equal(t, []string{binaryPath, "plan", "-out=tfplan"}, docker.created[1].Cmd)
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"os/exec"
+
+	tgplugin "github.com/gruntwork-io/terragrunt-engine-go/engine"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+)
+
+// PluginName is the name the engine is dispensed under by go-plugin
+const PluginName = "tofu"
+
+// PluginHandshake is the go-plugin handshake between Terragrunt and the engine
+var PluginHandshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "engine",
+	MagicCookieValue: "terragrunt",
+}
+
+// PluginServeConfig returns the go-plugin configuration which serves the engine as a plugin. The health of the
+// engine is reported from the Shutdown RPC until the next Init as NOT_SERVING. When the client
+// enables AutoMTLS, go-plugin passes its certificate to the plugin and the connection uses mutual TLS.
+func PluginServeConfig(logger hclog.Logger) *plugin.ServeConfig {
+	engine := &TofuEngine{}
+	engine.health = newEngineHealth(engine)
+
+	return &plugin.ServeConfig{
+		Logger:          logger,
+		HandshakeConfig: PluginHandshake,
+		Plugins: map[string]plugin.Plugin{
+			PluginName: &tgplugin.TerragruntGRPCEngine{Impl: engine},
+		},
+		// go-plugin registers the grpc.health.v1 and reflection services, the engine answers the health checks
+		// of its own services
+		GRPCServer: func(opts []grpc.ServerOption) *grpc.Server {
+			return plugin.DefaultGRPCServer(append(opts, engine.health.serverOptions()...))
+		},
+	}
+}
+
+// NewPluginClient returns a go-plugin client which starts the engine binary of cmd. The connection to the engine
+// is secured with AutoMTLS: go-plugin generates a certificate for each side and both verify the other.
+func NewPluginClient(cmd *exec.Cmd, logger hclog.Logger) *plugin.Client {
+	return plugin.NewClient(&plugin.ClientConfig{
+		Logger:          logger,
+		HandshakeConfig: PluginHandshake,
+		Plugins: map[string]plugin.Plugin{
+			PluginName: &tgplugin.TerragruntGRPCEngine{},
+		},
+		Cmd:              cmd,
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
+		AutoMTLS:         true,
+	})
+}
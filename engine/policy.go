@@ -0,0 +1,332 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaPolicyDir = "policy_dir"
+
+	// EventTypePolicyCheck is the type of the event record with the violations found by the policy check of a plan
+	EventTypePolicyCheck = "policy_check"
+
+	showCommand      = "show"
+	celPolicySuffix  = ".hcl"
+	celRuleBlockType = "rule"
+)
+
+var (
+	ErrInvalidPolicy     = errors.New("invalid policy")
+	ErrPolicyCheckFailed = errors.New("policy check failed")
+
+	policyLoadersMu sync.RWMutex
+
+	// policyLoaders are the policy loaders by file extension
+	policyLoaders = map[string]PolicyLoader{celPolicySuffix: loadCELPolicy}
+)
+
+// Plan is the part of the `tofu show -json` output of a plan which the engine evaluates
+type Plan struct {
+	FormatVersion    string           `json:"format_version"`
+	TerraformVersion string           `json:"terraform_version"`
+	ResourceChanges  []ResourceChange `json:"resource_changes"`
+	ResourceDrift    []ResourceChange `json:"resource_drift,omitempty"`
+}
+
+// ResourceChange is a planned change of a single resource instance
+type ResourceChange struct {
+	Change        Change `json:"change"`
+	Address       string `json:"address"`
+	ModuleAddress string `json:"module_address,omitempty"`
+	Mode          string `json:"mode"`
+	Type          string `json:"type"`
+	Name          string `json:"name"`
+	ProviderName  string `json:"provider_name"`
+}
+
+// Change describes the actions and values of a resource change
+type Change struct {
+	Before  any      `json:"before"`
+	After   any      `json:"after"`
+	Actions []string `json:"actions"`
+}
+
+// PolicyViolation is a resource change which violates a policy rule
+type PolicyViolation struct {
+	Policy  string `json:"policy"`
+	Rule    string `json:"rule"`
+	Address string `json:"address,omitempty"`
+	Message string `json:"message"`
+}
+
+// PolicyEvaluator evaluates the rules of a policy against a plan
+type PolicyEvaluator interface {
+	Evaluate(plan *Plan) ([]PolicyViolation, error)
+}
+
+// PolicyLoader creates the evaluator of a policy file from its path and content
+type PolicyLoader func(path string, src []byte) (PolicyEvaluator, error)
+
+// RegisterPolicyLoader registers the loader of policy files with the given extension, e.g. ".rego", so that other
+// policy languages can be plugged in. Policy files with the .hcl extension hold CEL rules.
+func RegisterPolicyLoader(extension string, loader PolicyLoader) {
+	policyLoadersMu.Lock()
+	defer policyLoadersMu.Unlock()
+
+	policyLoaders[extension] = loader
+}
+
+// policy is a loaded policy file
+type policy struct {
+	evaluator PolicyEvaluator
+	name      string
+}
+
+// parsePolicies loads the policies of the policy directory from Init meta. Files without a registered loader are ignored.
+func parsePolicies(meta map[string]*anypb.Any) ([]policy, error) {
+	dir := metaString(meta, metaPolicyDir)
+	if dir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read policy directory %s: %w", ErrInvalidPolicy, dir, err)
+	}
+
+	policyLoadersMu.RLock()
+	defer policyLoadersMu.RUnlock()
+
+	var policies []policy
+
+	for _, entry := range entries {
+		loader, exists := policyLoaders[filepath.Ext(entry.Name())]
+		if entry.IsDir() || !exists {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrInvalidPolicy, path, err)
+		}
+
+		evaluator, err := loader(path, src)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrInvalidPolicy, path, err)
+		}
+
+		policies = append(policies, policy{name: entry.Name(), evaluator: evaluator})
+	}
+
+	if len(policies) == 0 {
+		return nil, fmt.Errorf("%w: no policies in %s", ErrInvalidPolicy, dir)
+	}
+
+	return policies, nil
+}
+
+// evaluatePolicies evaluates every policy against the plan, violations are sorted by policy, rule and address
+func evaluatePolicies(policies []policy, plan *Plan) ([]PolicyViolation, error) {
+	violations := []PolicyViolation{}
+
+	for _, policy := range policies {
+		found, err := policy.evaluator.Evaluate(plan)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrPolicyCheckFailed, policy.name, err)
+		}
+
+		for _, violation := range found {
+			if violation.Policy == "" {
+				violation.Policy = policy.name
+			}
+
+			violations = append(violations, violation)
+		}
+	}
+
+	sort.SliceStable(violations, func(i, j int) bool {
+		a, b := violations[i], violations[j]
+		if a.Policy != b.Policy {
+			return a.Policy < b.Policy
+		}
+
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+
+		return a.Address < b.Address
+	})
+
+	return violations, nil
+}
+
+// checkPlanPolicies evaluates the policies against the plan file of a plan run
+func (c *TofuEngine) checkPlanPolicies(req *tgengine.RunRequest, opts *runOptions, policies []policy, planFile string) ([]PolicyViolation, error) {
+	plan, err := c.showPlan(req, opts, planFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPolicyCheckFailed, err)
+	}
+
+	return evaluatePolicies(policies, plan)
+}
+
+// showPlan renders a plan file with `tofu show -json`
+func (c *TofuEngine) showPlan(req *tgengine.RunRequest, opts *runOptions, planFile string) (*Plan, error) {
+	output, err := c.capture(req, opts, showCommand, jsonFlag, planFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan Plan
+	if err := json.Unmarshal(output, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan %s: %w", planFile, err)
+	}
+
+	return &plan, nil
+}
+
+// renderViolations renders policy violations as human readable text
+func renderViolations(violations []PolicyViolation) string {
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, "Policy check failed with %d violation(s):\n", len(violations))
+
+	for _, violation := range violations {
+		fmt.Fprintf(&builder, "  - [%s/%s] ", violation.Policy, violation.Rule)
+
+		if violation.Address != "" {
+			fmt.Fprintf(&builder, "%s: ", violation.Address)
+		}
+
+		builder.WriteString(violation.Message)
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// celRule is a rule of a CEL policy: the condition is evaluated for every resource change and a change for which
+// it is true violates the rule
+type celRule struct {
+	program cel.Program
+	name    string
+	message string
+}
+
+// celPolicy evaluates the CEL rules of a policy file
+type celPolicy struct {
+	rules []celRule
+}
+
+// loadCELPolicy parses a policy file of rule blocks, e.g.
+//
+//	rule "no_db_deletes" {
+//	  condition = "resource.type == 'aws_db_instance' && 'delete' in resource.change.actions"
+//	  message   = "Databases must not be deleted"
+//	}
+func loadCELPolicy(path string, src []byte) (PolicyEvaluator, error) {
+	file, diags := hclsyntax.ParseConfig(src, path, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	body, ok := file.Body.(*hclsyntax.Body)
+	if !ok {
+		return nil, errors.New("unexpected policy file body")
+	}
+
+	env, err := cel.NewEnv(cel.Variable("resource", cel.DynType))
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &celPolicy{}
+
+	for _, block := range body.Blocks {
+		if block.Type != celRuleBlockType || len(block.Labels) != 1 {
+			return nil, fmt.Errorf("%s: expected rule blocks with a name", block.DefRange())
+		}
+
+		rule := celRule{name: block.Labels[0], message: literalAttribute(block.Body, "message")}
+
+		condition := literalAttribute(block.Body, "condition")
+		if condition == "" {
+			return nil, fmt.Errorf("rule %s: condition must be a non-empty string", rule.name)
+		}
+
+		ast, issues := env.Compile(condition)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.name, issues.Err())
+		}
+
+		if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+			return nil, fmt.Errorf("rule %s: condition must be a boolean, got %s", rule.name, ast.OutputType())
+		}
+
+		if rule.program, err = env.Program(ast); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.name, err)
+		}
+
+		if rule.message == "" {
+			rule.message = fmt.Sprintf("violates rule %s", rule.name)
+		}
+
+		policy.rules = append(policy.rules, rule)
+	}
+
+	return policy, nil
+}
+
+// Evaluate implements PolicyEvaluator
+func (p *celPolicy) Evaluate(plan *Plan) ([]PolicyViolation, error) {
+	var violations []PolicyViolation
+
+	for _, change := range plan.ResourceChanges {
+		resource := map[string]any{
+			"address":        change.Address,
+			"module_address": change.ModuleAddress,
+			"mode":           change.Mode,
+			"type":           change.Type,
+			"name":           change.Name,
+			"provider_name":  change.ProviderName,
+			"change": map[string]any{
+				"actions": change.Change.Actions,
+				"before":  change.Change.Before,
+				"after":   change.Change.After,
+			},
+		}
+
+		for _, rule := range p.rules {
+			value, _, err := rule.program.Eval(map[string]any{"resource": resource})
+			if err != nil {
+				return nil, fmt.Errorf("rule %s on %s: %w", rule.name, change.Address, err)
+			}
+
+			violated, ok := value.Value().(bool)
+			if !ok {
+				return nil, fmt.Errorf("rule %s on %s: condition returned %v instead of a boolean", rule.name, change.Address, value)
+			}
+
+			if violated {
+				violations = append(violations, PolicyViolation{Rule: rule.name, Address: change.Address, Message: rule.message})
+			}
+		}
+	}
+
+	return violations, nil
+}
@@ -0,0 +1,86 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dbPolicy = `rule "no_db_deletes" {
+  condition = "resource.type == 'aws_db_instance' && 'delete' in resource.change.actions"
+  message   = "Databases must not be deleted"
+}
+
+rule "no_public_buckets" {
+  condition = "resource.type == 'aws_s3_bucket' && has(resource.change.after.acl) && resource.change.after.acl == 'public-read'"
+  message   = "Buckets must not be public"
+}
+`
+
+// policyTofu fakes a plan which replaces a database and creates a private bucket
+const policyTofu = `case "$1" in
+plan) echo plan > "${2#-out=}" ;;
+show) cat <<'JSON'
+{"format_version": "1.2", "resource_changes": [
+  {"address": "aws_db_instance.main", "type": "aws_db_instance", "name": "main", "change": {"actions": ["delete", "create"], "before": {}, "after": {}}},
+  {"address": "aws_s3_bucket.logs", "type": "aws_s3_bucket", "name": "logs", "change": {"actions": ["create"], "before": null, "after": {"acl": "private"}}}
+]}
+JSON
+;;
+esac
+`
+
+func TestTofuEngine_RunChecksPlanPolicies(t *testing.T) {
+	t.Parallel()
+
+	policyDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(policyDir, "database.hcl"), []byte(dbPolicy), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(policyDir, "README.md"), []byte("ignored"), 0644))
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("policy_dir", policyDir)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, policyTofu))
+
+	workingDir := t.TempDir()
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"plan", "-out=tfplan"}, Meta: stringMeta("run_report", "true")}, mockStream))
+
+	assert.Equal(t, int32(1), resultCode(mockStream.Responses))
+	assert.Contains(t, stderr(mockStream.Responses), "[database.hcl/no_db_deletes] aws_db_instance.main: Databases must not be deleted")
+	assert.NotContains(t, stderr(mockStream.Responses), "no_public_buckets")
+
+	var event *engine.Event
+
+	for _, response := range mockStream.Responses {
+		if parsed, ok := engine.ParseEventRecord(response.GetStdout()); ok && parsed.Type == engine.EventTypePolicyCheck {
+			event = parsed
+		}
+	}
+
+	require.NotNil(t, event)
+	require.Len(t, event.Violations, 1)
+	assert.Equal(t, engine.PolicyViolation{Policy: "database.hcl", Rule: "no_db_deletes", Address: "aws_db_instance.main", Message: "Databases must not be deleted"}, event.Violations[0])
+
+	// the violating plan can't be applied
+	_, err := os.Stat(filepath.Join(workingDir, "tfplan"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTofuEngine_InitRejectsInvalidPolicy(t *testing.T) {
+	t.Parallel()
+
+	policyDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(policyDir, "broken.hcl"), []byte(`rule "broken" { condition = "resource.type ==" }`), 0644))
+
+	tofuEngine := &engine.TofuEngine{}
+	err := tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("policy_dir", policyDir)}, &MockInitServer{})
+	require.ErrorIs(t, err, engine.ErrInvalidPolicy)
+
+	err = tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("policy_dir", t.TempDir())}, &MockInitServer{})
+	require.ErrorIs(t, err, engine.ErrInvalidPolicy)
+}
@@ -0,0 +1,534 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	log "github.com/sirupsen/logrus"
+	"github.com/zclconf/go-cty/cty"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaProviderCache    = "provider_cache"
+	metaProviderCacheDir = "provider_cache_dir"
+
+	defaultProviderHost   = "registry.opentofu.org"
+	providerCacheLockName = "cache.lock"
+
+	// providerCacheMarkerName marks a directory as a provider cache managed by the engine, only marked caches are
+	// listed and pruned
+	providerCacheMarkerName = ".terragrunt-engine-provider-cache"
+
+	// providerUseDirName holds a file per provider version in the lock directory of a cache, touched whenever a unit
+	// which locks that version runs
+	providerUseDirName = "used"
+
+	providerCacheFileMode = 0644
+
+	// provider cache layout: <host>/<namespace>/<type>/<version>/<os_arch>
+	providerCacheDepth = 5
+)
+
+var ErrNotProviderCache = errors.New("not a provider cache managed by the engine")
+
+// CachedProvider is a provider version stored in the provider cache
+type CachedProvider struct {
+	ModTime time.Time
+	// LastUsed is the last time a unit locking this version ran, or ModTime when it is later
+	LastUsed  time.Time
+	Address   string
+	Version   string
+	Path      string
+	Platforms []string
+	Size      int64
+}
+
+// DefaultProviderCacheDir returns the provider cache managed by the engine, next to the OpenTofu download cache
+func DefaultProviderCacheDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+
+	return filepath.Join(homeDir, ".cache", "terragrunt", "tofudl", "providers"), nil
+}
+
+// parseProviderCacheDir returns the managed provider cache from Init meta, or an empty string when it is disabled
+func parseProviderCacheDir(meta map[string]*anypb.Any) (string, error) {
+	enabled, err := metaBool(meta, metaProviderCache)
+	if err != nil || !enabled {
+		return "", err
+	}
+
+	dir := metaString(meta, metaProviderCacheDir)
+	if dir == "" {
+		if dir, err = DefaultProviderCacheDir(); err != nil {
+			return "", err
+		}
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve provider cache directory %s: %w", dir, err)
+	}
+
+	if err := os.MkdirAll(absDir, installDirMode); err != nil {
+		return "", fmt.Errorf("failed to create provider cache directory %s: %w", absDir, err)
+	}
+
+	marker := filepath.Join(absDir, providerCacheMarkerName)
+	if _, err := os.Stat(marker); errors.Is(err, fs.ErrNotExist) {
+		if err := os.WriteFile(marker, nil, providerCacheFileMode); err != nil {
+			return "", fmt.Errorf("failed to mark provider cache directory %s: %w", absDir, err)
+		}
+	}
+
+	return absDir, nil
+}
+
+// checkProviderCache verifies that dir is a provider cache managed by the engine, so that listing and pruning never
+// touch other directories
+func checkProviderCache(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, providerCacheMarkerName)); err != nil {
+		return fmt.Errorf("%w: %s has no %s file", ErrNotProviderCache, dir, providerCacheMarkerName)
+	}
+
+	return nil
+}
+
+// providerCacheLockDir returns the directory holding the locks of a provider cache. Locks live in the engine
+// lock directory rather than the cache itself, where tofu would take them for providers.
+func providerCacheLockDir(cacheDir string) (string, error) {
+	lockDir, err := getDefaultLockDir()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(cacheDir))
+	dir := filepath.Join(lockDir, "providers-"+hex.EncodeToString(sum[:])[:12])
+
+	if err := os.MkdirAll(dir, installDirMode); err != nil {
+		return "", fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	return dir, nil
+}
+
+// lockProviderCache serializes the population of the provider cache by an init of moduleDir.
+// When the lock file pins every provider the module requires, only those provider versions are locked and other
+// inits proceed concurrently. Otherwise the providers to be installed are unknown and the whole cache is locked.
+// The returned function releases the locks.
+func lockProviderCache(logger *log.Entry, cacheDir, moduleDir string, upgrade bool) (func(), error) {
+	lockDir, err := providerCacheLockDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	providers, complete := lockedProviders(moduleDir)
+
+	if upgrade || !complete {
+		logger.Debugf("Locking provider cache %s for init in %s", cacheDir, moduleDir)
+		return acquireFileLock(lockKindProviderCache, filepath.Join(lockDir, providerCacheLockName), false)
+	}
+
+	unlockCache, err := acquireFileLock(lockKindProviderCache, filepath.Join(lockDir, providerCacheLockName), true)
+	if err != nil {
+		return nil, err
+	}
+
+	unlocks := []func(){unlockCache}
+
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	// providers are sorted, so concurrent inits acquire their locks in the same order
+	for _, provider := range providers {
+		logger.Debugf("Locking provider %s in cache %s", provider, cacheDir)
+
+		unlock, err := acquireFileLock(lockKindProvider, filepath.Join(lockDir, providerLockName(provider)), false)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+
+		unlocks = append(unlocks, unlock)
+	}
+
+	return unlockAll, nil
+}
+
+// providerLockName returns the lock file name of a provider version, e.g. registry.opentofu.org_hashicorp_null_3.2.1.lock
+func providerLockName(provider string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(provider) + ".lock"
+}
+
+// lockedProviders returns the sorted "<address>/<version>" entries of the lock file of moduleDir, and whether they
+// cover every provider in the required_providers of the module
+func lockedProviders(moduleDir string) ([]string, bool) {
+	src, err := os.ReadFile(filepath.Join(moduleDir, lockFileName))
+	if err != nil {
+		return nil, false
+	}
+
+	file, diags := hclsyntax.ParseConfig(src, lockFileName, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, false
+	}
+
+	body, ok := file.Body.(*hclsyntax.Body)
+	if !ok {
+		return nil, false
+	}
+
+	var providers []string
+
+	addresses := map[string]bool{}
+
+	for _, block := range body.Blocks {
+		if block.Type != "provider" || len(block.Labels) == 0 {
+			continue
+		}
+
+		version := literalAttribute(block.Body, "version")
+		if version == "" {
+			return nil, false
+		}
+
+		address := normalizeProviderSource(block.Labels[0])
+		addresses[address] = true
+		providers = append(providers, address+"/"+version)
+	}
+
+	sort.Strings(providers)
+
+	for _, source := range requiredProviderSources(moduleDir) {
+		if !addresses[source] {
+			return providers, false
+		}
+	}
+
+	return providers, true
+}
+
+// requiredProviderSources returns the normalized provider sources from the required_providers blocks of a module.
+// An unparsable configuration yields a source which can never be locked, init reports the errors.
+func requiredProviderSources(moduleDir string) []string {
+	files, _, err := configFiles(moduleDir)
+	if err != nil {
+		return nil
+	}
+
+	var sources []string
+
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return []string{file}
+		}
+
+		parsed, diags := hclsyntax.ParseConfig(src, file, hcl.InitialPos)
+		if diags.HasErrors() {
+			return []string{file}
+		}
+
+		body, ok := parsed.Body.(*hclsyntax.Body)
+		if !ok {
+			continue
+		}
+
+		for _, block := range body.Blocks {
+			if block.Type != "terraform" {
+				continue
+			}
+
+			for _, nested := range block.Body.Blocks {
+				if nested.Type != "required_providers" {
+					continue
+				}
+
+				for name, attr := range nested.Body.Attributes {
+					source := name
+
+					if object, ok := attr.Expr.(*hclsyntax.ObjectConsExpr); ok {
+						for _, item := range object.Items {
+							if stringValue(item.KeyExpr) == "source" {
+								if value := stringValue(item.ValueExpr); value != "" {
+									source = value
+								}
+							}
+						}
+					}
+
+					sources = append(sources, normalizeProviderSource(source))
+				}
+			}
+		}
+	}
+
+	return sources
+}
+
+// literalAttribute returns the value of a string literal attribute, or an empty string
+func literalAttribute(body *hclsyntax.Body, name string) string {
+	attr, exists := body.Attributes[name]
+	if !exists {
+		return ""
+	}
+
+	return stringValue(attr.Expr)
+}
+
+// stringValue returns the value of a constant string expression, or an empty string
+func stringValue(expr hclsyntax.Expression) string {
+	value, diags := expr.Value(nil)
+	if diags.HasErrors() || value.Type() != cty.String || value.IsNull() || !value.IsKnown() {
+		return ""
+	}
+
+	return value.AsString()
+}
+
+// normalizeProviderSource returns the fully qualified, lower case address of a provider source
+func normalizeProviderSource(source string) string {
+	source = strings.ToLower(strings.TrimSpace(source))
+
+	switch strings.Count(source, "/") {
+	case 0:
+		return defaultProviderHost + "/hashicorp/" + source
+	case 1:
+		return defaultProviderHost + "/" + source
+	default:
+		return source
+	}
+}
+
+// ListCachedProviders returns the provider versions stored in the provider cache at dir
+func ListCachedProviders(dir string) ([]CachedProvider, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve provider cache directory %s: %w", dir, err)
+	}
+
+	if err := checkProviderCache(dir); err != nil {
+		return nil, err
+	}
+
+	lockDir, err := providerCacheLockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	versionDirs, err := filepath.Glob(filepath.Join(dir, "*", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	providers := make([]CachedProvider, 0, len(versionDirs))
+
+	for _, versionDir := range versionDirs {
+		info, err := os.Stat(versionDir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		rel, err := filepath.Rel(dir, versionDir)
+		if err != nil {
+			return nil, err
+		}
+
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		provider := CachedProvider{
+			Address: strings.Join(parts[:3], "/"),
+			Version: parts[3],
+			Path:    versionDir,
+			ModTime: info.ModTime(),
+		}
+
+		err = filepath.WalkDir(versionDir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			if info.ModTime().After(provider.ModTime) {
+				provider.ModTime = info.ModTime()
+			}
+
+			if entry.IsDir() {
+				if depth := strings.Count(filepath.ToSlash(strings.TrimPrefix(path, dir)), "/"); depth == providerCacheDepth {
+					provider.Platforms = append(provider.Platforms, entry.Name())
+				}
+
+				return nil
+			}
+
+			provider.Size += info.Size()
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cached provider %s: %w", versionDir, err)
+		}
+
+		provider.LastUsed = provider.ModTime
+
+		usage, err := os.Stat(filepath.Join(lockDir, providerUseDirName, providerLockName(provider.Address+"/"+provider.Version)))
+		if err == nil && usage.ModTime().After(provider.LastUsed) {
+			provider.LastUsed = usage.ModTime()
+		}
+
+		providers = append(providers, provider)
+	}
+
+	sort.Slice(providers, func(i, j int) bool {
+		if providers[i].Address != providers[j].Address {
+			return providers[i].Address < providers[j].Address
+		}
+
+		return providers[i].Version < providers[j].Version
+	})
+
+	return providers, nil
+}
+
+// PruneCachedProviders removes the provider versions of the cache at dir which weren't used for olderThan.
+// The whole cache is locked, so no init populates it meanwhile. With dryRun nothing is removed.
+// The pruned provider versions are returned.
+func PruneCachedProviders(dir string, olderThan time.Duration, dryRun bool) ([]CachedProvider, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve provider cache directory %s: %w", dir, err)
+	}
+
+	if err := checkProviderCache(absDir); err != nil {
+		return nil, err
+	}
+
+	lockDir, err := providerCacheLockDir(absDir)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := acquireFileLock(lockKindProviderCache, filepath.Join(lockDir, providerCacheLockName), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock provider cache %s: %w", absDir, err)
+	}
+	defer unlock()
+
+	providers, err := ListCachedProviders(absDir)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+
+	var pruned []CachedProvider
+
+	for _, provider := range providers {
+		if provider.LastUsed.After(cutoff) {
+			continue
+		}
+
+		if !dryRun {
+			if err := os.RemoveAll(provider.Path); err != nil {
+				return pruned, fmt.Errorf("failed to remove cached provider %s: %w", provider.Path, err)
+			}
+
+			removeEmptyParents(filepath.Dir(provider.Path), absDir)
+		}
+
+		pruned = append(pruned, provider)
+	}
+
+	return pruned, nil
+}
+
+// removeEmptyParents removes dir and its parents up to, but excluding, root while they are empty
+func removeEmptyParents(dir, root string) {
+	for dir != root && isWithin(dir, root) {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+// lockProviderCacheForRun locks the managed provider cache for runs which install providers into it.
+// Like downloads, runs continue without locking when the locks can't be taken. The returned function releases the locks.
+func lockProviderCacheForRun(req *tgengine.RunRequest, opts *runOptions) func() {
+	words, flags := splitCommandArgs(req.GetArgs())
+	if opts.providerCacheDir == "" || len(words) == 0 || words[0] != initCommand {
+		return func() {}
+	}
+
+	unlock, err := lockProviderCache(opts.log, opts.providerCacheDir, moduleDir(opts.workingDir, req.GetArgs()), slices.Contains(flags, upgradeFlag))
+	if err != nil {
+		opts.log.Warnf("Failed to lock provider cache %s, continuing without locking: %v", opts.providerCacheDir, err)
+		return func() {}
+	}
+
+	return unlock
+}
+
+// recordProviderCacheUse marks the provider versions locked by the module of a run as used, so that pruning keeps the
+// providers which initialized units link to
+func recordProviderCacheUse(req *tgengine.RunRequest, opts *runOptions) {
+	if opts.providerCacheDir == "" {
+		return
+	}
+
+	providers, _ := lockedProviders(moduleDir(opts.workingDir, req.GetArgs()))
+	if len(providers) == 0 {
+		return
+	}
+
+	lockDir, err := providerCacheLockDir(opts.providerCacheDir)
+	if err != nil {
+		opts.log.Debugf("Failed to record provider cache use: %v", err)
+		return
+	}
+
+	useDir := filepath.Join(lockDir, providerUseDirName)
+	if err := os.MkdirAll(useDir, installDirMode); err != nil {
+		opts.log.Debugf("Failed to record provider cache use: %v", err)
+		return
+	}
+
+	now := time.Now()
+
+	for _, provider := range providers {
+		path := filepath.Join(useDir, providerLockName(provider))
+
+		if err := os.Chtimes(path, now, now); errors.Is(err, fs.ErrNotExist) {
+			err = os.WriteFile(path, nil, providerCacheFileMode)
+		} else if err != nil {
+			opts.log.Debugf("Failed to record use of provider %s: %v", provider, err)
+		}
+	}
+}
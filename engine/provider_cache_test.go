@@ -0,0 +1,165 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const providerLockFile = `provider "registry.opentofu.org/hashicorp/null" {
+  version = "3.2.1"
+}
+`
+
+func TestTofuEngine_RunSetsProviderCache(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("provider_cache", "true", "provider_cache_dir", cacheDir)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "cache=$TF_PLUGIN_CACHE_DIR"`))
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"plan"}}, mockStream))
+	assert.Equal(t, "cache="+cacheDir+"\n", stdout(mockStream.Responses))
+
+	// a plugin cache set by the caller wins
+	mockStream = &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: t.TempDir(),
+		Args:       []string{"plan"},
+		EnvVars:    map[string]string{"TF_PLUGIN_CACHE_DIR": "/custom", "PATH": os.Getenv("PATH")},
+	}, mockStream))
+	assert.Equal(t, "cache=/custom\n", stdout(mockStream.Responses))
+}
+
+func TestTofuEngine_RunSerializesProviderCachePopulation(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+	events := filepath.Join(t.TempDir(), "events")
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("provider_cache", "true", "provider_cache_dir", cacheDir)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo start >> "`+events+`"
+sleep 0.2
+echo end >> "`+events+`"
+`))
+
+	const runs = 3
+
+	var wg sync.WaitGroup
+
+	for range runs {
+		workingDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(workingDir, ".terraform.lock.hcl"), []byte(providerLockFile), 0644))
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			mockStream := &MockRunServer{}
+			assert.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"init"}}, mockStream))
+		}()
+	}
+
+	wg.Wait()
+
+	content, err := os.ReadFile(events)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("start\nend\n", runs), string(content))
+}
+
+func TestPruneCachedProviders(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+
+	// Init marks the directory as a managed cache
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("provider_cache", "true", "provider_cache_dir", cacheDir)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo ran`))
+
+	writeProvider := func(address, version string, modTime time.Time) {
+		t.Helper()
+
+		platformDir := filepath.Join(cacheDir, address, version, "linux_amd64")
+		binary := filepath.Join(platformDir, "terraform-provider-"+filepath.Base(address))
+
+		require.NoError(t, os.MkdirAll(platformDir, 0755))
+		require.NoError(t, os.WriteFile(binary, []byte("binary"), 0755))
+
+		for _, path := range []string{binary, platformDir, filepath.Dir(platformDir)} {
+			require.NoError(t, os.Chtimes(path, modTime, modTime))
+		}
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	writeProvider("registry.opentofu.org/hashicorp/null", "3.2.1", old)
+	writeProvider("registry.opentofu.org/hashicorp/null", "3.2.2", time.Now())
+	writeProvider("registry.opentofu.org/hashicorp/random", "3.6.0", old)
+	writeProvider("registry.opentofu.org/hashicorp/local", "2.5.1", old)
+
+	// a run of a unit locking local 2.5.1 marks it as used, although it was written long ago
+	workingDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, ".terraform.lock.hcl"), []byte(`provider "registry.opentofu.org/hashicorp/local" {
+  version = "2.5.1"
+}
+`), 0644))
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"plan"}}, &MockRunServer{}))
+
+	providers, err := engine.ListCachedProviders(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, providers, 4)
+	assert.Equal(t, "registry.opentofu.org/hashicorp/local", providers[0].Address)
+	assert.True(t, providers[0].LastUsed.After(old.Add(time.Hour)))
+	assert.Equal(t, "registry.opentofu.org/hashicorp/null", providers[1].Address)
+	assert.Equal(t, "3.2.1", providers[1].Version)
+	assert.Equal(t, []string{"linux_amd64"}, providers[1].Platforms)
+	assert.Equal(t, int64(len("binary")), providers[1].Size)
+	assert.Equal(t, providers[1].ModTime, providers[1].LastUsed)
+
+	pruned, err := engine.PruneCachedProviders(cacheDir, 24*time.Hour, true)
+	require.NoError(t, err)
+	assert.Len(t, pruned, 2)
+
+	providers, err = engine.ListCachedProviders(cacheDir)
+	require.NoError(t, err)
+	assert.Len(t, providers, 4)
+
+	pruned, err = engine.PruneCachedProviders(cacheDir, 24*time.Hour, false)
+	require.NoError(t, err)
+	assert.Len(t, pruned, 2)
+
+	providers, err = engine.ListCachedProviders(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, providers, 2)
+	assert.Equal(t, "2.5.1", providers[0].Version)
+	assert.Equal(t, "3.2.2", providers[1].Version)
+	assert.NoDirExists(t, filepath.Join(cacheDir, "registry.opentofu.org", "hashicorp", "random"))
+}
+
+func TestPruneCachedProvidersUnmanagedDir(t *testing.T) {
+	t.Parallel()
+
+	// a directory with the layout of a cache, but without the marker of the engine
+	dir := t.TempDir()
+	versionDir := filepath.Join(dir, "registry.opentofu.org", "hashicorp", "null", "3.2.1")
+	require.NoError(t, os.MkdirAll(versionDir, 0755))
+
+	_, err := engine.ListCachedProviders(dir)
+	require.ErrorIs(t, err, engine.ErrNotProviderCache)
+
+	_, err = engine.PruneCachedProviders(dir, 0, false)
+	require.ErrorIs(t, err, engine.ErrNotProviderCache)
+	assert.DirExists(t, versionDir)
+}
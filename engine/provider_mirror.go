@@ -0,0 +1,450 @@
+package engine
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaProviderMirrorDir = "provider_mirror_dir"
+
+	cliConfigFileEnv = "TF_CLI_CONFIG_FILE"
+	sslCertFileEnv   = "SSL_CERT_FILE"
+
+	mirrorCLIConfigFileName = "provider-mirror.tfrc"
+	mirrorCertFileName      = "provider-mirror-ca.pem"
+	mirrorFileMode          = 0600
+	mirrorCertValidity      = 365 * 24 * time.Hour
+	mirrorReadHeaderTimeout = 10 * time.Second
+	mirrorShutdownTimeout   = 5 * time.Second
+
+	// provider path segments in the mirror: <host>/<namespace>/<type>
+	mirrorProviderSegments = 3
+)
+
+var (
+	ErrInvalidProviderMirror = errors.New("invalid provider mirror directory")
+
+	// providerArchivePattern matches the provider packages in the mirror directory, as written by `tofu providers mirror`
+	providerArchivePattern = regexp.MustCompile(`^terraform-provider-([^_]+)_([^_]+)_([^_]+_[^_]+)\.zip$`)
+
+	// systemCertFiles are the CA bundles which tofu trusts by default on Linux, the first existing one is extended
+	// with the certificate of the mirror
+	systemCertFiles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+	}
+)
+
+// providerMirror serves a directory of provider packages over the provider network mirror protocol on localhost.
+// tofu only accepts HTTPS mirrors, so the server uses a self-signed certificate which runs trust through SSL_CERT_FILE.
+type providerMirror struct {
+	server     *http.Server
+	hashes     map[string]mirrorHash
+	dir        string
+	configDir  string
+	url        string
+	configFile string
+	certFile   string
+	mu         sync.Mutex
+}
+
+// mirrorHash is the cached hash of a provider package
+type mirrorHash struct {
+	modTime time.Time
+	hash    string
+	size    int64
+}
+
+// parseProviderMirrorDir returns the provider mirror directory from Init meta, or an empty string when the mirror is disabled
+func parseProviderMirrorDir(meta map[string]*anypb.Any) (string, error) {
+	dir := metaString(meta, metaProviderMirrorDir)
+	if dir == "" {
+		return "", nil
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %w", ErrInvalidProviderMirror, dir, err)
+	}
+
+	info, err := os.Stat(absDir)
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %w", ErrInvalidProviderMirror, absDir, err)
+	}
+
+	if !info.IsDir() {
+		return "", fmt.Errorf("%w %s: not a directory", ErrInvalidProviderMirror, absDir)
+	}
+
+	if !providerMirrorSupported(runtime.GOOS) {
+		log.Warnf("Not starting the provider mirror, tofu on %s ignores %s and can't trust the mirror certificate", runtime.GOOS, sslCertFileEnv)
+
+		return "", nil
+	}
+
+	return absDir, nil
+}
+
+// providerMirrorSupported reports whether tofu on goos trusts the mirror certificate. Runs trust it through
+// SSL_CERT_FILE, which Go ignores on macOS, where certificates are verified by the platform verifier.
+func providerMirrorSupported(goos string) bool {
+	return goos != "darwin"
+}
+
+// startProviderMirror starts serving dir on a random localhost port and writes the CLI configuration and CA bundle
+// which point tofu at it
+func startProviderMirror(dir string) (*providerMirror, error) {
+	configDir, err := os.MkdirTemp("", "terragrunt-engine-mirror-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider mirror directory: %w", err)
+	}
+
+	mirror := &providerMirror{
+		dir:        dir,
+		configDir:  configDir,
+		hashes:     map[string]mirrorHash{},
+		configFile: filepath.Join(configDir, mirrorCLIConfigFileName),
+		certFile:   filepath.Join(configDir, mirrorCertFileName),
+	}
+
+	if err := mirror.start(); err != nil {
+		_ = os.RemoveAll(configDir)
+		return nil, err
+	}
+
+	log.Infof("Serving provider mirror %s at %s", dir, mirror.url)
+
+	return mirror, nil
+}
+
+// start generates the certificate, starts the server and writes the generated files
+func (m *providerMirror) start() error {
+	certificate, certPEM, err := generateMirrorCertificate()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen for provider mirror: %w", err)
+	}
+
+	m.url = fmt.Sprintf("https://%s/", listener.Addr().String())
+	m.server = &http.Server{
+		Handler:           m,
+		ReadHeaderTimeout: mirrorReadHeaderTimeout,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12},
+	}
+
+	go func() {
+		if err := m.server.ServeTLS(listener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Provider mirror stopped: %v", err)
+		}
+	}()
+
+	bundle, err := systemCertBundle()
+	if err != nil {
+		log.Warnf("Failed to read the system CA bundle, runs using the provider mirror only trust the mirror: %v", err)
+	}
+
+	if err := os.WriteFile(m.certFile, append(bundle, certPEM...), mirrorFileMode); err != nil {
+		return fmt.Errorf("failed to write provider mirror certificate: %w", err)
+	}
+
+	config := fmt.Sprintf("provider_installation {\n  network_mirror {\n    url = %q\n  }\n}\n", m.url)
+	if err := os.WriteFile(m.configFile, []byte(config), mirrorFileMode); err != nil {
+		return fmt.Errorf("failed to write provider mirror CLI configuration: %w", err)
+	}
+
+	return nil
+}
+
+// Close stops the server and removes the generated files
+func (m *providerMirror) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorShutdownTimeout)
+	defer cancel()
+
+	err := m.server.Shutdown(ctx)
+
+	return errors.Join(err, os.RemoveAll(m.configDir))
+}
+
+// configure points a run at the mirror. A CLI configuration set by the caller is kept, the mirror is unused then.
+// Runs which can't reach the loopback interface of the engine host don't use the mirror either.
+func (m *providerMirror) configure(req *tgengine.RunRequest, opts *runOptions) {
+	if configFile := requestEnv(req, cliConfigFileEnv); configFile != "" {
+		opts.log.Warnf("Not using the provider mirror, the run sets %s=%s", cliConfigFileEnv, configFile)
+		return
+	}
+
+	if _, local := opts.executor.(localExecutor); !local {
+		opts.log.Warnf("Not using the provider mirror, it only listens on the loopback interface of the engine host")
+		return
+	}
+
+	if opts.sandbox != nil && opts.sandbox.IsolateNetwork {
+		opts.log.Warnf("Not using the provider mirror, the sandbox of the run isolates the network")
+		return
+	}
+
+	if opts.env == nil {
+		opts.env = map[string]string{}
+	}
+
+	opts.env[cliConfigFileEnv] = m.configFile
+	opts.env[sslCertFileEnv] = m.certFile
+
+	if opts.sandbox != nil {
+		opts.sandbox.ReadOnlyPaths = append(opts.sandbox.ReadOnlyPaths, m.configDir)
+	}
+}
+
+// ServeHTTP implements the provider network mirror protocol:
+// <host>/<namespace>/<type>/index.json lists the versions, <host>/<namespace>/<type>/<version>.json lists the
+// packages of a version, and the packages are served from the same directory.
+func (m *providerMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("Provider mirror request: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cleanPath := path.Clean("/" + r.URL.Path)
+	segments := strings.Split(strings.TrimPrefix(cleanPath, "/"), "/")
+
+	if len(segments) != mirrorProviderSegments+1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	providerDir := filepath.Join(m.dir, filepath.Join(segments[:mirrorProviderSegments]...))
+	name := segments[mirrorProviderSegments]
+
+	switch {
+	case name == "index.json":
+		m.serveVersions(w, r, providerDir)
+	case strings.HasSuffix(name, ".json"):
+		m.serveArchives(w, r, providerDir, strings.TrimSuffix(name, ".json"))
+	case providerArchivePattern.MatchString(name):
+		http.ServeFile(w, r, filepath.Join(providerDir, name))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveVersions responds with the versions available for a provider
+func (m *providerMirror) serveVersions(w http.ResponseWriter, r *http.Request, providerDir string) {
+	archives, err := providerArchives(providerDir)
+	if err != nil || len(archives) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	versions := map[string]struct{}{}
+	for _, archive := range archives {
+		versions[archive.version] = struct{}{}
+	}
+
+	writeMirrorJSON(w, map[string]any{"versions": versions})
+}
+
+// serveArchives responds with the packages of a provider version and their hashes
+func (m *providerMirror) serveArchives(w http.ResponseWriter, r *http.Request, providerDir, version string) {
+	archives, err := providerArchives(providerDir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	type archiveInfo struct {
+		URL    string   `json:"url"`
+		Hashes []string `json:"hashes,omitempty"`
+	}
+
+	result := map[string]archiveInfo{}
+
+	for _, archive := range archives {
+		if archive.version != version {
+			continue
+		}
+
+		hash, err := m.hash(filepath.Join(providerDir, archive.name))
+		if err != nil {
+			log.Errorf("Failed to hash provider package %s: %v", archive.name, err)
+			http.Error(w, "failed to hash provider package", http.StatusInternalServerError)
+
+			return
+		}
+
+		result[archive.platform] = archiveInfo{URL: archive.name, Hashes: []string{hash}}
+	}
+
+	if len(result) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeMirrorJSON(w, map[string]any{"archives": result})
+}
+
+// hash returns the zh: hash of a provider package, cached until the file changes
+func (m *providerMirror) hash(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	cached, exists := m.hashes[file]
+	m.mu.Unlock()
+
+	if exists && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+
+	hash := "zh:" + hex.EncodeToString(hasher.Sum(nil))
+
+	m.mu.Lock()
+	m.hashes[file] = mirrorHash{hash: hash, size: info.Size(), modTime: info.ModTime()}
+	m.mu.Unlock()
+
+	return hash, nil
+}
+
+// providerArchive is a provider package in the mirror directory
+type providerArchive struct {
+	name     string
+	version  string
+	platform string
+}
+
+// providerArchives lists the provider packages in the directory of a provider
+func providerArchives(providerDir string) ([]providerArchive, error) {
+	entries, err := os.ReadDir(providerDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []providerArchive
+
+	for _, entry := range entries {
+		match := providerArchivePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil || match[1] != filepath.Base(providerDir) {
+			continue
+		}
+
+		archives = append(archives, providerArchive{name: entry.Name(), version: match[2], platform: match[3]})
+	}
+
+	return archives, nil
+}
+
+// writeMirrorJSON writes a JSON response
+func writeMirrorJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("Failed to write provider mirror response: %v", err)
+	}
+}
+
+// generateMirrorCertificate creates the self-signed certificate of the mirror for 127.0.0.1 and localhost
+func generateMirrorCertificate() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to generate provider mirror key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to generate provider mirror certificate serial: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "terragrunt-engine-opentofu provider mirror"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(mirrorCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to create provider mirror certificate: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPEM, nil
+}
+
+// systemCertBundle returns the CA bundle tofu would use without SSL_CERT_FILE pointing at the mirror certificate
+func systemCertBundle() ([]byte, error) {
+	files := systemCertFiles
+	if file := os.Getenv(sslCertFileEnv); file != "" {
+		files = []string{file}
+	}
+
+	for _, file := range files {
+		bundle, err := os.ReadFile(file)
+		if err == nil {
+			if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+				bundle = append(bundle, '\n')
+			}
+
+			return bundle, nil
+		}
+	}
+
+	return nil, fmt.Errorf("none of %s exists", strings.Join(files, ", "))
+}
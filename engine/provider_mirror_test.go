@@ -0,0 +1,186 @@
+package engine_test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mirrorFixtureDir = "testdata/provider-mirror"
+
+func TestTofuEngine_RunUsesProviderMirror(t *testing.T) {
+	t.Parallel()
+
+	if !engine.ProviderMirrorSupported(runtime.GOOS) {
+		t.Skip("the provider mirror isn't supported on " + runtime.GOOS)
+	}
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("provider_mirror_dir", mirrorFixtureDir)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `cat "$TF_CLI_CONFIG_FILE"
+echo "cert=$SSL_CERT_FILE"
+`))
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"init"}}, mockStream))
+
+	output := stdout(mockStream.Responses)
+	mirrorURL := regexp.MustCompile(`url = "(https://127\.0\.0\.1:\d+/)"`).FindStringSubmatch(output)
+	require.NotNil(t, mirrorURL, output)
+
+	certFile := regexp.MustCompile(`cert=(\S+)`).FindStringSubmatch(output)
+	require.NotNil(t, certFile, output)
+
+	// the run trusts the mirror through the generated CA bundle, like tofu does
+	bundle, err := os.ReadFile(certFile[1])
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(bundle))
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}}
+
+	get := func(target string) (int, []byte) {
+		t.Helper()
+
+		resp, err := client.Get(target)
+		require.NoError(t, err)
+
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, body
+	}
+
+	providerURL := mirrorURL[1] + "registry.opentofu.org/hashicorp/null/"
+
+	status, body := get(providerURL + "index.json")
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"versions": {"3.2.1": {}}}`, string(body))
+
+	status, body = get(providerURL + "3.2.1.json")
+	require.Equal(t, http.StatusOK, status)
+
+	var version struct {
+		Archives map[string]struct {
+			URL    string   `json:"url"`
+			Hashes []string `json:"hashes"`
+		} `json:"archives"`
+	}
+
+	require.NoError(t, json.Unmarshal(body, &version))
+	require.Contains(t, version.Archives, "linux_amd64")
+
+	archive := version.Archives["linux_amd64"]
+	fixture, err := os.ReadFile(filepath.Join(mirrorFixtureDir, "registry.opentofu.org", "hashicorp", "null", archive.URL))
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(fixture)
+	assert.Equal(t, []string{"zh:" + hex.EncodeToString(sum[:])}, archive.Hashes)
+
+	// archive URLs are relative to the version document
+	archiveURL, err := url.Parse(providerURL + "3.2.1.json")
+	require.NoError(t, err)
+
+	status, body = get(archiveURL.ResolveReference(&url.URL{Path: archive.URL}).String())
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, fixture, body)
+
+	status, _ = get(providerURL + "9.9.9.json")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = get(mirrorURL[1] + "registry.opentofu.org/hashicorp/random/index.json")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// a CLI configuration set by the caller is kept
+	mockStream = &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: t.TempDir(),
+		Args:       []string{"init"},
+		EnvVars:    map[string]string{"TF_CLI_CONFIG_FILE": "/dev/null", "PATH": os.Getenv("PATH")},
+	}, mockStream))
+	assert.NotContains(t, stdout(mockStream.Responses), "network_mirror")
+
+	require.NoError(t, tofuEngine.Shutdown(&tgengine.ShutdownRequest{}, &MockShutdownServer{}))
+	assert.NoFileExists(t, certFile[1])
+}
+
+func TestProviderMirrorSupported(t *testing.T) {
+	t.Parallel()
+
+	// tofu on macOS ignores SSL_CERT_FILE
+	assert.False(t, engine.ProviderMirrorSupported("darwin"))
+	assert.True(t, engine.ProviderMirrorSupported("linux"))
+	assert.True(t, engine.ProviderMirrorSupported("windows"))
+}
+
+func TestTofuEngine_RunWithoutUnsupportedProviderMirror(t *testing.T) {
+	t.Parallel()
+
+	if engine.ProviderMirrorSupported(runtime.GOOS) {
+		t.Skip("the provider mirror is supported on " + runtime.GOOS)
+	}
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("provider_mirror_dir", mirrorFixtureDir)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "config=$TF_CLI_CONFIG_FILE cert=$SSL_CERT_FILE"`))
+
+	mockStream := &MockRunServer{}
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"init"}}, mockStream))
+
+	// runs use the registry instead of a mirror they can't verify
+	assert.Equal(t, "config= cert=\n", stdout(mockStream.Responses))
+}
+
+func TestTofuEngine_InitRejectsMissingProviderMirror(t *testing.T) {
+	t.Parallel()
+
+	mockStream := &MockInitServer{}
+	err := (&engine.TofuEngine{}).Init(&tgengine.InitRequest{Meta: stringMeta("provider_mirror_dir", filepath.Join(t.TempDir(), "missing"))}, mockStream)
+	require.ErrorIs(t, err, engine.ErrInvalidProviderMirror)
+	assert.True(t, strings.Contains(mockStream.Responses[len(mockStream.Responses)-1].GetStderr(), "invalid provider mirror"))
+}
+
+func TestTofuEngine_RunSkipsUnreachableProviderMirror(t *testing.T) {
+	t.Parallel()
+
+	docker := &fakeDocker{images: map[string]bool{"example/tofu:1.9": true}}
+	host := startFakeDocker(t, docker)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta("provider_mirror_dir", mirrorFixtureDir, "executor", "docker", "docker_host", host, "docker_image", "example/tofu:1.9"),
+	}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `exit 1`))
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"init"}}, &MockRunServer{}))
+
+	docker.mu.Lock()
+	defer docker.mu.Unlock()
+
+	// the container has its own loopback interface, the mirror of the engine is unreachable from it
+	require.Len(t, docker.created, 1)
+
+	for _, variable := range docker.created[0].Env {
+		assert.NotContains(t, variable, "TF_CLI_CONFIG_FILE=")
+		assert.NotContains(t, variable, "SSL_CERT_FILE=")
+	}
+}
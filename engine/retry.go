@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaRetryMaxAttempts      = "retry_max_attempts"
+	metaRetrySleepInterval    = "retry_sleep_interval"
+	metaRetryMaxSleepInterval = "retry_max_sleep_interval"
+	metaRetryableErrors       = "retryable_errors"
+	metaRetryCommands         = "retry_commands"
+
+	defaultRetryMaxAttempts      = 1
+	defaultRetrySleepInterval    = 5 * time.Second
+	defaultRetryMaxSleepInterval = time.Minute
+)
+
+var (
+	ErrInvalidRetryConfig = errors.New("invalid retry configuration")
+
+	// defaultRetryableErrors match transient registry, network, locking and throttling failures
+	defaultRetryableErrors = []string{
+		`(?s).*Error acquiring the state lock.*`,
+		`(?s).*Failed to query available provider packages.*`,
+		`(?s).*(Error installing provider|Failed to install provider).*(timeout|connection reset by peer|TLS handshake).*`,
+		`(?s).*Failed to load (state|backend).*(timeout|TLS handshake).*`,
+		`(?s).*Error configuring the backend.*TLS handshake timeout.*`,
+		`(?s).*Could not download module.*(timeout|429|connection reset by peer).*`,
+		`(?s).*Client\.Timeout exceeded while awaiting headers.*`,
+		`(?s).*(Throttling|ThrottlingException|RequestLimitExceeded|Rate exceeded|TooManyRequests|429 Too Many Requests).*`,
+		`(?s).*connection reset by peer.*`,
+	}
+
+	// defaultRetryCommands are the subcommands which are safe to run again after a failure
+	defaultRetryCommands = []string{"init", "plan", "validate", "show", "output", "providers", "get", "version"}
+)
+
+// retryConfig controls the retries of failed runs
+type retryConfig struct {
+	patterns         []*regexp.Regexp
+	commands         []string
+	maxAttempts      int
+	sleepInterval    time.Duration
+	maxSleepInterval time.Duration
+}
+
+// parseRetryConfig builds the retry configuration from Init meta
+func parseRetryConfig(meta map[string]*anypb.Any) (retryConfig, error) {
+	config := retryConfig{commands: defaultRetryCommands}
+
+	var err error
+
+	if config.maxAttempts, err = metaInt(meta, metaRetryMaxAttempts, defaultRetryMaxAttempts); err != nil {
+		return retryConfig{}, err
+	}
+
+	if config.maxAttempts < 1 {
+		return retryConfig{}, fmt.Errorf("%w: %s must be at least 1", ErrInvalidRetryConfig, metaRetryMaxAttempts)
+	}
+
+	if config.sleepInterval, err = metaDuration(meta, metaRetrySleepInterval, defaultRetrySleepInterval); err != nil {
+		return retryConfig{}, err
+	}
+
+	if config.maxSleepInterval, err = metaDuration(meta, metaRetryMaxSleepInterval, defaultRetryMaxSleepInterval); err != nil {
+		return retryConfig{}, err
+	}
+
+	patterns := metaPatterns(meta, metaRetryableErrors)
+	if len(patterns) == 0 {
+		patterns = defaultRetryableErrors
+	}
+
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return retryConfig{}, fmt.Errorf("%w: invalid retryable error pattern %q: %w", ErrInvalidRetryConfig, pattern, err)
+		}
+
+		config.patterns = append(config.patterns, compiled)
+	}
+
+	if commands := metaStrings(meta, metaRetryCommands); len(commands) > 0 {
+		config.commands = commands
+	}
+
+	return config, nil
+}
+
+// retryable returns the pattern matching the output of a failed attempt, or nil when the attempt must not be retried
+func (r retryConfig) retryable(args []string, attempt int, output string) *regexp.Regexp {
+	if attempt >= r.maxAttempts || !slices.Contains(r.commands, subcommand(args)) {
+		return nil
+	}
+
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(output) {
+			return pattern
+		}
+	}
+
+	return nil
+}
+
+// backoff returns the time to wait after the given failed attempt, doubling each time up to the maximum
+func (r retryConfig) backoff(attempt int) time.Duration {
+	sleep := r.sleepInterval
+
+	for i := 1; i < attempt && sleep < r.maxSleepInterval; i++ {
+		sleep *= 2
+	}
+
+	return min(sleep, r.maxSleepInterval)
+}
@@ -0,0 +1,138 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyTofu returns a fake tofu which fails with message until it ran failures times
+func flakyTofu(t *testing.T, failures int, message string) (string, string) {
+	t.Helper()
+
+	counter := filepath.Join(t.TempDir(), "attempts")
+	script := `echo x >> "` + counter + `"
+if [ "$(wc -l < "` + counter + `")" -le ` + strconv.Itoa(failures) + ` ]; then
+  echo "` + message + `" >&2
+  exit 1
+fi
+echo done
+`
+
+	return fakeTofu(t, script), counter
+}
+
+func attempts(t *testing.T, counter string) int {
+	t.Helper()
+
+	data, err := os.ReadFile(counter)
+	require.NoError(t, err)
+
+	return strings.Count(string(data), "\n")
+}
+
+func TestTofuEngine_RunRetry(t *testing.T) {
+	t.Parallel()
+
+	binary, counter := flakyTofu(t, 2, "Error: Error acquiring the state lock")
+
+	tofuEngine := &engine.TofuEngine{}
+	meta := stringMeta("retry_max_attempts", "3", "retry_sleep_interval", "10ms")
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: meta}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(binary)
+
+	report, responses := runReportWith(t, tofuEngine, []string{"plan"})
+	assert.Equal(t, 3, attempts(t, counter))
+	assert.Equal(t, 0, report.ResultCode)
+	assert.Equal(t, 3, report.Attempts)
+
+	output := stderr(responses)
+	assert.Contains(t, output, "Attempt 1 of 3 failed with a retryable error")
+	assert.Contains(t, output, "Attempt 2 of 3 failed with a retryable error")
+	assert.Contains(t, output, "Run finished after 3 attempts")
+	assert.Contains(t, stdout(responses), "done")
+}
+
+func TestTofuEngine_RunRetryExhausted(t *testing.T) {
+	t.Parallel()
+
+	binary, counter := flakyTofu(t, 5, "Error: Failed to query available provider packages")
+
+	tofuEngine := &engine.TofuEngine{}
+	meta := stringMeta("retry_max_attempts", "2", "retry_sleep_interval", "10ms")
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: meta}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(binary)
+
+	report, _ := runReportWith(t, tofuEngine, []string{"init"})
+	assert.Equal(t, 2, attempts(t, counter))
+	assert.Equal(t, 1, report.ResultCode)
+	assert.Equal(t, 2, report.Attempts)
+}
+
+func TestTofuEngine_RunNoRetry(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		message string
+		meta    []string
+		args    []string
+	}{
+		{name: "not idempotent", message: "Error acquiring the state lock", args: []string{"apply"}},
+		{name: "not retryable", message: "Error: Unsupported argument", args: []string{"plan"}},
+		{name: "custom pattern", message: "Error acquiring the state lock", args: []string{"plan"}, meta: []string{"retryable_errors", "Throttling"}},
+		{name: "disabled", message: "Error acquiring the state lock", args: []string{"plan"}, meta: []string{"retry_max_attempts", "1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			binary, counter := flakyTofu(t, 1, tc.message)
+
+			tofuEngine := &engine.TofuEngine{}
+			meta := stringMeta(append([]string{"retry_max_attempts", "3", "retry_sleep_interval", "10ms"}, tc.meta...)...)
+			require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: meta}, &MockInitServer{}))
+			tofuEngine.SetBinaryPath(binary)
+
+			report, _ := runReportWith(t, tofuEngine, tc.args)
+			assert.Equal(t, 1, attempts(t, counter))
+			assert.Equal(t, 1, report.Attempts)
+			assert.Equal(t, 1, report.ResultCode)
+		})
+	}
+}
+
+func TestTofuEngine_InitInvalidRetryConfig(t *testing.T) {
+	t.Parallel()
+
+	err := (&engine.TofuEngine{}).Init(&tgengine.InitRequest{Meta: stringMeta("retryable_errors", "(")}, &MockInitServer{})
+	require.ErrorIs(t, err, engine.ErrInvalidRetryConfig)
+}
+
+func TestTofuEngine_RunRetryPatternsWithCommas(t *testing.T) {
+	t.Parallel()
+
+	binary, counter := flakyTofu(t, 1, "Error: rate exceeded, retry later (code 429)")
+
+	// patterns are separated by newlines, commas belong to the patterns
+	tofuEngine := &engine.TofuEngine{}
+	meta := stringMeta(
+		"retry_max_attempts", "3",
+		"retry_sleep_interval", "10ms",
+		"retryable_errors", "Throttling\nrate exceeded, retry later \\(code \\d{1,3}\\)",
+	)
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: meta}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(binary)
+
+	report, _ := runReportWith(t, tofuEngine, []string{"plan"})
+	assert.Equal(t, 2, attempts(t, counter))
+	assert.Equal(t, 0, report.ResultCode)
+}
@@ -0,0 +1,359 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaRunLog           = "run_log"
+	metaRunLogDir        = "run_log_dir"
+	metaRunLogMaxSize    = "run_log_max_size"
+	metaRunLogMaxBackups = "run_log_max_backups"
+	metaRunLogRetention  = "run_log_retention"
+	metaRunLogMaxAge     = "run_log_max_age"
+
+	defaultRunLogMaxBackups = 3
+	defaultRunLogRetention  = 20
+	runLogDirMode           = 0700
+	runLogFileMode          = 0600
+	runLogSuffix            = ".log"
+	runLogNameTimeFormat    = "20060102T150405.000000000Z"
+	runLogLineTimeFormat    = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var ErrInvalidRunLog = errors.New("invalid run log configuration")
+
+// runLogs mirrors the output of every Run to a log file per run, in a directory per unit
+type runLogs struct {
+	dir string
+
+	// maxSize is the size in bytes a log file is rotated at, 0 when it isn't rotated
+	maxSize int64
+	// maxBackups is the number of rotated files kept per run
+	maxBackups int
+	// retention is the number of runs whose logs are kept per unit, 0 keeps them all
+	retention int
+	// maxAge removes the logs of older runs, 0 keeps them regardless of age
+	maxAge time.Duration
+}
+
+// DefaultRunLogDir returns the run log directory used when run_log is set without run_log_dir
+func DefaultRunLogDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user cache directory: %w", err)
+	}
+
+	return filepath.Join(cacheDir, "terragrunt", "tofudl", "run-logs"), nil
+}
+
+// parseRunLogs reads the run log settings from Init meta, nil when they are disabled
+func parseRunLogs(meta map[string]*anypb.Any) (*runLogs, error) {
+	dir := metaString(meta, metaRunLogDir)
+
+	enabled, err := metaBool(meta, metaRunLog)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled && dir == "" {
+		return nil, nil
+	}
+
+	if dir == "" {
+		if dir, err = DefaultRunLogDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	logs := &runLogs{}
+
+	if logs.dir, err = filepath.Abs(dir); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRunLog, err)
+	}
+
+	maxSize, err := metaInt(meta, metaRunLogMaxSize, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	logs.maxSize = int64(maxSize)
+
+	if logs.maxBackups, err = metaInt(meta, metaRunLogMaxBackups, defaultRunLogMaxBackups); err != nil {
+		return nil, err
+	}
+
+	if logs.retention, err = metaInt(meta, metaRunLogRetention, defaultRunLogRetention); err != nil {
+		return nil, err
+	}
+
+	if logs.maxAge, err = metaDuration(meta, metaRunLogMaxAge, 0); err != nil {
+		return nil, err
+	}
+
+	if logs.maxSize < 0 || logs.maxBackups < 0 || logs.retention < 0 || logs.maxAge < 0 {
+		return nil, fmt.Errorf("%w: %s, %s, %s and %s must not be negative", ErrInvalidRunLog,
+			metaRunLogMaxSize, metaRunLogMaxBackups, metaRunLogRetention, metaRunLogMaxAge)
+	}
+
+	if err := os.MkdirAll(logs.dir, runLogDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create run log directory %s: %w", logs.dir, err)
+	}
+
+	return logs, nil
+}
+
+// tee runs a Run through run and mirrors its output to a new log file of its unit
+func (r *runLogs) tee(req *tgengine.RunRequest, stream tgengine.Engine_RunServer, runID, binary string, logger *log.Entry, run func(tgengine.Engine_RunServer) error) error {
+	unit, err := filepath.Abs(moduleDir(req.GetWorkingDir(), req.GetArgs()))
+	if err != nil {
+		unit = moduleDir(req.GetWorkingDir(), req.GetArgs())
+	}
+
+	start := time.Now()
+
+	file, err := r.create(req, unit, runID, binary, start)
+	if err != nil {
+		logger.Warnf("Failed to create run log of %s: %v", unit, err)
+
+		return run(stream)
+	}
+
+	logger.Debugf("Writing run log %s", file.path)
+
+	teed := newResultStream(stream, file.record)
+	err = run(teed)
+
+	if err := file.close(teed.exitCode(err), time.Since(start)); err != nil {
+		logger.Warnf("Failed to write run log %s: %v", file.path, err)
+	}
+
+	if err := r.prune(logger, unit); err != nil {
+		logger.Warnf("Failed to prune run logs of %s: %v", unit, err)
+	}
+
+	return err
+}
+
+// create opens the log file of a run and writes its header
+func (r *runLogs) create(req *tgengine.RunRequest, unit, runID, binary string, start time.Time) (*runLogFile, error) {
+	unitDir := filepath.Join(r.dir, unitFileName(unit))
+	if err := os.MkdirAll(unitDir, runLogDirMode); err != nil {
+		return nil, err
+	}
+
+	version := tofuBinaries.get(binary).version
+	if version == "" {
+		version = "unknown"
+	}
+
+	header := strings.Join([]string{
+		"# run_id: " + runID,
+		"# unit: " + unit,
+		"# working_dir: " + req.GetWorkingDir(),
+		"# command: " + strings.Join(append([]string{filepath.Base(binary)}, redactArgs(req.GetArgs())...), " "),
+		"# tofu_version: " + version,
+		"# started: " + start.UTC().Format(time.RFC3339Nano),
+	}, "\n") + "\n"
+
+	file := &runLogFile{
+		path:       filepath.Join(unitDir, start.UTC().Format(runLogNameTimeFormat)+"-"+runID+runLogSuffix),
+		header:     header,
+		maxSize:    r.maxSize,
+		maxBackups: r.maxBackups,
+		pending:    map[string]string{},
+	}
+
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// prune removes the logs of unit beyond the retention count or older than the maximum age, with their rotated files
+func (r *runLogs) prune(logger *log.Entry, unit string) error {
+	logs, err := ListRunLogs(r.dir, unit)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for i, path := range logs {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		// logs are listed newest first
+		expired := r.maxAge > 0 && time.Since(info.ModTime()) > r.maxAge
+		if (r.retention > 0 && i >= r.retention) || expired {
+			logger.Debugf("Removing run log %s", path)
+
+			rotated, _ := filepath.Glob(path + ".*")
+			for _, name := range append(rotated, path) {
+				if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ListRunLogs returns the paths of the run logs of a unit in dir, newest first. Rotated files are not listed.
+func ListRunLogs(dir, unit string) ([]string, error) {
+	absUnit, err := filepath.Abs(unit)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := filepath.Glob(filepath.Join(dir, unitFileName(absUnit), "*"+runLogSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	// names start with the time of the run
+	slices.Sort(logs)
+	slices.Reverse(logs)
+
+	return logs, nil
+}
+
+// runLogFile writes the timestamped output lines of a run, rotating the file when it exceeds the maximum size
+type runLogFile struct {
+	file *os.File
+
+	// pending holds the last incomplete line of each stream
+	pending map[string]string
+
+	// err is the first write error, the output is no longer written after it
+	err error
+
+	path       string
+	header     string
+	size       int64
+	maxSize    int64
+	maxBackups int
+	mu         sync.Mutex
+}
+
+// open creates the log file and writes the header
+func (f *runLogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, runLogFileMode)
+	if err != nil {
+		return err
+	}
+
+	f.file, f.size = file, 0
+
+	return f.write(f.header)
+}
+
+// record writes the output of a response, complete lines are written and the rest is kept until its line ends
+func (f *runLogFile) record(response *tgengine.RunResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, output := range []struct{ stream, text string }{{"stdout", response.GetStdout()}, {"stderr", response.GetStderr()}} {
+		if output.text == "" {
+			continue
+		}
+
+		stream := output.stream
+
+		lines := strings.Split(f.pending[stream]+output.text, "\n")
+		f.pending[stream] = lines[len(lines)-1]
+
+		for _, line := range lines[:len(lines)-1] {
+			f.writeLine(stream, line)
+		}
+	}
+}
+
+// writeLine writes a line of a stream with its time, rotating the file first when the line doesn't fit
+func (f *runLogFile) writeLine(stream, line string) {
+	if f.err != nil {
+		return
+	}
+
+	entry := fmt.Sprintf("%s %s %s\n", time.Now().UTC().Format(runLogLineTimeFormat), stream, line)
+
+	if f.maxSize > 0 && f.size > int64(len(f.header)) && f.size+int64(len(entry)) > f.maxSize {
+		if f.err = f.rotate(); f.err != nil {
+			return
+		}
+	}
+
+	f.err = f.write(entry)
+}
+
+func (f *runLogFile) write(text string) error {
+	n, err := f.file.WriteString(text)
+	f.size += int64(n)
+
+	return err
+}
+
+// rotate moves the log file to path.1, shifting older rotated files and removing those beyond the maximum number of
+// backups, then starts a new file with the header
+func (f *runLogFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+
+		return f.open()
+	}
+
+	if err := os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// close writes the incomplete lines and the footer with the exit code and duration, and closes the file
+func (f *runLogFile) close(exitCode int, duration time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, stream := range []string{"stdout", "stderr"} {
+		if line := f.pending[stream]; line != "" {
+			f.writeLine(stream, line)
+		}
+	}
+
+	if f.err == nil {
+		f.err = f.write(fmt.Sprintf("# exit_code: %d\n# duration: %s\n", exitCode, duration.Round(time.Millisecond)))
+	}
+
+	return errors.Join(f.err, f.file.Close())
+}
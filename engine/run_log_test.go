@@ -0,0 +1,131 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runLogTofu is a fake tofu which reports its version and writes to both streams
+const runLogTofu = `if [ "$1" = "version" ]; then echo '{"terraform_version":"1.9.0"}'; exit 0; fi
+printf 'line one\nline two\nno newline'
+echo "warning" >&2
+exit 2`
+
+func TestTofuEngine_RunLog(t *testing.T) {
+	t.Parallel()
+
+	logDir := t.TempDir()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("run_log_dir", logDir)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, runLogTofu))
+
+	workingDir := t.TempDir()
+	stream := &MockRunServer{}
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: workingDir,
+		Args:       []string{"plan", "-input=false", "-var", "password=hunter2"},
+	}, stream))
+
+	// the stream is unchanged
+	assert.Equal(t, "line one\nline two\nno newline", stdout(stream.Responses))
+
+	logs, err := engine.ListRunLogs(logDir, workingDir)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+
+	content, err := os.ReadFile(logs[0])
+	require.NoError(t, err)
+
+	text := string(content)
+	assert.Regexp(t, `(?m)^# run_id: [0-9a-f]{32}$`, text)
+	assert.Contains(t, text, "# unit: "+workingDir+"\n")
+	assert.Contains(t, text, "# command: tofu plan -input=false -var password=REDACTED\n")
+	assert.Contains(t, text, "# tofu_version: 1.9.0\n")
+	assert.NotContains(t, text, "hunter2")
+
+	timestamp := `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z`
+	for _, line := range []string{"stdout line one", "stdout line two", "stdout no newline", "stderr warning"} {
+		assert.Regexp(t, regexp.MustCompile(`(?m)^`+timestamp+` `+line+`$`), text)
+	}
+
+	assert.Contains(t, text, "# exit_code: 2\n")
+
+	runID := regexp.MustCompile(`# run_id: (\w+)`).FindStringSubmatch(text)[1]
+	assert.Equal(t, filepath.Base(logs[0])[len("20060102T150405.000000000Z-"):], runID+".log")
+}
+
+func TestTofuEngine_RunLogRetention(t *testing.T) {
+	t.Parallel()
+
+	logDir := t.TempDir()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta("run_log_dir", logDir, "run_log_retention", "2"),
+	}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "planned"`))
+
+	workingDir := t.TempDir()
+
+	for range 3 {
+		require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"plan"}}, &MockRunServer{}))
+	}
+
+	logs, err := engine.ListRunLogs(logDir, workingDir)
+	require.NoError(t, err)
+	assert.Len(t, logs, 2)
+}
+
+func TestTofuEngine_RunLogRotation(t *testing.T) {
+	t.Parallel()
+
+	logDir := t.TempDir()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{
+		Meta: stringMeta("run_log_dir", logDir, "run_log_max_size", "512", "run_log_max_backups", "2"),
+	}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `i=0; while [ $i -lt 100 ]; do echo "output line $i"; i=$((i+1)); done`))
+
+	workingDir := t.TempDir()
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"plan"}}, &MockRunServer{}))
+
+	logs, err := engine.ListRunLogs(logDir, workingDir)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+
+	for _, path := range []string{logs[0], logs[0] + ".1", logs[0] + ".2"} {
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "# run_id: ", "every file starts with the header")
+
+		// the footer is appended to the last file regardless of its size
+		if path != logs[0] {
+			assert.LessOrEqual(t, len(content), 512, path)
+		}
+	}
+
+	assert.NoFileExists(t, logs[0]+".3")
+
+	content, err := os.ReadFile(logs[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "stdout output line 99\n")
+}
+
+func TestTofuEngine_RunLogInvalid(t *testing.T) {
+	t.Parallel()
+
+	err := (&engine.TofuEngine{}).Init(&tgengine.InitRequest{
+		Meta: stringMeta("run_log_dir", t.TempDir(), "run_log_retention", "-1"),
+	}, &MockInitServer{})
+	require.ErrorIs(t, err, engine.ErrInvalidRunLog)
+}
@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"sync"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+)
+
+// resultStream passes the responses of a Run through and keeps the result code of the last one. The wrappers of
+// the audit log, run logs, metrics and tracing build on it, onSend sees every response before it is sent.
+type resultStream struct {
+	tgengine.Engine_RunServer
+	onSend     func(response *tgengine.RunResponse)
+	resultCode int32
+	mu         sync.Mutex
+}
+
+func newResultStream(stream tgengine.Engine_RunServer, onSend func(response *tgengine.RunResponse)) *resultStream {
+	return &resultStream{Engine_RunServer: stream, onSend: onSend}
+}
+
+func (s *resultStream) Send(response *tgengine.RunResponse) error {
+	s.mu.Lock()
+	if s.onSend != nil {
+		s.onSend(response)
+	}
+
+	s.resultCode = response.GetResultCode()
+	s.mu.Unlock()
+
+	return s.Engine_RunServer.Send(response)
+}
+
+// exitCode returns the exit code of a Run which returned err, errorResultCode when it failed without sending one
+func (s *resultStream) exitCode(err error) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil && s.resultCode == 0 {
+		return errorResultCode
+	}
+
+	return int(s.resultCode)
+}
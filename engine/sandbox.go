@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+)
+
+const (
+	// SandboxInitCommand is the hidden command used to re-execute the engine binary as the init process of a sandbox.
+	SandboxInitCommand = "__sandbox-init"
+
+	metaSandbox               = "sandbox"
+	metaSandboxIsolateNetwork = "sandbox_isolate_network"
+	pluginCacheDirEnv         = "TF_PLUGIN_CACHE_DIR"
+)
+
+var (
+	ErrSandboxUnsupported        = errors.New("sandboxed execution is only supported on Linux")
+	ErrUserNamespacesUnavailable = errors.New("user namespaces are not available on this host, sandboxed execution requires unprivileged user namespaces or running the engine as root")
+)
+
+// sandboxOptions describes the isolation applied to a sandboxed tofu process
+type sandboxOptions struct {
+	WritablePaths  []string `json:"writable_paths"`
+	ReadOnlyPaths  []string `json:"read_only_paths,omitempty"`
+	IsolateNetwork bool     `json:"isolate_network"`
+}
+
+// sandboxOptionsFromRequest builds the sandbox options for a run in workingDir which uses the plugin cache in
+// pluginCacheDir, nil is returned when sandboxing is not requested
+func sandboxOptionsFromRequest(req *tgengine.RunRequest, workingDir, pluginCacheDir string) (*sandboxOptions, error) {
+	enabled, err := metaBool(req.GetMeta(), metaSandbox)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	isolateNetwork, err := metaBool(req.GetMeta(), metaSandboxIsolateNetwork)
+	if err != nil {
+		return nil, err
+	}
+
+	writablePaths := []string{workingDir}
+
+	if pluginCacheDir != "" {
+		if err := os.MkdirAll(pluginCacheDir, installDirMode); err != nil {
+			return nil, fmt.Errorf("failed to create plugin cache directory %s: %w", pluginCacheDir, err)
+		}
+
+		writablePaths = append(writablePaths, pluginCacheDir)
+	}
+
+	opts := &sandboxOptions{IsolateNetwork: isolateNetwork}
+
+	for _, path := range writablePaths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve sandbox path %s: %w", path, err)
+		}
+
+		opts.WritablePaths = append(opts.WritablePaths, absPath)
+	}
+
+	return opts, nil
+}
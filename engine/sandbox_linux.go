@@ -0,0 +1,314 @@
+//go:build linux
+
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	maxUserNamespacesPath   = "/proc/sys/user/max_user_namespaces"
+	unprivilegedUsernsPath  = "/proc/sys/kernel/unprivileged_userns_clone"
+	mountInfoPath           = "/proc/self/mountinfo"
+	sandboxTmpDir           = "/tmp"
+	minSandboxInitArgs      = 2
+	mountInfoMountPointItem = 4
+
+	// flags which are locked on mounts inherited from another user namespace and must be kept on remount
+	lockedMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME |
+		syscall.MS_NODIRATIME | syscall.MS_RELATIME
+)
+
+// configureSandbox rewrites cmd to start through the sandbox init process in new mount, PID and optionally network namespaces
+func configureSandbox(cmd *exec.Cmd, opts *sandboxOptions) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+
+	useUserNamespace := os.Geteuid() != 0
+	if useUserNamespace {
+		if err := checkUserNamespaces(); err != nil {
+			return err
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to resolve engine executable for sandbox: %w", err)
+	}
+
+	encodedOpts, err := json.Marshal(opts)
+	if err != nil {
+		return fmt.Errorf("failed to encode sandbox options: %w", err)
+	}
+
+	args := []string{self, SandboxInitCommand, string(encodedOpts), cmd.Path}
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = self
+
+	cloneFlags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID)
+	if opts.IsolateNetwork {
+		cloneFlags |= syscall.CLONE_NEWNET
+	}
+
+	attr := &syscall.SysProcAttr{Cloneflags: cloneFlags}
+
+	if useUserNamespace {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+	}
+
+	cmd.SysProcAttr = attr
+
+	return nil
+}
+
+// checkUserNamespaces verifies that unprivileged user namespaces can be created on this host
+func checkUserNamespaces() error {
+	if value, err := os.ReadFile(maxUserNamespacesPath); err == nil && strings.TrimSpace(string(value)) == "0" {
+		return fmt.Errorf("%w (%s is 0)", ErrUserNamespacesUnavailable, maxUserNamespacesPath)
+	}
+
+	if value, err := os.ReadFile(unprivilegedUsernsPath); err == nil && strings.TrimSpace(string(value)) == "0" {
+		return fmt.Errorf("%w (%s is 0)", ErrUserNamespacesUnavailable, unprivilegedUsernsPath)
+	}
+
+	return nil
+}
+
+// sandboxStartError explains process start failures caused by missing namespace support
+func sandboxStartError(err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %w", ErrUserNamespacesUnavailable, err)
+	}
+
+	return err
+}
+
+// SandboxInit runs inside the new namespaces: it makes the filesystem read-only except for the writable paths,
+// mounts a private /tmp and /proc, and then replaces itself with the tofu binary.
+// Expected args: <encoded options> <binary> [binary args...]
+func SandboxInit(args []string) error {
+	if len(args) < minSandboxInitArgs {
+		return fmt.Errorf("invalid sandbox init arguments: %v", args)
+	}
+
+	var opts sandboxOptions
+	if err := json.Unmarshal([]byte(args[0]), &opts); err != nil {
+		return fmt.Errorf("failed to decode sandbox options: %w", err)
+	}
+
+	binary := args[1]
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get sandbox working directory: %w", err)
+	}
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	mountPoints, err := readMountPoints()
+	if err != nil {
+		return err
+	}
+
+	// writable paths get their own mounts so they keep write access when the rest is remounted read-only
+	for _, path := range opts.WritablePaths {
+		if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s: %w", path, err)
+		}
+	}
+
+	// keep handles on the writable paths, the binary directory and the read-only paths, they may be shadowed by the
+	// private /tmp mounted below
+	writable, err := openPaths(opts.WritablePaths)
+	defer closePaths(writable)
+
+	if err != nil {
+		return err
+	}
+
+	readOnly, err := openPaths(append([]string{filepath.Dir(binary)}, opts.ReadOnlyPaths...))
+	defer closePaths(readOnly)
+
+	if err != nil {
+		return err
+	}
+
+	for _, mountPoint := range mountPoints {
+		if withinAny(mountPoint, opts.WritablePaths) {
+			continue
+		}
+
+		if err := remountReadOnly(mountPoint); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Mount("tmpfs", sandboxTmpDir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("failed to mount private %s: %w", sandboxTmpDir, err)
+	}
+
+	for path, dir := range writable {
+		if !isWithin(path, sandboxTmpDir) {
+			continue
+		}
+
+		if err := bindMount(dir, path); err != nil {
+			return err
+		}
+	}
+
+	for path, dir := range readOnly {
+		if !isWithin(path, sandboxTmpDir) {
+			continue
+		}
+
+		if err := bindMount(dir, path); err != nil {
+			return err
+		}
+
+		if err := remountReadOnly(path); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+
+	// re-enter the working directory so it resolves through the writable bind mount
+	if err := os.Chdir(workingDir); err != nil {
+		return fmt.Errorf("failed to enter sandbox working directory: %w", err)
+	}
+
+	if err := syscall.Exec(binary, args[1:], os.Environ()); err != nil {
+		return fmt.Errorf("failed to execute %s: %w", binary, err)
+	}
+
+	return nil
+}
+
+// openPaths opens the given directories, keyed by path
+func openPaths(paths []string) (map[string]*os.File, error) {
+	dirs := make(map[string]*os.File, len(paths))
+
+	for _, path := range paths {
+		dir, err := os.Open(path)
+		if err != nil {
+			return dirs, fmt.Errorf("failed to open sandbox path %s: %w", path, err)
+		}
+
+		dirs[path] = dir
+	}
+
+	return dirs, nil
+}
+
+// closePaths closes directories opened by openPaths
+func closePaths(dirs map[string]*os.File) {
+	for _, dir := range dirs {
+		_ = dir.Close()
+	}
+}
+
+// bindMount mounts the opened directory on path inside the private /tmp
+func bindMount(dir *os.File, path string) error {
+	if err := os.MkdirAll(path, installDirMode); err != nil {
+		return fmt.Errorf("failed to create mount point %s: %w", path, err)
+	}
+
+	source := "/proc/self/fd/" + strconv.Itoa(int(dir.Fd()))
+	if err := syscall.Mount(source, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// remountReadOnly remounts a single mount point read-only, keeping its locked flags
+func remountReadOnly(mountPoint string) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &stat); err != nil {
+		// mount points shadowed by other mounts can't be reached
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EACCES) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to stat mount %s: %w", mountPoint, err)
+	}
+
+	flags := uintptr(syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY) | (uintptr(stat.Flags) & lockedMountFlags)
+
+	if err := syscall.Mount("", mountPoint, "", flags, ""); err != nil {
+		// kernel pseudo filesystems are replaced or unreachable from the sandbox
+		if isWithin(mountPoint, "/proc") || isWithin(mountPoint, "/sys") {
+			return nil
+		}
+
+		return fmt.Errorf("failed to remount %s read-only: %w", mountPoint, err)
+	}
+
+	return nil
+}
+
+// readMountPoints returns the mount points of the current mount namespace
+func readMountPoints() ([]string, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %w", err)
+	}
+	defer file.Close()
+
+	var mountPoints []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= mountInfoMountPointItem {
+			continue
+		}
+
+		mountPoints = append(mountPoints, unescapeMountPath(fields[mountInfoMountPointItem]))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %w", err)
+	}
+
+	return mountPoints, nil
+}
+
+// unescapeMountPath decodes the octal escapes used in /proc/self/mountinfo
+func unescapeMountPath(path string) string {
+	var builder strings.Builder
+
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if value, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				builder.WriteByte(byte(value))
+
+				i += 3
+
+				continue
+			}
+		}
+
+		builder.WriteByte(path[i])
+	}
+
+	return builder.String()
+}
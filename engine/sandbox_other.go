@@ -0,0 +1,20 @@
+//go:build !linux
+
+package engine
+
+import "os/exec"
+
+// configureSandbox is not supported outside of Linux
+func configureSandbox(_ *exec.Cmd, _ *sandboxOptions) error {
+	return ErrSandboxUnsupported
+}
+
+// sandboxStartError returns err unchanged outside of Linux
+func sandboxStartError(err error) error {
+	return err
+}
+
+// SandboxInit is not supported outside of Linux
+func SandboxInit(_ []string) error {
+	return ErrSandboxUnsupported
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package engine_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTofuEngine_RunSandbox(t *testing.T) {
+	t.Parallel()
+
+	workingDir := t.TempDir()
+	hostDir := t.TempDir()
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	readOnlyFile := filepath.Join(cwd, "sandbox-escape.txt")
+	t.Cleanup(func() { _ = os.Remove(readOnlyFile) })
+
+	script := fakeTofu(t, `echo inside > sandboxed.txt
+echo leaked > "`+hostDir+`/leaked.txt"
+echo escaped > "`+readOnlyFile+`" || echo "read-only"
+echo "pid $$"
+`)
+
+	tofuEngine := &engine.TofuEngine{}
+	tofuEngine.SetBinaryPath(script)
+
+	mockStream := &MockRunServer{}
+	err = tofuEngine.Run(&tgengine.RunRequest{
+		WorkingDir: workingDir,
+		Meta:       stringMeta("sandbox", "true"),
+	}, mockStream)
+
+	if errors.Is(err, engine.ErrUserNamespacesUnavailable) {
+		t.Skipf("user namespaces are not available: %v", err)
+	}
+
+	require.NoError(t, err)
+
+	output := stdout(mockStream.Responses)
+	assert.Contains(t, output, "read-only")
+	assert.Contains(t, output, "pid 1")
+	assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+	assert.FileExists(t, filepath.Join(workingDir, "sandboxed.txt"))
+	assert.NoFileExists(t, filepath.Join(hostDir, "leaked.txt"))
+	assert.NoFileExists(t, readOnlyFile)
+}
+
+func TestTofuEngine_RunSandboxInvalidMeta(t *testing.T) {
+	t.Parallel()
+
+	mockStream := &MockRunServer{}
+	err := (&engine.TofuEngine{}).Run(&tgengine.RunRequest{
+		Meta: stringMeta("sandbox", "maybe"),
+	}, mockStream)
+	require.Error(t, err)
+	require.Len(t, mockStream.Responses, 1)
+	assert.Contains(t, mockStream.Responses[0].GetStderr(), "invalid boolean value")
+}
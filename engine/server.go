@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+const (
+	unixScheme = "unix://"
+	tcpScheme  = "tcp://"
+
+	unixSocketMode = 0660
+)
+
+var ErrInvalidListenAddress = errors.New("invalid listen address")
+
+// Server serves the engine on a plain gRPC server, outside of the go-plugin handshake, so that it can run as a
+// shared long-running service. Every client connection gets its own engine.
+type Server struct {
+	grpc     *grpc.Server
+	sessions *sessions
+	health   *engineHealth
+	listener net.Listener
+}
+
+// Listen opens the listener of a listen address, either unix:///path/to/socket or tcp://host:port.
+// A stale Unix socket left behind by a previous server is replaced.
+func Listen(address string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, unixScheme):
+		path := strings.TrimPrefix(address, unixScheme)
+		if path == "" {
+			return nil, fmt.Errorf("%w: %q has no socket path", ErrInvalidListenAddress, address)
+		}
+
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.Chmod(path, unixSocketMode); err != nil {
+			listener.Close()
+
+			return nil, fmt.Errorf("failed to set the permissions of %s: %w", path, err)
+		}
+
+		return listener, nil
+	case strings.HasPrefix(address, tcpScheme):
+		hostPort := strings.TrimPrefix(address, tcpScheme)
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidListenAddress, err)
+		}
+
+		return net.Listen("tcp", hostPort)
+	default:
+		return nil, fmt.Errorf("%w: %q must start with %s or %s", ErrInvalidListenAddress, address, unixScheme, tcpScheme)
+	}
+}
+
+// removeStaleSocket removes a Unix socket which no server accepts connections on anymore
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%w: %s exists and is not a socket", ErrInvalidListenAddress, path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+
+		return fmt.Errorf("%w: another server is listening on %s", ErrInvalidListenAddress, path)
+	}
+
+	return os.Remove(path)
+}
+
+// NewServer registers the engine and the grpc.health.v1 service on a new gRPC server which serves on listener.
+// The health of the server is that of an engine without Init, which runs the tofu of PATH.
+func NewServer(listener net.Listener, opts ...grpc.ServerOption) *Server {
+	server := &Server{sessions: newSessions(), health: newEngineHealth(&TofuEngine{}), listener: listener}
+	server.grpc = grpc.NewServer(append(opts, grpc.StatsHandler(server.sessions))...)
+
+	tgengine.RegisterEngineServer(server.grpc, server.sessions)
+	healthpb.RegisterHealthServer(server.grpc, server.health)
+
+	return server
+}
+
+// EnableReflection registers the server reflection service, e.g. for grpcurl. It must be called before Serve.
+func (s *Server) EnableReflection() {
+	reflection.Register(s.grpc)
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until the server is stopped
+func (s *Server) Serve() error {
+	log.Infof("Serving the engine on %s://%s", s.listener.Addr().Network(), s.listener.Addr())
+
+	if err := s.grpc.Serve(s.listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+
+	return nil
+}
+
+// Stop stops accepting connections and waits for the running RPCs to finish. When ctx is done first, the
+// remaining RPCs are cancelled.
+func (s *Server) Stop(ctx context.Context) {
+	log.Info("Stopping the engine server, waiting for running requests")
+
+	// load balancers stop sending new requests while the running ones finish
+	s.health.stop()
+
+	done := make(chan struct{})
+
+	go func() {
+		s.grpc.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("Graceful stop timed out, cancelling running requests")
+		s.grpc.Stop()
+		<-done
+	}
+
+	s.sessions.closeAll()
+}
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"context"
+	"sync"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/stats"
+)
+
+// sessionIDKey is the context key of the ID of the client connection a request arrived on
+type sessionIDKey struct{}
+
+// sessions serves every client connection of the standalone server with its own TofuEngine. The Init of a client
+// configures the engine of its connection only, and its Shutdown stops only the resources of that engine, such as
+// the provider mirror, so that clients sharing the server don't affect each other's runs. The engine of a
+// connection is closed when the connection ends.
+type sessions struct {
+	tgengine.UnimplementedEngineServer
+	engines map[uint64]*TofuEngine
+	nextID  uint64
+	mu      sync.Mutex
+}
+
+func newSessions() *sessions {
+	return &sessions{engines: map[uint64]*TofuEngine{}}
+}
+
+// engine returns the engine of the connection of a request, creating it on the first request
+func (s *sessions) engine(ctx context.Context) *TofuEngine {
+	id, _ := ctx.Value(sessionIDKey{}).(uint64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	engine, exists := s.engines[id]
+	if !exists {
+		engine = &TofuEngine{session: true}
+		s.engines[id] = engine
+	}
+
+	return engine
+}
+
+// close stops the resources of the engine of a connection and forgets it
+func (s *sessions) close(id uint64) {
+	s.mu.Lock()
+	engine, exists := s.engines[id]
+	delete(s.engines, id)
+	s.mu.Unlock()
+
+	if exists {
+		engine.setMirror(nil)
+	}
+}
+
+// closeAll closes the engines of every connection
+func (s *sessions) closeAll() {
+	s.mu.Lock()
+	ids := make([]uint64, 0, len(s.engines))
+
+	for id := range s.engines {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		s.close(id)
+	}
+}
+
+func (s *sessions) Init(req *tgengine.InitRequest, stream tgengine.Engine_InitServer) error {
+	return s.engine(stream.Context()).Init(req, stream)
+}
+
+func (s *sessions) Run(req *tgengine.RunRequest, stream tgengine.Engine_RunServer) error {
+	return s.engine(stream.Context()).Run(req, stream)
+}
+
+func (s *sessions) Shutdown(req *tgengine.ShutdownRequest, stream tgengine.Engine_ShutdownServer) error {
+	return s.engine(stream.Context()).Shutdown(req, stream)
+}
+
+// TagConn assigns an ID to a new client connection, the requests on the connection carry it in their context
+func (s *sessions) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.mu.Unlock()
+
+	log.Debugf("Client %s connected, session %d", info.RemoteAddr, id)
+
+	return context.WithValue(ctx, sessionIDKey{}, id)
+}
+
+// HandleConn closes the engine of a connection once the connection ends
+func (s *sessions) HandleConn(ctx context.Context, event stats.ConnStats) {
+	if _, ended := event.(*stats.ConnEnd); !ended {
+		return
+	}
+
+	if id, ok := ctx.Value(sessionIDKey{}).(uint64); ok {
+		log.Debugf("Session %d ended", id)
+		s.close(id)
+	}
+}
+
+func (s *sessions) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (s *sessions) HandleRPC(context.Context, stats.RPCStats) {}
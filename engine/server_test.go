@@ -0,0 +1,213 @@
+package engine_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// socketPath returns a Unix socket path short enough for the limit of the platform
+func socketPath(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "engine")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "engine.sock")
+}
+
+// startServer serves the engine on listener and returns a client of it
+func startServer(t *testing.T, listener net.Listener, opts ...grpc.ServerOption) (*engine.Server, chan error) {
+	t.Helper()
+
+	server := engine.NewServer(listener, opts...)
+	served := make(chan error, 1)
+
+	go func() { served <- server.Serve() }()
+
+	t.Cleanup(func() { server.Stop(context.Background()) })
+
+	return server, served
+}
+
+// engineClient connects to an engine server
+func engineClient(t *testing.T, target string, opts ...grpc.DialOption) tgengine.EngineClient {
+	t.Helper()
+
+	if len(opts) == 0 {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	conn, err := grpc.NewClient(target, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return tgengine.NewEngineClient(conn)
+}
+
+// runOutput runs tofu through a client and returns the merged stdout and the result code
+func runOutput(ctx context.Context, client tgengine.EngineClient, req *tgengine.RunRequest) (string, int32, error) {
+	stream, err := client.Run(ctx, req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var (
+		output     string
+		resultCode int32
+	)
+
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return output, resultCode, nil
+		}
+
+		if err != nil {
+			return output, resultCode, err
+		}
+
+		output += response.GetStdout()
+		resultCode = response.GetResultCode()
+	}
+}
+
+// initEngine runs Init through a client with meta given as key, value pairs
+func initEngine(t *testing.T, client tgengine.EngineClient, meta ...string) {
+	t.Helper()
+
+	stream, err := client.Init(t.Context(), &tgengine.InitRequest{Meta: stringMeta(meta...)})
+	require.NoError(t, err)
+
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, int32(0), response.GetResultCode(), response.GetStderr())
+	}
+}
+
+func TestServer_ServesOverUnixSocket(t *testing.T) {
+	// the server runs the tofu of PATH
+	t.Setenv("PATH", filepath.Dir(fakeTofu(t, `sleep 0.5; echo "ran $*"`))+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	path := socketPath(t)
+
+	listener, err := engine.Listen("unix://" + path)
+	require.NoError(t, err)
+
+	server, served := startServer(t, listener)
+	client := engineClient(t, "unix://"+path)
+
+	initEngine(t, client)
+
+	type result struct {
+		err        error
+		output     string
+		resultCode int32
+	}
+
+	running := make(chan result, 1)
+
+	go func() {
+		output, resultCode, err := runOutput(context.Background(), client, &tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"plan"}})
+		running <- result{output: output, resultCode: resultCode, err: err}
+	}()
+
+	// the running request finishes after the stop
+	time.Sleep(200 * time.Millisecond)
+	server.Stop(context.Background())
+
+	run := <-running
+	require.NoError(t, run.err)
+	assert.Equal(t, "ran plan\n", run.output)
+	assert.Equal(t, int32(0), run.resultCode)
+	require.NoError(t, <-served)
+
+	// the socket is free again for the next server, which refuses to share it
+	listener, err = engine.Listen("unix://" + path)
+	require.NoError(t, err)
+
+	_, err = engine.Listen("unix://" + path)
+	require.ErrorIs(t, err, engine.ErrInvalidListenAddress)
+	require.NoError(t, listener.Close())
+}
+
+func TestServer_SessionsPerConnection(t *testing.T) {
+	t.Setenv("PATH", filepath.Dir(fakeTofu(t, `echo "ran $*"; cat "$TF_CLI_CONFIG_FILE" 2>/dev/null`))+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	path := socketPath(t)
+
+	listener, err := engine.Listen("unix://" + path)
+	require.NoError(t, err)
+
+	startServer(t, listener)
+
+	readOnly := engineClient(t, "unix://"+path)
+	mirrored := engineClient(t, "unix://"+path)
+
+	initEngine(t, mirrored, "provider_mirror_dir", mirrorFixtureDir)
+	initEngine(t, readOnly, "command_mode", "read-only")
+
+	// the Init of one client neither applies its policy to the other nor stops the mirror of the other
+	output, resultCode, err := runOutput(t.Context(), mirrored, &tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"apply"}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), resultCode)
+	assert.Contains(t, output, "ran apply\n")
+	assert.Contains(t, output, "network_mirror")
+
+	_, resultCode, err = runOutput(t.Context(), readOnly, &tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"apply"}})
+	require.ErrorContains(t, err, "not allowed by the engine command policy")
+	assert.Equal(t, int32(1), resultCode)
+
+	// neither does its Shutdown
+	shutdown, err := readOnly.Shutdown(t.Context(), &tgengine.ShutdownRequest{})
+	require.NoError(t, err)
+
+	for {
+		if _, err := shutdown.Recv(); err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+	}
+
+	output, _, err = runOutput(t.Context(), mirrored, &tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"plan"}})
+	require.NoError(t, err)
+	assert.Contains(t, output, "network_mirror")
+}
+
+func TestListen(t *testing.T) {
+	t.Parallel()
+
+	listener, err := engine.Listen("tcp://127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	for _, address := range []string{"127.0.0.1:7000", "http://127.0.0.1:7000", "tcp://127.0.0.1", "unix://"} {
+		_, err := engine.Listen(address)
+		require.ErrorIs(t, err, engine.ErrInvalidListenAddress, address)
+	}
+
+	// a file which is not a socket is never removed
+	file := filepath.Join(t.TempDir(), "engine.sock")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+
+	_, err = engine.Listen("unix://" + file)
+	require.ErrorIs(t, err, engine.ErrInvalidListenAddress)
+	assert.FileExists(t, file)
+}
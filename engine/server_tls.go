@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrInvalidTLSConfig = errors.New("invalid TLS configuration")
+
+// ServerTLSConfig configures TLS of the standalone server. With a client CA, clients must present a certificate
+// signed by it (mutual TLS).
+type ServerTLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// tlsReloader serves the certificate and client CA pool of the current files, so that renewed certificates are
+// picked up by new connections without a restart
+type tlsReloader struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	config    ServerTLSConfig
+	mu        sync.Mutex
+}
+
+// TLSConfig loads the certificates and returns the TLS configuration of the server. The files are checked for
+// changes on every handshake and reloaded, a failing reload keeps the previous certificates.
+func (c ServerTLSConfig) TLSConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("%w: a certificate and a key are required", ErrInvalidTLSConfig)
+	}
+
+	reloader := &tlsReloader{config: c}
+
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.current(), nil
+		},
+	}, nil
+}
+
+// files returns the files the configuration is loaded from
+func (r *tlsReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+
+	return files
+}
+
+// changed reports whether a file was modified since the last load
+func (r *tlsReloader) changed() bool {
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reload loads the certificate, key and client CA pool from their files
+func (r *tlsReloader) reload() error {
+	modTimes := map[string]time.Time{}
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTLSConfig, err)
+		}
+
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTLSConfig, err)
+	}
+
+	var clientCAs *x509.CertPool
+
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTLSConfig, err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: no certificates in %s", ErrInvalidTLSConfig, r.config.ClientCAFile)
+		}
+	}
+
+	r.cert, r.clientCAs, r.modTimes = &cert, clientCAs, modTimes
+
+	return nil
+}
+
+// current returns the TLS configuration of a new connection, reloading the files when they changed
+func (r *tlsReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			log.Warnf("Failed to reload TLS certificates, keeping the previous ones: %v", err)
+		} else {
+			log.Info("Reloaded TLS certificates")
+		}
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*r.cert}}
+
+	if r.clientCAs != nil {
+		config.ClientCAs = r.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config
+}
@@ -0,0 +1,234 @@
+package engine_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// testCA is a locally generated certificate authority
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a certificate for a server at 127.0.0.1 or for a client, and returns its certificate and key PEM
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCredentials returns the transport credentials of a client trusting ca, with a client certificate when
+// certPEM is set
+func clientCredentials(t *testing.T, ca *testCA, certPEM, keyPEM []byte) grpc.DialOption {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	if certPEM != nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		require.NoError(t, err)
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(config))
+}
+
+// canInit reports whether Init succeeds through a client
+func canInit(t *testing.T, client tgengine.EngineClient) error {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Init(ctx, &tgengine.InitRequest{})
+	if err != nil {
+		return err
+	}
+
+	_, err = stream.Recv()
+
+	return err
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile, clientCAFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "clients.crt")
+
+	serverCA, clientCA := newTestCA(t, "server CA"), newTestCA(t, "client CA")
+
+	writeServerCert := func(ca *testCA) {
+		t.Helper()
+
+		certPEM, keyPEM := ca.issue(t, "engine", x509.ExtKeyUsageServerAuth)
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	}
+
+	writeServerCert(serverCA)
+	require.NoError(t, os.WriteFile(clientCAFile, clientCA.pem, 0600))
+
+	tlsConfig, err := engine.ServerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile}.TLSConfig()
+	require.NoError(t, err)
+
+	listener, err := engine.Listen("tcp://127.0.0.1:0")
+	require.NoError(t, err)
+
+	server, _ := startServer(t, listener, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	target := server.Addr().String()
+
+	clientCert, clientKey := clientCA.issue(t, "terragrunt", x509.ExtKeyUsageClientAuth)
+	require.NoError(t, canInit(t, engineClient(t, target, clientCredentials(t, serverCA, clientCert, clientKey))))
+
+	// clients without a certificate of the client CA are rejected
+	require.Error(t, canInit(t, engineClient(t, target, clientCredentials(t, serverCA, nil, nil))))
+
+	otherCert, otherKey := newTestCA(t, "other CA").issue(t, "intruder", x509.ExtKeyUsageClientAuth)
+	require.Error(t, canInit(t, engineClient(t, target, clientCredentials(t, serverCA, otherCert, otherKey))))
+
+	require.Error(t, canInit(t, engineClient(t, target, grpc.WithTransportCredentials(insecure.NewCredentials()))))
+
+	// a renewed certificate is served to new connections without a restart
+	renewedCA := newTestCA(t, "renewed server CA")
+	writeServerCert(renewedCA)
+
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+
+	require.NoError(t, canInit(t, engineClient(t, target, clientCredentials(t, renewedCA, clientCert, clientKey))))
+	require.Error(t, canInit(t, engineClient(t, target, clientCredentials(t, serverCA, clientCert, clientKey))))
+
+	// a broken certificate keeps the previous one
+	require.NoError(t, os.WriteFile(certFile, []byte("broken"), 0600))
+	require.NoError(t, os.Chtimes(certFile, future.Add(time.Minute), future.Add(time.Minute)))
+	require.NoError(t, canInit(t, engineClient(t, target, clientCredentials(t, renewedCA, clientCert, clientKey))))
+}
+
+func TestServerTLSConfig_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := engine.ServerTLSConfig{CertFile: "server.crt"}.TLSConfig()
+	require.ErrorIs(t, err, engine.ErrInvalidTLSConfig)
+
+	dir := t.TempDir()
+	certPEM, keyPEM := newTestCA(t, "CA").issue(t, "engine", x509.ExtKeyUsageServerAuth)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server.crt"), certPEM, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server.key"), keyPEM, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "clients.crt"), []byte("no certificates"), 0600))
+
+	_, err = engine.ServerTLSConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "clients.crt"),
+	}.TLSConfig()
+	require.ErrorIs(t, err, engine.ErrInvalidTLSConfig)
+}
+
+func TestPluginClient_AutoMTLS(t *testing.T) {
+	t.Parallel()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), engine.TestPluginEnv+"=1")
+
+	client := engine.NewPluginClient(cmd, hclog.NewNullLogger())
+	t.Cleanup(client.Kill)
+
+	rpcClient, err := client.Client()
+	require.NoError(t, err)
+
+	raw, err := rpcClient.Dispense(engine.PluginName)
+	require.NoError(t, err)
+
+	engineClient, ok := raw.(tgengine.EngineClient)
+	require.True(t, ok)
+	require.NoError(t, canInit(t, engineClient))
+
+	// the plugin only accepts the client holding the certificate go-plugin generated
+	conn, err := grpc.NewClient("passthrough:///"+client.ReattachConfig().Addr.String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			addr := client.ReattachConfig().Addr
+
+			return (&net.Dialer{}).DialContext(ctx, addr.Network(), addr.String())
+		}))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	assert.Error(t, canInit(t, tgengine.NewEngineClient(conn)))
+}
@@ -0,0 +1,426 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	metaStateBackup          = "state_backup"
+	metaStateBackupDir       = "state_backup_dir"
+	metaStateBackupCompress  = "state_backup_compress"
+	metaStateBackupRetention = "state_backup_retention"
+	metaStateBackupMaxAge    = "state_backup_max_age"
+
+	defaultStateBackupRetention = 10
+	stateBackupDirMode          = 0700
+	stateBackupFileMode         = 0600
+	stateBackupUnitFile         = "unit"
+	stateBackupTimeFormat       = "20060102T150405.000000000Z"
+	stateFileSuffix             = ".tfstate"
+	gzipSuffix                  = ".gz"
+)
+
+var (
+	ErrStateBackupFailed   = errors.New("failed to back up state")
+	ErrInvalidStateBackup  = errors.New("invalid state backup configuration")
+	ErrStateBackupNotFound = errors.New("state backup not found")
+	ErrStateRestoreFailed  = errors.New("failed to restore state")
+
+	// stateMutatingCommands are the subcommands which are preceded by a state backup
+	stateMutatingCommands = [][]string{{"apply"}, {"destroy"}, {"import"}, {"state", "mv"}, {"state", "rm"}}
+
+	stateBackupNamePattern = regexp.MustCompile(`^(\d{8}T\d{6}\.\d{9}Z)-serial(\d+)\.tfstate(\.gz)?$`)
+	unitNameSanitize       = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// StateBackup is a state snapshot in the backup directory
+type StateBackup struct {
+	Time       time.Time `json:"time"`
+	Unit       string    `json:"unit"`
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Serial     int64     `json:"serial"`
+	Size       int64     `json:"size"`
+	Compressed bool      `json:"compressed"`
+}
+
+// stateBackupConfig configures the state snapshots taken before mutating runs
+type stateBackupConfig struct {
+	dir       string
+	retention int
+	maxAge    time.Duration
+	compress  bool
+}
+
+// DefaultStateBackupDir returns the default state backup directory, next to the OpenTofu download cache
+func DefaultStateBackupDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+
+	return filepath.Join(homeDir, ".cache", "terragrunt", "tofudl", "state-backups"), nil
+}
+
+// parseStateBackupConfig builds the state backup configuration from Init meta, nil is returned when backups are disabled
+func parseStateBackupConfig(meta map[string]*anypb.Any) (*stateBackupConfig, error) {
+	enabled, err := metaBool(meta, metaStateBackup)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	config := &stateBackupConfig{dir: metaString(meta, metaStateBackupDir)}
+
+	if config.dir == "" {
+		if config.dir, err = DefaultStateBackupDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.dir, err = filepath.Abs(config.dir); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStateBackup, err)
+	}
+
+	if config.compress, err = metaBool(meta, metaStateBackupCompress); err != nil {
+		return nil, err
+	}
+
+	if config.retention, err = metaInt(meta, metaStateBackupRetention, defaultStateBackupRetention); err != nil {
+		return nil, err
+	}
+
+	if config.maxAge, err = metaDuration(meta, metaStateBackupMaxAge, 0); err != nil {
+		return nil, err
+	}
+
+	if config.retention < 0 || config.maxAge < 0 {
+		return nil, fmt.Errorf("%w: %s and %s must not be negative", ErrInvalidStateBackup, metaStateBackupRetention, metaStateBackupMaxAge)
+	}
+
+	if err := os.MkdirAll(config.dir, stateBackupDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create state backup directory %s: %w", config.dir, err)
+	}
+
+	return config, nil
+}
+
+// mutatesState reports whether args run a subcommand which changes the state
+func mutatesState(args []string) bool {
+	words, _ := splitCommandArgs(args)
+
+	for _, command := range stateMutatingCommands {
+		if len(words) >= len(command) && slices.Equal(words[:len(command)], command) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backupState pulls the state of the unit of a mutating run and stores it as a snapshot.
+// Nothing is stored when the unit has no state yet, and nil is returned.
+func (c *TofuEngine) backupState(req *tgengine.RunRequest, opts *runOptions, config *stateBackupConfig) (*StateBackup, error) {
+	output, err := c.capture(req, opts, "state", "pull")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStateBackupFailed, err)
+	}
+
+	state := bytes.TrimSpace(output)
+	if len(state) == 0 {
+		return nil, nil
+	}
+
+	var header struct {
+		Serial int64 `json:"serial"`
+	}
+
+	if err := json.Unmarshal(state, &header); err != nil {
+		return nil, fmt.Errorf("%w: tofu state pull returned invalid state: %w", ErrStateBackupFailed, err)
+	}
+
+	unit := moduleDir(opts.workingDir, req.GetArgs())
+
+	backup, err := writeStateBackup(config, unit, header.Serial, append(state, '\n'))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStateBackupFailed, err)
+	}
+
+	if err := pruneStateBackups(opts.log, config, unit); err != nil {
+		opts.log.Warnf("Failed to prune state backups of %s: %v", unit, err)
+	}
+
+	return backup, nil
+}
+
+// stateBackupUnitDir returns the backup directory of a unit
+func stateBackupUnitDir(dir, unit string) string {
+	return filepath.Join(dir, unitFileName(unit))
+}
+
+// unitFileName names the files of a unit after the unit and a hash of its path
+func unitFileName(unit string) string {
+	sum := sha256.Sum256([]byte(unit))
+	name := unitNameSanitize.ReplaceAllString(filepath.Base(unit), "_")
+
+	return name + "-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// writeStateBackup stores a snapshot of the state of unit
+func writeStateBackup(config *stateBackupConfig, unit string, serial int64, state []byte) (*StateBackup, error) {
+	unitDir := stateBackupUnitDir(config.dir, unit)
+	if err := os.MkdirAll(unitDir, stateBackupDirMode); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(unitDir, stateBackupUnitFile), []byte(unit+"\n"), stateBackupFileMode); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-serial%d%s", now.Format(stateBackupTimeFormat), serial, stateFileSuffix)
+
+	content := state
+
+	if config.compress {
+		name += gzipSuffix
+
+		var compressed bytes.Buffer
+
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(state); err != nil {
+			return nil, err
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		content = compressed.Bytes()
+	}
+
+	path := filepath.Join(unitDir, name)
+	if err := writeFileAtomic(path, content); err != nil {
+		return nil, err
+	}
+
+	return &StateBackup{
+		Time:       now,
+		Unit:       unit,
+		Name:       name,
+		Path:       path,
+		Serial:     serial,
+		Size:       int64(len(content)),
+		Compressed: config.compress,
+	}, nil
+}
+
+// pruneStateBackups removes the snapshots of unit beyond the retention count or older than the maximum age
+func pruneStateBackups(logger *log.Entry, config *stateBackupConfig, unit string) error {
+	backups, err := ListStateBackups(config.dir, unit)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for i, backup := range backups {
+		// backups are listed newest first
+		expired := config.maxAge > 0 && time.Since(backup.Time) > config.maxAge
+		if (config.retention > 0 && i >= config.retention) || expired {
+			logger.Debugf("Removing state backup %s", backup.Path)
+			errs = append(errs, os.Remove(backup.Path))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ListStateBackups returns the state snapshots in dir, newest first. With a unit, only the snapshots of that unit
+// are returned.
+func ListStateBackups(dir, unit string) ([]StateBackup, error) {
+	var unitDirs []string
+
+	if unit != "" {
+		absUnit, err := filepath.Abs(unit)
+		if err != nil {
+			return nil, err
+		}
+
+		unitDirs = []string{stateBackupUnitDir(dir, absUnit)}
+	} else {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				unitDirs = append(unitDirs, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	var backups []StateBackup
+
+	for _, unitDir := range unitDirs {
+		unitPath, err := os.ReadFile(filepath.Join(unitDir, stateBackupUnitFile))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		entries, err := os.ReadDir(unitDir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			match := stateBackupNamePattern.FindStringSubmatch(entry.Name())
+			if match == nil {
+				continue
+			}
+
+			backupTime, err := time.Parse(stateBackupTimeFormat, match[1])
+			if err != nil {
+				continue
+			}
+
+			serial, _ := strconv.ParseInt(match[2], 10, 64)
+
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+
+			backups = append(backups, StateBackup{
+				Time:       backupTime,
+				Unit:       strings.TrimSpace(string(unitPath)),
+				Name:       entry.Name(),
+				Path:       filepath.Join(unitDir, entry.Name()),
+				Serial:     serial,
+				Size:       info.Size(),
+				Compressed: match[3] != "",
+			})
+		}
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+// FindStateBackup returns the snapshot of unit with the given name, or the newest one when name is empty
+func FindStateBackup(dir, unit, name string) (*StateBackup, error) {
+	backups, err := ListStateBackups(dir, unit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range backups {
+		if name == "" || backups[i].Name == name {
+			return &backups[i], nil
+		}
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("%w: %s has no state backups", ErrStateBackupNotFound, unit)
+	}
+
+	return nil, fmt.Errorf("%w: %s of %s", ErrStateBackupNotFound, name, unit)
+}
+
+// RestoreStateBackup pushes a snapshot back with `tofu state push` in the unit of the snapshot, run by executor like
+// the tofu processes of runs. With force, the push is forced even if the snapshot has an older serial or a different
+// lineage than the current state.
+func RestoreStateBackup(backup *StateBackup, executor Executor, binary string, force bool, stdout, stderr io.Writer) error {
+	state, err := readStateBackup(backup)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStateRestoreFailed, err)
+	}
+
+	stateFile, err := os.CreateTemp(backup.Unit, ".terragrunt-engine-restore-*"+stateFileSuffix)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStateRestoreFailed, err)
+	}
+
+	defer func() {
+		_ = os.Remove(stateFile.Name())
+	}()
+
+	_, err = stateFile.Write(state)
+	if closeErr := stateFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStateRestoreFailed, err)
+	}
+
+	args := []string{"state", "push"}
+	if force {
+		args = append(args, "-force")
+	}
+
+	spec := &ExecSpec{Binary: binary, Args: append(args, stateFile.Name()), Dir: backup.Unit}
+
+	exitCode, pushStdout, pushStderr, err := runProcess(context.Background(), executor, spec)
+
+	_, _ = stdout.Write(pushStdout)
+	_, _ = stderr.Write(pushStderr)
+
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: tofu state push: %w", ErrStateRestoreFailed, err)
+	}
+
+	return nil
+}
+
+// readStateBackup returns the uncompressed state of a snapshot
+func readStateBackup(backup *StateBackup) ([]byte, error) {
+	file, err := os.Open(backup.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if !backup.Compressed {
+		return io.ReadAll(file)
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,120 @@
+package engine_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stateTofu fakes a tofu whose state serial is kept in a file of the working directory and bumped by apply
+const stateTofu = `case "$1 $2" in
+"state pull") if [ -f serial ]; then echo "{\"version\": 4, \"serial\": $(cat serial)}"; fi ;;
+"state push") echo "pushed $(cat "$3")" ;;
+apply*|destroy*) echo $(( $(cat serial 2>/dev/null || echo 0) + 1 )) > serial; echo applied ;;
+*) echo "ran $*" ;;
+esac
+`
+
+func TestTofuEngine_RunBacksUpState(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	workingDir := t.TempDir()
+	binary := fakeTofu(t, stateTofu)
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta(
+		"state_backup", "true",
+		"state_backup_dir", backupDir,
+		"state_backup_compress", "true",
+		"state_backup_retention", "2",
+	)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(binary)
+
+	run := func(args ...string) string {
+		t.Helper()
+
+		mockStream := &MockRunServer{}
+		require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: args}, mockStream))
+		require.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+		return stdout(mockStream.Responses)
+	}
+
+	// there is no state to back up before the first apply
+	assert.NotContains(t, run("apply", "-auto-approve"), "Backed up state")
+
+	for range 3 {
+		assert.Contains(t, run("apply", "-auto-approve"), "Backed up state")
+	}
+
+	assert.NotContains(t, run("plan"), "Backed up state")
+
+	backups, err := engine.ListStateBackups(backupDir, workingDir)
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	assert.Equal(t, int64(3), backups[0].Serial)
+	assert.Equal(t, int64(2), backups[1].Serial)
+	assert.True(t, backups[0].Compressed)
+	assert.Equal(t, workingDir, backups[0].Unit)
+
+	backup, err := engine.FindStateBackup(backupDir, workingDir, backups[1].Name)
+	require.NoError(t, err)
+
+	local, err := engine.NewExecutor(nil)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, engine.RestoreStateBackup(backup, local, binary, false, &out, &out))
+	assert.Equal(t, `pushed {"version": 4, "serial": 2}`, strings.TrimSpace(out.String()))
+
+	// restores run through the configured executor, like runs
+	docker := &fakeDocker{images: map[string]bool{"example/tofu:1.9": true}, stdout: "pushed in container\n"}
+	dockerExecutor, err := engine.NewExecutor(map[string]string{
+		"executor":      "docker",
+		"docker_host":   startFakeDocker(t, docker),
+		"docker_image":  "example/tofu:1.9",
+		"docker_binary": "/usr/local/bin/tofu",
+	})
+	require.NoError(t, err)
+
+	out.Reset()
+	require.NoError(t, engine.RestoreStateBackup(backup, dockerExecutor, binary, true, &out, &out))
+	assert.Equal(t, "pushed in container\n", out.String())
+
+	docker.mu.Lock()
+	require.Len(t, docker.created, 1)
+	assert.Equal(t, []string{"/usr/local/bin/tofu", "state", "push", "-force"}, docker.created[0].Cmd[:4])
+	assert.Equal(t, workingDir, docker.created[0].WorkingDir)
+	docker.mu.Unlock()
+
+	_, err = engine.FindStateBackup(backupDir, t.TempDir(), "")
+	require.ErrorIs(t, err, engine.ErrStateBackupNotFound)
+}
+
+func TestTofuEngine_RunRefusesWithoutStateBackup(t *testing.T) {
+	t.Parallel()
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("state_backup", "true", "state_backup_dir", t.TempDir())}, &MockInitServer{}))
+
+	marker := filepath.Join(t.TempDir(), "applied")
+	tofuEngine.SetBinaryPath(fakeTofu(t, `[ "$1" = state ] && { echo "backend unreachable" >&2; exit 1; }
+touch "`+marker+`"
+`))
+
+	mockStream := &MockRunServer{}
+	err := tofuEngine.Run(&tgengine.RunRequest{WorkingDir: t.TempDir(), Args: []string{"destroy", "-auto-approve"}}, mockStream)
+	require.ErrorIs(t, err, engine.ErrStateBackupFailed)
+	assert.Contains(t, stderr(mockStream.Responses), "backend unreachable")
+
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err), "destroy must not run without a state backup")
+}
@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// TraceExporterEnv selects the exporter of the engine traces: otlp or file. Tracing is disabled without it.
+	TraceExporterEnv = "TG_ENGINE_TRACE_EXPORTER"
+	// TraceFileEnv is the file the file exporter appends spans to, one JSON object per line
+	TraceFileEnv = "TG_ENGINE_TRACE_FILE"
+
+	traceExporterOTLP = "otlp"
+	traceExporterFile = "file"
+
+	traceFileName = "traces.jsonl"
+	traceFileMode = 0600
+	traceDirMode  = 0700
+
+	serviceName = "terragrunt-engine-opentofu"
+	tracerName  = "github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+)
+
+// span attributes
+const (
+	attrWorkingDir = attribute.Key("tofu.working_dir")
+	attrSubcommand = attribute.Key("tofu.subcommand")
+	attrVersion    = attribute.Key("tofu.version")
+	attrExitCode   = attribute.Key("tofu.exit_code")
+	attrBinary     = attribute.Key("tofu.binary")
+)
+
+var ErrInvalidTraceExporter = errors.New("invalid trace exporter")
+
+// tracer creates the engine spans, through the global provider which is a no-op until tracing is started
+var tracer = otel.Tracer(tracerName)
+
+// TracingConfig selects where the engine exports its spans
+type TracingConfig struct {
+	// Exporter is otlp, file, or empty when tracing is disabled. The OTLP exporter sends spans over gRPC and is
+	// configured by the standard OTEL_EXPORTER_OTLP_* environment variables.
+	Exporter string
+	// File is the file of the file exporter, ~/.cache/terragrunt/tofudl/traces.jsonl by default
+	File string
+}
+
+// TracingConfigFromEnv reads the tracing configuration from TG_ENGINE_TRACE_EXPORTER and TG_ENGINE_TRACE_FILE
+func TracingConfigFromEnv() TracingConfig {
+	return TracingConfig{
+		Exporter: strings.ToLower(os.Getenv(TraceExporterEnv)),
+		File:     os.Getenv(TraceFileEnv),
+	}
+}
+
+// StartTracing installs the global tracer provider and the W3C trace context propagator. The returned function
+// flushes the remaining spans and stops the exporter. Without an exporter, tracing stays disabled.
+func StartTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	var (
+		processor sdktrace.SpanProcessor
+		closeFile func() error
+	)
+
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case traceExporterOTLP:
+		exporter, err := otlptracegrpc.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		}
+
+		processor = sdktrace.NewBatchSpanProcessor(exporter)
+	case traceExporterFile:
+		file, err := openTraceFile(config.File)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+
+			return nil, fmt.Errorf("failed to create file trace exporter: %w", err)
+		}
+
+		// spans are written as they end, the plugin process may be killed before a batch is flushed
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+		closeFile = file.Close
+	default:
+		return nil, fmt.Errorf("%w %q, must be %s or %s", ErrInvalidTraceExporter, config.Exporter, traceExporterOTLP, traceExporterFile)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		log.Warnf("Failed to detect the trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(processor), sdktrace.WithResource(res))
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	log.Infof("Exporting traces with the %s exporter", config.Exporter)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			err = errors.Join(err, closeFile())
+		}
+
+		return err
+	}, nil
+}
+
+// openTraceFile opens the file of the file exporter for appending
+func openTraceFile(path string) (*os.File, error) {
+	if path == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user cache directory: %w", err)
+		}
+
+		path = filepath.Join(cacheDir, "terragrunt", "tofudl", traceFileName)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), traceDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create directory of %s: %w", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, traceFileMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+
+	return file, nil
+}
+
+// flushTraces exports the ended spans, so that they are not lost when the plugin is killed after Shutdown
+func flushTraces(ctx context.Context) {
+	provider, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	if !ok {
+		return
+	}
+
+	if err := provider.ForceFlush(ctx); err != nil {
+		log.Warnf("Failed to flush traces: %v", err)
+	}
+}
+
+// metadataCarrier reads and writes trace context in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// traceContext returns ctx with the trace context of its incoming gRPC metadata, so that the engine spans join
+// the trace of the caller
+func traceContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+// spanError marks span as failed with err, when it is not nil
+func spanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	spanError(span, err)
+	span.End()
+}
+
+// tracedStream is a Run stream whose context carries the Run span and which keeps the result code
+type tracedStream struct {
+	*resultStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// traceRun runs a Run through run in a span, which is the parent of the spans of the run
+func traceRun(req *tgengine.RunRequest, stream tgengine.Engine_RunServer, run func(tgengine.Engine_RunServer) error) error {
+	ctx, span := tracer.Start(traceContext(stream.Context()), "Run", trace.WithAttributes(
+		attrWorkingDir.String(req.GetWorkingDir()),
+		attrSubcommand.String(subcommand(req.GetArgs())),
+	))
+
+	traced := &tracedStream{resultStream: newResultStream(stream, nil), ctx: ctx}
+
+	err := run(traced)
+
+	exitCode := traced.exitCode(err)
+
+	span.SetAttributes(attrExitCode.Int(exitCode))
+
+	if err == nil && exitCode != 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("tofu exited with %d", exitCode))
+	}
+
+	endSpan(span, err)
+
+	return err
+}
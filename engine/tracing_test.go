@@ -0,0 +1,153 @@
+package engine_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+// exportedSpan is the part of a span written by the file exporter which the tests check
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	Parent struct {
+		TraceID string
+		SpanID  string
+	}
+	Attributes []struct {
+		Key   string
+		Value struct {
+			Value any
+		}
+	}
+	Status struct {
+		Code string
+	}
+}
+
+func (s exportedSpan) attribute(key string) any {
+	for _, attribute := range s.Attributes {
+		if attribute.Key == key {
+			return attribute.Value.Value
+		}
+	}
+
+	return nil
+}
+
+// contextRunServer is a Run stream with the context of an incoming request
+type contextRunServer struct {
+	MockRunServer
+	ctx context.Context
+}
+
+func (s *contextRunServer) Context() context.Context {
+	return s.ctx
+}
+
+// contextInitServer is an Init stream with the context of an incoming request
+type contextInitServer struct {
+	MockInitServer
+	ctx context.Context
+}
+
+func (s *contextInitServer) Context() context.Context {
+	return s.ctx
+}
+
+// readSpans returns the spans of a trace from the file of the file exporter, by name
+func readSpans(t *testing.T, path, traceID string) map[string]exportedSpan {
+	t.Helper()
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	spans := map[string]exportedSpan{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), 1024*1024)
+
+	for scanner.Scan() {
+		var span exportedSpan
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &span))
+
+		if span.SpanContext.TraceID == traceID {
+			spans[span.Name] = span
+		}
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return spans
+}
+
+func TestTofuEngine_Tracing(t *testing.T) {
+	// the tracer provider is global, spans of other tests are told apart by their trace
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+
+	traceFile := filepath.Join(t.TempDir(), "traces.jsonl")
+
+	shutdown, err := engine.StartTracing(t.Context(), engine.TracingConfig{Exporter: "file", File: traceFile})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, shutdown(context.Background())) })
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", "00-"+traceID+"-"+parentSpanID+"-01"))
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{}, &contextInitServer{ctx: ctx}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `echo "planned"; exit 2`))
+
+	workingDir := t.TempDir()
+
+	require.NoError(t, tofuEngine.Run(&tgengine.RunRequest{WorkingDir: workingDir, Args: []string{"plan", "-input=false"}}, &contextRunServer{ctx: ctx}))
+
+	spans := readSpans(t, traceFile, traceID)
+
+	initSpan, exists := spans["Init"]
+	require.True(t, exists, "no Init span in %v", spans)
+	assert.Equal(t, parentSpanID, initSpan.Parent.SpanID)
+
+	run, exists := spans["Run"]
+	require.True(t, exists, "no Run span in %v", spans)
+	assert.Equal(t, parentSpanID, run.Parent.SpanID)
+	assert.Equal(t, workingDir, run.attribute("tofu.working_dir"))
+	assert.Equal(t, "plan", run.attribute("tofu.subcommand"))
+	assert.InDelta(t, 2, run.attribute("tofu.exit_code"), 0)
+	assert.Equal(t, "Error", run.Status.Code)
+
+	for _, name := range []string{"spawn", "stream", "wait"} {
+		span, exists := spans[name]
+		require.True(t, exists, "no %s span in %v", name, spans)
+		assert.Equal(t, run.SpanContext.SpanID, span.Parent.SpanID, name)
+	}
+
+	assert.InDelta(t, 2, spans["wait"].attribute("tofu.exit_code"), 0)
+}
+
+func TestStartTracing_InvalidExporter(t *testing.T) {
+	t.Parallel()
+
+	_, err := engine.StartTracing(t.Context(), engine.TracingConfig{Exporter: "zipkin"})
+	require.ErrorIs(t, err, engine.ErrInvalidTraceExporter)
+
+	// without an exporter tracing stays disabled
+	shutdown, err := engine.StartTracing(t.Context(), engine.TracingConfig{})
+	require.NoError(t, err)
+	require.NoError(t, shutdown(t.Context()))
+}
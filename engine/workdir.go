@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const metaAllowedRoots = "allowed_roots"
+
+var (
+	ErrInvalidWorkingDir    = errors.New("invalid working directory")
+	ErrWorkingDirNotAllowed = errors.New("working directory is outside of the allowed roots")
+)
+
+// parseAllowedRoots resolves the allowed roots from Init meta to absolute paths without symlinks
+func parseAllowedRoots(meta map[string]*anypb.Any) ([]string, error) {
+	return resolveRoots(metaStrings(meta, metaAllowedRoots))
+}
+
+// resolveRoots returns the absolute paths of roots with symlinks resolved
+func resolveRoots(roots []string) ([]string, error) {
+	resolved := make([]string, 0, len(roots))
+
+	for _, root := range roots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve allowed root %s: %w", root, err)
+		}
+
+		realRoot, err := filepath.EvalSymlinks(absRoot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve allowed root %s: %w", root, err)
+		}
+
+		resolved = append(resolved, realRoot)
+	}
+
+	return resolved, nil
+}
+
+// resolveWorkingDir validates the working directory of a run and returns its absolute path.
+// An empty working directory is the engine's current directory. When allowed roots are configured, the
+// working directory and any -chdir target must resolve, symlinks included, to a path inside one of them.
+func resolveWorkingDir(workingDir string, allowedRoots, args []string) (string, error) {
+	if workingDir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("%w: failed to get current directory: %w", ErrInvalidWorkingDir, err)
+		}
+
+		workingDir = cwd
+	}
+
+	absDir, err := filepath.Abs(workingDir)
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %w", ErrInvalidWorkingDir, workingDir, err)
+	}
+
+	info, err := os.Stat(absDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%w %s: directory does not exist", ErrInvalidWorkingDir, absDir)
+		}
+
+		return "", fmt.Errorf("%w %s: %w", ErrInvalidWorkingDir, absDir, err)
+	}
+
+	if !info.IsDir() {
+		return "", fmt.Errorf("%w %s: not a directory", ErrInvalidWorkingDir, absDir)
+	}
+
+	if len(allowedRoots) == 0 {
+		return absDir, nil
+	}
+
+	if err := checkAllowedRoot(absDir, allowedRoots); err != nil {
+		return "", err
+	}
+
+	for _, arg := range args {
+		if chdir, found := strings.CutPrefix(arg, "-chdir="); found {
+			target := chdir
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(absDir, target)
+			}
+
+			if err := checkAllowedRoot(target, allowedRoots); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return absDir, nil
+}
+
+// moduleDir returns the directory of the root module tofu operates on, which -chdir moves away from the working directory
+func moduleDir(workingDir string, args []string) string {
+	dir := workingDir
+
+	for _, arg := range args {
+		if chdir, found := strings.CutPrefix(arg, "-chdir="); found {
+			dir = chdir
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(workingDir, chdir)
+			}
+		}
+	}
+
+	return dir
+}
+
+// checkAllowedRoot verifies that dir resolves to a path inside one of the allowed roots
+func checkAllowedRoot(dir string, allowedRoots []string) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", ErrInvalidWorkingDir, dir, err)
+	}
+
+	if !withinAny(realDir, allowedRoots) {
+		return fmt.Errorf("%w: %s (resolved to %s), allowed roots: %s", ErrWorkingDirNotAllowed, dir, realDir, strings.Join(allowedRoots, ", "))
+	}
+
+	return nil
+}
+
+// withinAny reports whether path is within any of the parents
+func withinAny(path string, parents []string) bool {
+	for _, parent := range parents {
+		if isWithin(path, parent) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isWithin reports whether path is parent itself or a descendant of it
+func isWithin(path, parent string) bool {
+	rel, err := filepath.Rel(parent, path)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
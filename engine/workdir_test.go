@@ -0,0 +1,83 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	tgengine "github.com/gruntwork-io/terragrunt-engine-go/proto"
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTofuEngine_RunMissingWorkingDir(t *testing.T) {
+	t.Parallel()
+
+	missingDir := filepath.Join(t.TempDir(), "missing")
+
+	mockStream := &MockRunServer{}
+	err := (&engine.TofuEngine{}).Run(&tgengine.RunRequest{WorkingDir: missingDir, Args: []string{"plan"}}, mockStream)
+	require.ErrorIs(t, err, engine.ErrInvalidWorkingDir)
+	require.Len(t, mockStream.Responses, 1)
+	assert.Contains(t, mockStream.Responses[0].GetStderr(), missingDir+": directory does not exist")
+	assert.Equal(t, int32(1), mockStream.Responses[0].GetResultCode())
+}
+
+func TestTofuEngine_RunAllowedRoots(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	unit := filepath.Join(root, "unit")
+	require.NoError(t, os.Mkdir(unit, 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+
+	tofuEngine := &engine.TofuEngine{}
+	require.NoError(t, tofuEngine.Init(&tgengine.InitRequest{Meta: stringMeta("allowed_roots", root)}, &MockInitServer{}))
+	tofuEngine.SetBinaryPath(fakeTofu(t, `pwd`))
+
+	testCases := []struct {
+		name       string
+		workingDir string
+		args       []string
+		allowed    bool
+	}{
+		{name: "unit", workingDir: unit, allowed: true},
+		{name: "root", workingDir: root, allowed: true},
+		{name: "relative", workingDir: filepath.Join(unit, ".."), allowed: true},
+		{name: "outside", workingDir: outside},
+		{name: "symlink escape", workingDir: filepath.Join(root, "escape")},
+		{name: "chdir escape", workingDir: unit, args: []string{"-chdir=" + outside, "plan"}},
+		{name: "chdir inside", workingDir: root, args: []string{"-chdir=unit", "plan"}, allowed: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockStream := &MockRunServer{}
+			err := tofuEngine.Run(&tgengine.RunRequest{WorkingDir: tc.workingDir, Args: tc.args}, mockStream)
+
+			if tc.allowed {
+				require.NoError(t, err)
+				assert.Equal(t, int32(0), resultCode(mockStream.Responses))
+
+				return
+			}
+
+			require.ErrorIs(t, err, engine.ErrWorkingDirNotAllowed)
+			assert.Contains(t, stderr(mockStream.Responses), "outside of the allowed roots")
+			assert.Empty(t, stdout(mockStream.Responses))
+		})
+	}
+}
+
+func TestTofuEngine_InitMissingAllowedRoot(t *testing.T) {
+	t.Parallel()
+
+	mockStream := &MockInitServer{}
+	err := (&engine.TofuEngine{}).Init(&tgengine.InitRequest{Meta: stringMeta("allowed_roots", filepath.Join(t.TempDir(), "missing"))}, mockStream)
+	require.Error(t, err)
+	assert.Equal(t, int32(1), mockStream.Responses[len(mockStream.Responses)-1].GetResultCode())
+}
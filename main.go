@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"time"
 
-	tgengine "github.com/gruntwork-io/terragrunt-engine-go/engine"
 	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
 	"github.com/hashicorp/go-hclog"
 	"github.com/sirupsen/logrus"
@@ -11,39 +14,82 @@ import (
 	"github.com/hashicorp/go-plugin"
 )
 
-const (
-	engineLogLevelEnv     = "TG_ENGINE_LOG_LEVEL"
-	defaultEngineLogLevel = "INFO"
-)
+const traceShutdownTimeout = 10 * time.Second
+
+// commands are the maintenance subcommands of the engine binary, without one it serves the plugin
+var commands = map[string]func(args []string, out io.Writer) error{
+	auditCommand:       runAuditCommand,
+	cacheCommand:       runCacheCommand,
+	serveCommand:       runServeCommand,
+	stateBackupCommand: runStateBackupCommand,
+}
 
 func main() {
-	engineLogLevel := os.Getenv(engineLogLevelEnv)
-	if engineLogLevel == "" {
-		engineLogLevel = defaultEngineLogLevel
+	if len(os.Args) > 1 && os.Args[1] == engine.SandboxInitCommand {
+		if err := engine.SandboxInit(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+			os.Exit(1)
+		}
+
+		return
 	}
 
-	parsedLevel, err := logrus.ParseLevel(engineLogLevel)
-	if err != nil {
-		logrus.Warnf("Error parsing log level: %v", err)
-		parsedLevel = logrus.InfoLevel
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			if err := command(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+
+			return
+		}
 	}
 
-	logrus.SetLevel(parsedLevel)
+	// go-plugin parses JSON lines on stderr, so that Terragrunt logs them with their levels and fields
+	logger := configureLogging(engine.LogFormatJSON)
 
-	logger := hclog.NewInterceptLogger(&hclog.LoggerOptions{
-		Level: hclog.LevelFromString(engineLogLevel),
-	})
+	stopTracing := startTracing()
+	defer stopTracing()
+
+	plugin.Serve(engine.PluginServeConfig(logger))
+}
+
+// configureLogging configures the engine logs from TG_ENGINE_LOG_LEVEL and TG_ENGINE_LOG_FORMAT, in defaultFormat
+// when the format isn't set, and returns the logger of go-plugin
+func configureLogging(defaultFormat string) hclog.Logger {
+	format := os.Getenv(engine.LogFormatEnv)
+	if format == "" {
+		format = defaultFormat
+	}
 
-	plugin.Serve(&plugin.ServeConfig{
-		Logger: logger,
-		HandshakeConfig: plugin.HandshakeConfig{
-			ProtocolVersion:  1,
-			MagicCookieKey:   "engine",
-			MagicCookieValue: "terragrunt",
-		},
-		Plugins: map[string]plugin.Plugin{
-			"tofu": &tgengine.TerragruntGRPCEngine{Impl: &engine.TofuEngine{}},
-		},
-		GRPCServer: plugin.DefaultGRPCServer,
+	logger, err := engine.ConfigureLogging(engine.LogConfig{
+		Format: format,
+		Level:  os.Getenv(engine.LogLevelEnv),
+		Output: os.Stderr,
 	})
+	if err != nil {
+		logrus.Warnf("Error configuring logging: %v", err)
+	}
+
+	return logger
+}
+
+// startTracing exports the engine traces as configured by TG_ENGINE_TRACE_EXPORTER, the returned function flushes
+// the remaining spans
+func startTracing() func() {
+	shutdown, err := engine.StartTracing(context.Background(), engine.TracingConfigFromEnv())
+	if err != nil {
+		logrus.Warnf("Tracing disabled: %v", err)
+
+		return func() {}
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+		defer cancel()
+
+		if err := shutdown(ctx); err != nil {
+			logrus.Warnf("Failed to flush traces: %v", err)
+		}
+	}
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	serveCommand           = "serve"
+	defaultShutdownTimeout = 10 * time.Minute
+)
+
+var errServeUsage = errors.New("usage: serve -listen unix:///PATH|tcp://HOST:PORT [-shutdown-timeout DURATION] " +
+	"[-tls-cert FILE -tls-key FILE [-tls-client-ca FILE]] [-auth-config FILE] [-reflection] [-metrics-address HOST:PORT]")
+
+// runServeCommand serves the engine on a plain gRPC server until SIGTERM or SIGINT, then stops it gracefully
+func runServeCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet(serveCommand, flag.ContinueOnError)
+	flags.SetOutput(out)
+
+	listen := flags.String("listen", "", "address to listen on, unix:///run/tofu-engine.sock or tcp://0.0.0.0:7000")
+	shutdownTimeout := flags.Duration("shutdown-timeout", defaultShutdownTimeout, "how long running requests may finish after SIGTERM")
+
+	tlsConfig := engine.ServerTLSConfig{}
+
+	flags.StringVar(&tlsConfig.CertFile, "tls-cert", "", "server certificate, enables TLS")
+	flags.StringVar(&tlsConfig.KeyFile, "tls-key", "", "key of the server certificate")
+	flags.StringVar(&tlsConfig.ClientCAFile, "tls-client-ca", "", "CA bundle which client certificates must be signed by, enables mutual TLS")
+
+	authConfig := flags.String("auth-config", "", "HCL file of the identities allowed to call the engine and their policies")
+
+	enableReflection := flags.Bool("reflection", false, "register the gRPC server reflection service, e.g. for grpcurl")
+	metricsAddress := flags.String("metrics-address", "", "address to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9464")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *listen == "" || flags.NArg() > 0 {
+		return errServeUsage
+	}
+
+	configureLogging(engine.LogFormatText)
+
+	stopTracing := startTracing()
+	defer stopTracing()
+
+	listener, err := engine.Listen(*listen)
+	if err != nil {
+		return err
+	}
+
+	var opts []grpc.ServerOption
+
+	if tlsConfig != (engine.ServerTLSConfig{}) {
+		config, err := tlsConfig.TLSConfig()
+		if err != nil {
+			listener.Close()
+
+			return err
+		}
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	} else if strings.HasPrefix(*listen, "tcp://") {
+		logrus.Warn("Serving over TCP without TLS, any client which can connect can run tofu")
+	}
+
+	if *authConfig != "" {
+		auth, err := engine.LoadAuthConfig(*authConfig)
+		if err != nil {
+			listener.Close()
+
+			return err
+		}
+
+		opts = append(opts, auth.ServerOptions()...)
+	}
+
+	if *metricsAddress != "" {
+		metrics, err := engine.StartMetricsServer(*metricsAddress)
+		if err != nil {
+			listener.Close()
+
+			return err
+		}
+
+		defer metrics.Close()
+	}
+
+	server := engine.NewServer(listener, opts...)
+
+	if *enableReflection {
+		server.EnableReflection()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		logrus.Info("Received a stop signal")
+
+		stopCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+
+		server.Stop(stopCtx)
+	}()
+
+	return server.Serve()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/terragrunt-engine-opentofu/engine"
+)
+
+const stateBackupCommand = "state-backup"
+
+var errStateBackupUsage = errors.New("usage: state-backup list [-dir DIR] [-unit PATH] | " +
+	"state-backup restore -unit PATH [-name SNAPSHOT] [-dir DIR] [-tofu BINARY] [-force] [-executor-option KEY=VALUE]...")
+
+// runStateBackupCommand lists state backups or restores one of them
+func runStateBackupCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errStateBackupUsage
+	}
+
+	defaultDir, err := engine.DefaultStateBackupDir()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet(stateBackupCommand+" "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+
+	dir := flags.String("dir", defaultDir, "state backup directory")
+	unit := flags.String("unit", "", "unit directory")
+
+	switch args[0] {
+	case "list":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		backups, err := engine.ListStateBackups(*dir, *unit)
+		if err != nil {
+			return err
+		}
+
+		writer := tabwriter.NewWriter(out, 0, 0, tabwriterPadding, ' ', 0)
+
+		fmt.Fprintln(writer, "UNIT\tSNAPSHOT\tSERIAL\tSIZE\tTIME")
+
+		for _, backup := range backups {
+			fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%s\n", backup.Unit, backup.Name, backup.Serial, backup.Size, backup.Time.Format(time.RFC3339))
+		}
+
+		return writer.Flush()
+	case "restore":
+		name := flags.String("name", "", "snapshot to restore, the newest one by default")
+		binary := flags.String("tofu", "tofu", "OpenTofu binary")
+		force := flags.Bool("force", false, "push the snapshot even if its serial is older or its lineage differs")
+
+		executorOptions := map[string]string{}
+		flags.Func("executor-option", "executor meta option of the engine as KEY=VALUE, e.g. executor=ssh, may be repeated", func(option string) error {
+			key, value, found := strings.Cut(option, "=")
+			if !found {
+				return fmt.Errorf("executor option %q must be KEY=VALUE", option)
+			}
+
+			executorOptions[key] = value
+
+			return nil
+		})
+
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		if *unit == "" {
+			return errStateBackupUsage
+		}
+
+		executor, err := engine.NewExecutor(executorOptions)
+		if err != nil {
+			return err
+		}
+
+		backup, err := engine.FindStateBackup(*dir, *unit, *name)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Restoring %s (serial %d) to %s\n", backup.Name, backup.Serial, backup.Unit)
+
+		return engine.RestoreStateBackup(backup, executor, *binary, *force, out, os.Stderr)
+	default:
+		return errStateBackupUsage
+	}
+}